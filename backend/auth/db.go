@@ -32,6 +32,13 @@ func Connect() *mongo.Client {
 
 	log.Println("Connected to MongoDB")
 
+	if err := ensureTokenIndexes(ctx); err != nil {
+		log.Printf("Error creating token indexes: %v", err)
+	}
+	if err := markExistingUsersVerified(ctx); err != nil {
+		log.Printf("Error marking existing users verified: %v", err)
+	}
+
 	return Client
 }
 
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"example.com/collaborative-coding-editor/config"
@@ -13,6 +14,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -36,6 +38,10 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing Fields", http.StatusBadRequest)
 		return
 	}
+	if !validEmail(req.Email) {
+		http.Error(w, "Invalid Email", http.StatusBadRequest)
+		return
+	}
 
 	userCollection := GetCollection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -78,8 +84,16 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The account starts unverified, the user can ask for another link later
+	token, err := createEmailVerification(ctx, &user)
+	if err != nil {
+		log.Printf("Error creating email verification: %v", err)
+	} else {
+		go sendEmailVerification(user, token)
+	}
+
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User successfully registered"})
+	json.NewEncoder(w).Encode(map[string]string{"message": "User successfully registered, check your email to verify it"})
 }
 
 // Login Request
@@ -125,121 +139,139 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create the access toke
-	accessClaims := jwt.MapClaims{
-		"user_id":  user.ID.Hex(),
-		"role":     user.Role,
-		"exp":      time.Now().Add(72 * time.Hour).Unix(),
-		"email":    user.Email,
-		"username": user.Username,
-	}
-	accessTokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessToken, err := accessTokenObj.SignedString([]byte(config.AppConfig.JWTSecret))
+	// Create the access token and a refresh token starting a new family
+	tokens, err := issueTokens(ctx, &user, "")
 	if err != nil {
-		log.Printf("Error signing JWT: %v", err)
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		log.Printf("Error issuing tokens: %v", err)
+		http.Error(w, "Error processing login", http.StatusInternalServerError)
 		return
 	}
 
-	// Create a refresh token
-	refreshClaims := jwt.MapClaims{
-		"user_id": user.ID.Hex(),
-		"exp":     time.Now().Add(30 * 24 * time.Hour).Unix(),
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+
+}
+
+// Refresh Token Request
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Exchange a refresh token for a new access token and refresh token.
+// Every refresh token can be used once, the response carries its successor.
+func Refresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid Request Payload", http.StatusBadRequest)
+		return
 	}
-	refereshTokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshToken, err := refereshTokenObj.SignedString([]byte(config.AppConfig.JWTSecret))
-	if err != nil {
-		log.Printf("Error signing refresh token: %v", err)
-		http.Error(w, "Error generating refresh token", http.StatusInternalServerError)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stored, err := rotateRefreshToken(ctx, req.RefreshToken)
+	switch err {
+	case nil:
+	case ErrInvalidRefreshToken:
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case ErrRefreshTokenExpired:
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	case ErrRefreshTokenReused:
+		http.Error(w, "Refresh token already used, please log in again", http.StatusUnauthorized)
+		return
+	default:
+		log.Printf("Error rotating refresh token: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
 		return
 	}
 
-	// Store the refresh token in DB
-	refreshCollection := GetCollection("refresh_tokens")
-	refreshTokenRecord := models.RefreshToken{
-		ID:        primitive.NewObjectID(),
-		UserID:    user.ID,
-		Token:     refreshToken,
-		ExpiresAt: time.Now().Add(30 * 24 * time.Hour),
-		CreatedAt: time.Now(),
+	// The new access token carries the user's current role and profile
+	var user models.User
+	if err := GetCollection("users").FindOne(ctx, bson.M{"_id": stored.UserID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
 	}
-	_, err = refreshCollection.InsertOne(ctx, refreshTokenRecord)
+
+	tokens, err := issueTokens(ctx, &user, stored.FamilyID)
 	if err != nil {
-		log.Printf("Error storing refresh token: %v", err)
-		http.Error(w, "Error processing login", http.StatusInternalServerError)
+		log.Printf("Error issuing tokens: %v", err)
+		http.Error(w, "Error signing new access token", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(TokenResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-	})
-
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
 }
 
-// Validate the refresh token and generate a new one
-func Refresh(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		RefreshToken string `json:"refresh_token"`
-	}
+// Logout -> revokes the refresh token and every token rotated from it
+func Logout(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
 		http.Error(w, "Invalid Request Payload", http.StatusBadRequest)
 		return
 	}
 
-	token, err := jwt.Parse(req.RefreshToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return []byte(config.AppConfig.RefreshTokenSecret), nil
-	})
-	if err != nil || !token.Valid {
+	// Expired tokens may still be logged out, their family may live on
+	if _, err := parseRefreshToken(req.RefreshToken); err != nil && err != ErrRefreshTokenExpired {
 		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
 		return
 	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || claims["user_id"] == nil {
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-		return
-	}
-	userID := claims["user_id"].(string)
-	userRole := claims["role"].(string)
 
 	refreshCollection := GetCollection("refresh_tokens")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var storedToken models.RefreshToken
-	err = refreshCollection.FindOne(ctx, bson.M{"token": req.RefreshToken}).Decode(&storedToken)
-	if err != nil {
-		http.Error(w, "Refresh token not found", http.StatusUnauthorized)
+	var stored models.RefreshToken
+	err := refreshCollection.FindOne(ctx, bson.M{"token_hash": hashToken(req.RefreshToken)}).Decode(&stored)
+	if err == nil {
+		err = revokeFamily(ctx, stored.FamilyID)
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Error revoking refresh tokens: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
 		return
 	}
 
-	if time.Now().After(storedToken.ExpiresAt) {
-		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
-		return
+	// The access token sent along is revoked too, whatever login it belongs to
+	if parts := strings.Split(r.Header.Get("Authorization"), " "); len(parts) == 2 && parts[0] == "Bearer" {
+		if claims, err := middleware.ParseAccessToken(parts[1]); err == nil {
+			if err := revokeAccessToken(ctx, claims); err != nil {
+				log.Printf("Error revoking access token: %v", err)
+			}
+		}
 	}
 
-	// TODO: delete the refresh token for one time usage
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
 
-	newAccessClaims := jwt.MapClaims{
-		"user_id": userID,
-		"role":    userRole,
-		"exp":     time.Now().Add(72 * time.Hour).Unix(),
+// LogoutAll -> revokes the refresh tokens of the user on every device
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
 	}
-	newAccessTokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, newAccessClaims)
-	newAccessToken, err := newAccessTokenObj.SignedString([]byte(config.AppConfig.JWTSecret))
+	userIDStr, _ := claims["user_id"].(string)
+	userID, err := primitive.ObjectIDFromHex(userIDStr)
 	if err != nil {
-		log.Printf("Error signing new access token: %v", err)
-		http.Error(w, "Error signing new access token", http.StatusInternalServerError)
+		http.Error(w, "Invalid User Id", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := revokeUserTokens(ctx, userID); err != nil {
+		log.Printf("Error revoking refresh tokens: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"access_token": newAccessToken,
-	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out on all devices"})
 }
 
 // Returns the active invitation for logged_in user
@@ -249,9 +281,9 @@ func GetActiveInvitations(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	userEmail, ok := claims["email"].(string)
-	if !ok || userEmail == "" {
-		http.Error(w, "Email not found in token", http.StatusUnauthorized)
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		http.Error(w, "Invalid user id", http.StatusUnauthorized)
 		return
 	}
 
@@ -259,6 +291,18 @@ func GetActiveInvitations(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Invitations sent to an email are only shown once it is verified
+	userEmail, verified, err := VerifiedEmail(ctx, userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if !verified {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]models.Invitation{})
+		return
+	}
+
 	filter := bson.M{
 		"invited_email": userEmail,
 		"used":          false,
@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "editor"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "http://api.test/auth/oidc/callback"
+)
+
+// mockIssuer is an OpenID Connect issuer serving discovery, keys and the
+// token endpoint. Codes are registered with the ID token they are traded for.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu sync.Mutex
+	// Code -> ID token and the PKCE challenge the code was issued for
+	codes map[string]mockCode
+	// Requests to the keys endpoint
+	keyFetches int
+}
+
+type mockCode struct {
+	idToken   string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, kid: "key-1", codes: make(map[string]mockCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.server.URL,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JWKSURI:               m.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.keyFetches++
+		m.mu.Unlock()
+		pub := m.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// token trades a registered code for its ID token, checking the client and verifier
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, code string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != testClientID || secret != testClientSecret {
+		fail(http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectURL {
+		fail(http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	m.mu.Lock()
+	code, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+	if !ok || codeChallenge(r.PostFormValue("code_verifier")) != code.challenge {
+		fail(http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": code.idToken, "token_type": "Bearer"})
+}
+
+// issue registers a code for an ID token
+func (m *mockIssuer) issue(code, challenge, idToken string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[code] = mockCode{idToken: idToken, challenge: challenge}
+}
+
+// claims -> valid ID token claims for the test client
+func (m *mockIssuer) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            m.server.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada",
+	}
+}
+
+// sign -> ID token signed with the issuer's key
+func (m *mockIssuer) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (m *mockIssuer) provider() *oidcProvider {
+	return newOIDCProvider(m.server.URL, testClientID, testClientSecret, testRedirectURL, "openid email profile")
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := issuer.provider()
+	ctx := context.Background()
+
+	claims, err := p.verifyIDToken(ctx, issuer.sign(t, issuer.claims("n1")), "n1")
+	if err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if claims["email"] != "ada@example.com" {
+		t.Fatalf("claims = %v", claims)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		token  func() string
+		nonce  string
+		reason error
+	}{
+		{name: "nonce", nonce: "other", token: func() string {
+			return issuer.sign(t, issuer.claims("n1"))
+		}},
+		{name: "audience", nonce: "n1", reason: jwt.ErrTokenInvalidAudience, token: func() string {
+			c := issuer.claims("n1")
+			c["aud"] = "another-client"
+			return issuer.sign(t, c)
+		}},
+		{name: "authorized party", nonce: "n1", token: func() string {
+			c := issuer.claims("n1")
+			c["aud"] = []string{testClientID, "another-client"}
+			c["azp"] = "another-client"
+			return issuer.sign(t, c)
+		}},
+		{name: "issuer", nonce: "n1", reason: jwt.ErrTokenInvalidIssuer, token: func() string {
+			c := issuer.claims("n1")
+			c["iss"] = "https://evil.example.com"
+			return issuer.sign(t, c)
+		}},
+		{name: "expired", nonce: "n1", reason: jwt.ErrTokenExpired, token: func() string {
+			c := issuer.claims("n1")
+			c["exp"] = time.Now().Add(-2 * oidcLeeway).Unix()
+			return issuer.sign(t, c)
+		}},
+		{name: "no expiry", nonce: "n1", reason: jwt.ErrTokenRequiredClaimMissing, token: func() string {
+			c := issuer.claims("n1")
+			delete(c, "exp")
+			return issuer.sign(t, c)
+		}},
+		{name: "unknown kid", nonce: "n1", reason: ErrUnknownSigningKey, token: func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, issuer.claims("n1"))
+			token.Header["kid"] = "key-2"
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}},
+		{name: "wrong key", nonce: "n1", reason: jwt.ErrTokenSignatureInvalid, token: func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, issuer.claims("n1"))
+			token.Header["kid"] = issuer.kid
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}},
+		{name: "symmetric algorithm", nonce: "n1", reason: jwt.ErrTokenSignatureInvalid, token: func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, issuer.claims("n1"))
+			token.Header["kid"] = issuer.kid
+			signed, _ := token.SignedString([]byte(testClientSecret))
+			return signed
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.verifyIDToken(ctx, tt.token(), tt.nonce)
+			if err == nil {
+				t.Fatal("token accepted")
+			}
+			if tt.reason != nil && !errors.Is(err, tt.reason) {
+				t.Fatalf("error = %v, want %v", err, tt.reason)
+			}
+		})
+	}
+
+	// Unknown keys do not make every token download the keys again
+	issuer.mu.Lock()
+	fetches := issuer.keyFetches
+	issuer.mu.Unlock()
+	if fetches != 1 {
+		t.Fatalf("keys downloaded %d times, want 1", fetches)
+	}
+}
+
+func TestDiscoverRejectsOtherIssuer(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := newOIDCProvider(issuer.server.URL+"/", testClientID, "", testRedirectURL, "openid")
+	if _, err := p.discover(context.Background()); err == nil || !strings.Contains(err.Error(), "discovery document is for issuer") {
+		t.Fatalf("error = %v, want an issuer mismatch", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := issuer.provider()
+	ctx := context.Background()
+
+	issuer.issue("code-1", codeChallenge("verifier"), "id-token")
+	if _, err := p.exchange(ctx, "code-1", "wrong verifier"); err == nil {
+		t.Fatal("code exchanged with the wrong verifier")
+	}
+
+	issuer.issue("code-2", codeChallenge("verifier"), "id-token")
+	idToken, err := p.exchange(ctx, "code-2", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idToken != "id-token" {
+		t.Fatalf("id token = %q", idToken)
+	}
+	if _, err := p.exchange(ctx, "code-2", "verifier"); err == nil {
+		t.Fatal("code exchanged twice")
+	}
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/mail"
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Forgot Password Request in the payload
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// Reset Password Request in the payload
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ForgotPassword -> mails a password reset link to the user. The answer is
+// the same whether or not the email is registered.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid Request Payload", http.StatusBadRequest)
+		return
+	}
+	if req.Email == "" {
+		http.Error(w, "Missing Fields", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := GetCollection("users").FindOne(ctx, bson.M{"email": req.Email}).Decode(&user)
+	switch err {
+	case nil:
+		token, err := createPasswordReset(ctx, user.ID)
+		if err != nil {
+			log.Printf("Error creating password reset: %v", err)
+			http.Error(w, "Error processing request", http.StatusInternalServerError)
+			return
+		}
+		// Sending may take a while, the answer must not tell whether it happened
+		go sendPasswordReset(user, token)
+	case mongo.ErrNoDocuments:
+	default:
+		log.Printf("Error finding user: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the email is registered, a password reset link has been sent"})
+}
+
+// ResetPassword -> sets a new password with a reset token and logs the user
+// out everywhere
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid Request Payload", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		http.Error(w, "Missing Fields", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Using the token and checking it happen at once, a token works only once
+	now := time.Now()
+	filter := bson.M{
+		"token_hash": hashToken(req.Token),
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}
+	var reset models.PasswordReset
+	err := GetCollection("password_resets").FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error using password reset: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), config.AppConfig.BCryptCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+	result, err := GetCollection("users").UpdateOne(ctx, bson.M{"_id": reset.UserID}, bson.M{"$set": bson.M{"password": string(hashedPassword)}})
+	if err != nil {
+		log.Printf("Error updating password: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	// Whoever knew the old password is logged out
+	if err := revokeUserTokens(ctx, reset.UserID); err != nil {
+		log.Printf("Error revoking tokens after password reset: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset"})
+}
+
+// createPasswordReset stores a new reset token for the user, replacing any
+// earlier one, and returns the token
+func createPasswordReset(ctx context.Context, userID primitive.ObjectID) (string, error) {
+	token, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	resetCollection := GetCollection("password_resets")
+	if _, err := resetCollection.DeleteMany(ctx, bson.M{"user_id": userID, "used_at": bson.M{"$exists": false}}); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = resetCollection.InsertOne(ctx, models.PasswordReset{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(config.AppConfig.PasswordResetTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Mail the reset link to the user
+func sendPasswordReset(user models.User, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	link := appLink("/reset-password", token)
+	err := mail.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomebody asked to reset the password of your account. "+
+			"Open this link to choose a new one:\n\n%s\n\n"+
+			"The link works once and expires in %s. If you did not ask for it, you can ignore this mail.\n",
+			user.Username, link, config.AppConfig.PasswordResetTTL),
+	})
+	if err != nil {
+		log.Printf("Error sending password reset mail to user %s: %v", user.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// How often revocations made on other instances are picked up
+	revocationSyncInterval = 15 * time.Second
+	// Overlap of two syncs so that entries written while syncing are not missed
+	revocationSyncOverlap = 5 * time.Second
+)
+
+// Kinds of revocation list entries
+const (
+	revokedToken   = "token"
+	revokedSession = "session"
+	revokedUser    = "user"
+)
+
+// In-memory copy of the revocation list, consulted on every request
+var revoked = struct {
+	sync.RWMutex
+	entries map[string]models.RevokedToken // By kind:value
+}{entries: make(map[string]models.RevokedToken)}
+
+func revocationKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// Add an entry to the in-memory list, keeping the latest revocation
+func cacheRevocation(entry models.RevokedToken) {
+	key := revocationKey(entry.Kind, entry.Value)
+	revoked.Lock()
+	defer revoked.Unlock()
+	if old, ok := revoked.entries[key]; ok && old.RevokedAt.After(entry.RevokedAt) {
+		return
+	}
+	revoked.entries[key] = entry
+}
+
+// revoke adds an entry to the revocation list. It takes effect on this
+// instance right away and on the others with their next sync.
+func revoke(ctx context.Context, kind, value string, expiresAt time.Time) error {
+	entry := models.RevokedToken{
+		ID:        primitive.NewObjectID(),
+		Kind:      kind,
+		Value:     value,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	cacheRevocation(entry)
+	_, err := GetCollection("revoked_tokens").InsertOne(ctx, entry)
+	return err
+}
+
+// revokeSession revokes the access tokens issued with a refresh token family
+func revokeSession(ctx context.Context, familyID string) error {
+	return revoke(ctx, revokedSession, familyID, time.Now().Add(config.AppConfig.AccessTokenTTL))
+}
+
+// RevokeUser revokes every access token issued to a user so far, for when
+// the user logs out everywhere or is removed
+func RevokeUser(ctx context.Context, userID primitive.ObjectID) error {
+	return revoke(ctx, revokedUser, userID.Hex(), time.Now().Add(config.AppConfig.AccessTokenTTL))
+}
+
+// TokenRevoked -> true if the access token with the given claims is on the
+// revocation list, either itself, its session or its user
+func TokenRevoked(claims jwt.MapClaims) bool {
+	now := time.Now()
+	revoked.RLock()
+	defer revoked.RUnlock()
+
+	if jti, _ := claims["jti"].(string); jti != "" {
+		if entry, ok := revoked.entries[revocationKey(revokedToken, jti)]; ok && now.Before(entry.ExpiresAt) {
+			return true
+		}
+	}
+	if sid, _ := claims["sid"].(string); sid != "" {
+		if entry, ok := revoked.entries[revocationKey(revokedSession, sid)]; ok && now.Before(entry.ExpiresAt) {
+			return true
+		}
+	}
+	if userID, _ := claims["user_id"].(string); userID != "" {
+		if entry, ok := revoked.entries[revocationKey(revokedUser, userID)]; ok && now.Before(entry.ExpiresAt) {
+			// Tokens without iat predate the revocation list. Tokens issued
+			// right after the revocation, e.g. by logging in again, are valid.
+			iat, _ := claims["iat"].(float64)
+			return iat < float64(entry.RevokedAt.UnixNano())/1e9
+		}
+	}
+	return false
+}
+
+// StartRevocationSync loads the revocation list and keeps the in-memory copy
+// up to date with the entries other instances add
+func StartRevocationSync() {
+	last, err := syncRevocations(time.Time{})
+	if err != nil {
+		log.Printf("Error loading revoked tokens: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(revocationSyncInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			synced, err := syncRevocations(last.Add(-revocationSyncOverlap))
+			if err != nil {
+				log.Printf("Error syncing revoked tokens: %v", err)
+				continue
+			}
+			last = synced
+			pruneRevocations()
+		}
+	}()
+}
+
+// syncRevocations loads the entries revoked since the given time that have
+// not expired yet and returns when it started
+func syncRevocations(since time.Time) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	started := time.Now()
+	filter := bson.M{"expires_at": bson.M{"$gt": started}}
+	if !since.IsZero() {
+		filter["revoked_at"] = bson.M{"$gte": since}
+	}
+	cursor, err := GetCollection("revoked_tokens").Find(ctx, filter, options.Find().SetSort(bson.M{"revoked_at": 1}))
+	if err != nil {
+		return since, err
+	}
+	var entries []models.RevokedToken
+	if err := cursor.All(ctx, &entries); err != nil {
+		return since, err
+	}
+	for _, entry := range entries {
+		cacheRevocation(entry)
+	}
+	return started, nil
+}
+
+// Drop the entries of the in-memory list no valid token can match anymore
+func pruneRevocations() {
+	now := time.Now()
+	revoked.Lock()
+	defer revoked.Unlock()
+	for key, entry := range revoked.entries {
+		if !now.Before(entry.ExpiresAt) {
+			delete(revoked.entries, key)
+		}
+	}
+}
+
+// tokenExpiry -> expiry time of a token from its exp claim
+func tokenExpiry(claims jwt.MapClaims) time.Time {
+	exp, _ := claims["exp"].(float64)
+	return time.Unix(int64(exp), 0)
+}
+
+// revokeAccessToken revokes a single access token until it expires
+func revokeAccessToken(ctx context.Context, claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil
+	}
+	return revoke(ctx, revokedToken, jti, tokenExpiry(claims))
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useRevocations gives a test its own revocation list
+func useRevocations(t *testing.T, entries ...models.RevokedToken) {
+	t.Helper()
+	revoked.Lock()
+	prev := revoked.entries
+	revoked.entries = make(map[string]models.RevokedToken)
+	revoked.Unlock()
+	t.Cleanup(func() {
+		revoked.Lock()
+		revoked.entries = prev
+		revoked.Unlock()
+	})
+	for _, entry := range entries {
+		cacheRevocation(entry)
+	}
+}
+
+// issuedAt -> iat claim as newAccessToken writes it
+func issuedAt(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func TestTokenRevokedForUser(t *testing.T) {
+	revokedAt := time.Now().Truncate(time.Second).Add(500 * time.Millisecond)
+	useRevocations(t, models.RevokedToken{Kind: revokedUser, Value: "u1", RevokedAt: revokedAt, ExpiresAt: time.Now().Add(time.Hour)})
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   bool
+	}{
+		{"issued before", jwt.MapClaims{"user_id": "u1", "iat": issuedAt(revokedAt.Add(-time.Minute))}, true},
+		{"issued earlier in the same second", jwt.MapClaims{"user_id": "u1", "iat": issuedAt(revokedAt.Add(-100 * time.Millisecond))}, true},
+		{"issued later in the same second", jwt.MapClaims{"user_id": "u1", "iat": issuedAt(revokedAt.Add(100 * time.Millisecond))}, false},
+		{"issued after", jwt.MapClaims{"user_id": "u1", "iat": issuedAt(revokedAt.Add(time.Minute))}, false},
+		{"without iat", jwt.MapClaims{"user_id": "u1"}, true},
+		{"other user", jwt.MapClaims{"user_id": "u2", "iat": issuedAt(revokedAt.Add(-time.Minute))}, false},
+	}
+	for _, tt := range tests {
+		if got := TokenRevoked(tt.claims); got != tt.want {
+			t.Errorf("%s: TokenRevoked = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTokenRevokedByTokenAndSession(t *testing.T) {
+	now := time.Now()
+	useRevocations(t,
+		models.RevokedToken{Kind: revokedToken, Value: "jti-1", RevokedAt: now, ExpiresAt: now.Add(time.Hour)},
+		models.RevokedToken{Kind: revokedSession, Value: "family-1", RevokedAt: now, ExpiresAt: now.Add(time.Hour)},
+		models.RevokedToken{Kind: revokedToken, Value: "jti-old", RevokedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)},
+	)
+
+	if !TokenRevoked(jwt.MapClaims{"jti": "jti-1", "sid": "family-2", "user_id": "u"}) {
+		t.Error("revoked token accepted")
+	}
+	if !TokenRevoked(jwt.MapClaims{"jti": "jti-2", "sid": "family-1", "user_id": "u"}) {
+		t.Error("token of a revoked session accepted")
+	}
+	if TokenRevoked(jwt.MapClaims{"jti": "jti-2", "sid": "family-2", "user_id": "u"}) {
+		t.Error("unrelated token rejected")
+	}
+	// Entries past the expiry of every token they could match are ignored
+	if TokenRevoked(jwt.MapClaims{"jti": "jti-old"}) {
+		t.Error("expired revocation still applied")
+	}
+	pruneRevocations()
+	revoked.RLock()
+	_, kept := revoked.entries[revocationKey(revokedToken, "jti-old")]
+	revoked.RUnlock()
+	if kept {
+		t.Error("expired revocation not pruned")
+	}
+}
@@ -11,10 +11,18 @@ func RegisterAuthRoutes(router *mux.Router) {
 	router.HandleFunc("/auth/register", Register).Methods("POST")
 	router.HandleFunc("/auth/login", Login).Methods("POST")
 	router.HandleFunc("/auth/refresh", Refresh).Methods("POST")
+	router.HandleFunc("/auth/logout", Logout).Methods("POST")
+	router.HandleFunc("/auth/password/forgot", ForgotPassword).Methods("POST")
+	router.HandleFunc("/auth/password/reset", ResetPassword).Methods("POST")
+	router.HandleFunc("/auth/email/verify", VerifyEmail).Methods("POST")
+	router.HandleFunc("/auth/oidc/login", OIDCLogin).Methods("GET")
+	router.HandleFunc("/auth/oidc/callback", OIDCCallback).Methods("GET")
 
 	//Protected Routes
 	protected := router.PathPrefix("/auth").Subrouter()
 	protected.Use(middleware.JWTAuthentication)
 	protected.HandleFunc("/profile", Profile).Methods("GET")
 	protected.HandleFunc("/invitations", GetActiveInvitations).Methods("GET")
+	protected.HandleFunc("/logout-all", LogoutAll).Methods("POST")
+	protected.HandleFunc("/email/resend", ResendVerification).Methods("POST")
 }
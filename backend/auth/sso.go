@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long the user has to sign in with the issuer
+const oidcLoginTTL = 10 * time.Minute
+
+// ssoStore keeps the pending logins and the users of single sign-on
+type ssoStore interface {
+	// Save a login started with the issuer
+	saveLogin(ctx context.Context, login models.OIDCLogin) error
+	// Remove and return the unexpired login with the state hash, nil if there is none
+	takeLogin(ctx context.Context, stateHash string) (*models.OIDCLogin, error)
+	// Find or create the user with a verified email
+	user(ctx context.Context, email string, claims jwt.MapClaims) (*models.User, error)
+	// Start a new login of the user
+	issueTokens(ctx context.Context, user *models.User) (*TokenResponse, error)
+}
+
+// Store of the single sign-on handlers, replaced in tests
+var sso ssoStore = mongoSSOStore{}
+
+// OIDCLogin -> sends the user to the issuer to sign in
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// The state ties the callback to this login, the nonce the ID token and
+	// the verifier the code exchange
+	var secrets [3]string
+	for i := range secrets {
+		secret, err := newSecretToken()
+		if err != nil {
+			http.Error(w, "Error processing request", http.StatusInternalServerError)
+			return
+		}
+		secrets[i] = secret
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+	authURL, err := oidc.authCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		log.Printf("Error discovering OIDC issuer: %v", err)
+		http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	err = sso.saveLogin(ctx, models.OIDCLogin{
+		ID:           primitive.NewObjectID(),
+		StateHash:    hashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    now.Add(oidcLoginTTL),
+		CreatedAt:    now,
+	})
+	if err != nil {
+		log.Printf("Error saving OIDC login: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback -> signs the user in with the authorization code from the
+// issuer and hands the project's own tokens to the frontend
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("OIDC sign-in failed: %s %s", e, q.Get("error_description"))
+		ssoFailed(w, r, "Single sign-on was cancelled or failed")
+		return
+	}
+	state, code := q.Get("state"), q.Get("code")
+	if state == "" || code == "" {
+		ssoFailed(w, r, "Invalid single sign-on response")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// Each login can be completed once
+	login, err := sso.takeLogin(ctx, hashToken(state))
+	if err != nil {
+		log.Printf("Error finding OIDC login: %v", err)
+		ssoFailed(w, r, "Error processing request")
+		return
+	}
+	if login == nil {
+		ssoFailed(w, r, "Single sign-on expired, please try again")
+		return
+	}
+
+	idToken, err := oidc.exchange(ctx, code, login.CodeVerifier)
+	if err != nil {
+		log.Printf("Error exchanging OIDC code: %v", err)
+		ssoFailed(w, r, "Single sign-on failed")
+		return
+	}
+	claims, err := oidc.verifyIDToken(ctx, idToken, login.Nonce)
+	if err != nil {
+		log.Printf("Invalid OIDC ID token: %v", err)
+		ssoFailed(w, r, "Single sign-on failed")
+		return
+	}
+
+	// Accounts are matched by email, which only works if the issuer vouches for it
+	email, _ := claims["email"].(string)
+	if !validEmail(email) {
+		ssoFailed(w, r, "Your sign-on account has no email")
+		return
+	}
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		ssoFailed(w, r, "Your email is not verified by the sign-on provider")
+		return
+	}
+
+	user, err := sso.user(ctx, email, claims)
+	if err != nil {
+		log.Printf("Error finding user for OIDC login: %v", err)
+		ssoFailed(w, r, "Error processing request")
+		return
+	}
+	tokens, err := sso.issueTokens(ctx, user)
+	if err != nil {
+		log.Printf("Error issuing tokens: %v", err)
+		ssoFailed(w, r, "Error processing request")
+		return
+	}
+
+	// The fragment keeps the tokens out of server logs and Referer headers
+	fragment := url.Values{"access_token": {tokens.AccessToken}, "refresh_token": {tokens.RefreshToken}}
+	http.Redirect(w, r, strings.TrimRight(config.AppConfig.AppURL, "/")+"/sso/callback#"+fragment.Encode(), http.StatusFound)
+}
+
+// ssoFailed sends the user back to the login page with an error
+func ssoFailed(w http.ResponseWriter, r *http.Request, message string) {
+	target := strings.TrimRight(config.AppConfig.AppURL, "/") + "/login?" + url.Values{"sso_error": {message}}.Encode()
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// mongoSSOStore keeps logins in oidc_logins and users in users
+type mongoSSOStore struct{}
+
+func (mongoSSOStore) saveLogin(ctx context.Context, login models.OIDCLogin) error {
+	_, err := GetCollection("oidc_logins").InsertOne(ctx, login)
+	return err
+}
+
+func (mongoSSOStore) takeLogin(ctx context.Context, stateHash string) (*models.OIDCLogin, error) {
+	var login models.OIDCLogin
+	filter := bson.M{"state_hash": stateHash, "expires_at": bson.M{"$gt": time.Now()}}
+	err := GetCollection("oidc_logins").FindOneAndDelete(ctx, filter).Decode(&login)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// user returns the user with the given email, creating it on the first
+// sign-on. The issuer verified the email, so the user's is verified too.
+func (mongoSSOStore) user(ctx context.Context, email string, claims jwt.MapClaims) (*models.User, error) {
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username, _ = claims["name"].(string)
+	}
+	if username == "" {
+		username = email[:strings.LastIndex(email, "@")]
+	}
+
+	// Users created here have no password, they can set one by resetting it
+	update := bson.M{
+		"$set": bson.M{"email_verified": true},
+		"$setOnInsert": bson.M{
+			"username":   username,
+			"password":   "",
+			"role":       "user",
+			"created_at": time.Now(),
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var user models.User
+	if err := GetCollection("users").FindOneAndUpdate(ctx, bson.M{"email": email}, update, opts).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (mongoSSOStore) issueTokens(ctx context.Context, user *models.User) (*TokenResponse, error) {
+	return issueTokens(ctx, user, "")
+}
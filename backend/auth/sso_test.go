@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memorySSOStore keeps logins and users in memory
+type memorySSOStore struct {
+	mu     sync.Mutex
+	logins map[string]models.OIDCLogin
+	users  map[string]*models.User
+}
+
+func (s *memorySSOStore) saveLogin(ctx context.Context, login models.OIDCLogin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins[login.StateHash] = login
+	return nil
+}
+
+func (s *memorySSOStore) takeLogin(ctx context.Context, stateHash string) (*models.OIDCLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, ok := s.logins[stateHash]
+	delete(s.logins, stateHash)
+	if !ok || !login.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &login, nil
+}
+
+func (s *memorySSOStore) user(ctx context.Context, email string, claims jwt.MapClaims) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, ok := s.users[email]; ok {
+		user.EmailVerified = true
+		return user, nil
+	}
+	name, _ := claims["name"].(string)
+	user := &models.User{ID: primitive.NewObjectID(), Email: email, Username: name, Role: "user", EmailVerified: true}
+	s.users[email] = user
+	return user, nil
+}
+
+func (s *memorySSOStore) issueTokens(ctx context.Context, user *models.User) (*TokenResponse, error) {
+	return &TokenResponse{AccessToken: "access-" + user.ID.Hex(), RefreshToken: "refresh-" + user.ID.Hex()}, nil
+}
+
+// useSSO points the single sign-on handlers at the issuer and a memory store
+func useSSO(t *testing.T, issuer *mockIssuer) *memorySSOStore {
+	t.Helper()
+	store := &memorySSOStore{logins: make(map[string]models.OIDCLogin), users: make(map[string]*models.User)}
+	prevProvider, prevStore, prevConfig := oidc, sso, config.AppConfig
+	oidc, sso = issuer.provider(), store
+	config.AppConfig = &config.Config{AppURL: "http://app.test/"}
+	t.Cleanup(func() {
+		oidc, sso, config.AppConfig = prevProvider, prevStore, prevConfig
+	})
+	return store
+}
+
+// get -> redirect target of a GET request to a handler
+func get(t *testing.T, handler http.HandlerFunc, target string) *url.URL {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("GET %s: status %d, want 302", target, rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+// startLogin begins a sign-on and returns the parameters sent to the issuer
+func startLogin(t *testing.T, issuer *mockIssuer) url.Values {
+	t.Helper()
+	authURL := get(t, OIDCLogin, "/auth/oidc/login")
+	if got := authURL.Scheme + "://" + authURL.Host + authURL.Path; got != issuer.server.URL+"/authorize" {
+		t.Fatalf("redirected to %s", got)
+	}
+	q := authURL.Query()
+	if q.Get("client_id") != testClientID || q.Get("redirect_uri") != testRedirectURL || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request %v", q)
+	}
+	return q
+}
+
+// ssoError -> error shown on the login page, "" if the redirect is not to it
+func ssoError(location *url.URL) string {
+	if location.Path != "/login" {
+		return ""
+	}
+	return location.Query().Get("sso_error")
+}
+
+func TestOIDCCallback(t *testing.T) {
+	issuer := newMockIssuer(t)
+	store := useSSO(t, issuer)
+
+	q := startLogin(t, issuer)
+	issuer.issue("code-1", q.Get("code_challenge"), issuer.sign(t, issuer.claims(q.Get("nonce"))))
+
+	callback := "/auth/oidc/callback?" + url.Values{"state": {q.Get("state")}, "code": {"code-1"}}.Encode()
+	location := get(t, OIDCCallback, callback)
+	if location.Host != "app.test" || location.Path != "/sso/callback" {
+		t.Fatalf("redirected to %s", location)
+	}
+	user := store.users["ada@example.com"]
+	if user == nil || !user.EmailVerified {
+		t.Fatalf("user not created: %+v", store.users)
+	}
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fragment.Get("access_token") != "access-"+user.ID.Hex() || fragment.Get("refresh_token") != "refresh-"+user.ID.Hex() {
+		t.Fatalf("tokens = %v", fragment)
+	}
+
+	// A state is consumed by its first callback
+	issuer.issue("code-2", q.Get("code_challenge"), issuer.sign(t, issuer.claims(q.Get("nonce"))))
+	callback = "/auth/oidc/callback?" + url.Values{"state": {q.Get("state")}, "code": {"code-2"}}.Encode()
+	if msg := ssoError(get(t, OIDCCallback, callback)); msg != "Single sign-on expired, please try again" {
+		t.Fatalf("reused state: error %q", msg)
+	}
+}
+
+func TestOIDCCallbackFailures(t *testing.T) {
+	issuer := newMockIssuer(t)
+
+	tests := []struct {
+		name string
+		// Claims of the ID token, from valid ones for the login's nonce
+		claims func(jwt.MapClaims)
+		// Query of the callback, from the login's state and a valid code
+		query func(url.Values)
+		want  string
+	}{
+		{name: "issuer error", query: func(q url.Values) { q.Set("error", "access_denied") },
+			want: "Single sign-on was cancelled or failed"},
+		{name: "missing code", query: func(q url.Values) { q.Del("code") },
+			want: "Invalid single sign-on response"},
+		{name: "unknown state", query: func(q url.Values) { q.Set("state", "forged") },
+			want: "Single sign-on expired, please try again"},
+		{name: "unknown code", query: func(q url.Values) { q.Set("code", "forged") },
+			want: "Single sign-on failed"},
+		{name: "wrong nonce", claims: func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+			want: "Single sign-on failed"},
+		{name: "no email", claims: func(c jwt.MapClaims) { delete(c, "email") },
+			want: "Your sign-on account has no email"},
+		{name: "unverified email", claims: func(c jwt.MapClaims) { c["email_verified"] = false },
+			want: "Your email is not verified by the sign-on provider"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useSSO(t, issuer)
+			q := startLogin(t, issuer)
+			claims := issuer.claims(q.Get("nonce"))
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			issuer.issue("code", q.Get("code_challenge"), issuer.sign(t, claims))
+
+			query := url.Values{"state": {q.Get("state")}, "code": {"code"}}
+			if tt.query != nil {
+				tt.query(query)
+			}
+			if msg := ssoError(get(t, OIDCCallback, "/auth/oidc/callback?"+query.Encode())); msg != tt.want {
+				t.Fatalf("error %q, want %q", msg, tt.want)
+			}
+			if len(store.users) != 0 {
+				t.Fatal("user created by a failed sign-on")
+			}
+		})
+	}
+}
+
+func TestOIDCExpiredLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	store := useSSO(t, issuer)
+
+	q := startLogin(t, issuer)
+	for hash, login := range store.logins {
+		login.ExpiresAt = time.Now().Add(-time.Second)
+		store.logins[hash] = login
+	}
+	issuer.issue("code", q.Get("code_challenge"), issuer.sign(t, issuer.claims(q.Get("nonce"))))
+	callback := "/auth/oidc/callback?" + url.Values{"state": {q.Get("state")}, "code": {"code"}}.Encode()
+	if msg := ssoError(get(t, OIDCCallback, callback)); msg != "Single sign-on expired, please try again" {
+		t.Fatalf("error %q", msg)
+	}
+}
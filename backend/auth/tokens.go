@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// hashToken -> hex encoded SHA-256 of a token, the form tokens are stored in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTokenID -> random id for token ids and families
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newSecretToken -> random token for links sent by mail
+func newSecretToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// appLink -> link to a page of the frontend carrying a token
+func appLink(path, token string) string {
+	return strings.TrimRight(config.AppConfig.AppURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// Create the access token of a user. Its sid is the refresh token family
+// so that logging out revokes the access tokens of that login as well.
+func newAccessToken(user *models.User, familyID string) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	accessClaims := jwt.MapClaims{
+		"user_id":        user.ID.Hex(),
+		"role":           user.Role,
+		"jti":            tokenID,
+		"sid":            familyID,
+		"iat":            float64(now.UnixNano()) / 1e9, // Sub-second, revocations are compared with it
+		"exp":            now.Add(config.AppConfig.AccessTokenTTL).Unix(),
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"username":       user.Username,
+	}
+	accessTokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
+	return accessTokenObj.SignedString([]byte(config.AppConfig.JWTSecret))
+}
+
+// issueTokens creates an access token and a refresh token of the given
+// family for a user, starting a new family if familyID is empty
+func issueTokens(ctx context.Context, user *models.User, familyID string) (*TokenResponse, error) {
+	var err error
+	if familyID == "" {
+		if familyID, err = newTokenID(); err != nil {
+			return nil, err
+		}
+	}
+	accessToken, err := newAccessToken(user, familyID)
+	if err != nil {
+		return nil, err
+	}
+	// Every refresh token gets its own id so that no two tokens are alike
+	tokenID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	refreshClaims := jwt.MapClaims{
+		"user_id": user.ID.Hex(),
+		"type":    "refresh",
+		"jti":     tokenID,
+		"exp":     now.Add(config.AppConfig.RefreshTokenTTL).Unix(),
+	}
+	refreshTokenObj := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
+	refreshToken, err := refreshTokenObj.SignedString([]byte(config.AppConfig.RefreshTokenSecret))
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the refresh token in DB, only its hash is kept
+	_, err = GetCollection("refresh_tokens").InsertOne(ctx, models.RefreshToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		TokenHash: hashToken(refreshToken),
+		FamilyID:  familyID,
+		ExpiresAt: now.Add(config.AppConfig.RefreshTokenTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+// parseRefreshToken checks the signature and expiry of a refresh token
+func parseRefreshToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(config.AppConfig.RefreshTokenSecret), nil
+	})
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrRefreshTokenExpired
+	}
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidRefreshToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != "refresh" {
+		return nil, ErrInvalidRefreshToken
+	}
+	return claims, nil
+}
+
+// rotateRefreshToken marks a refresh token as used and returns its record.
+// Presenting a token that was already used revokes its whole family, as
+// either the client or somebody who stole the token is replaying it.
+func rotateRefreshToken(ctx context.Context, tokenString string) (*models.RefreshToken, error) {
+	if _, err := parseRefreshToken(tokenString); err != nil {
+		return nil, err
+	}
+
+	refreshCollection := GetCollection("refresh_tokens")
+	var stored models.RefreshToken
+	err := refreshCollection.FindOne(ctx, bson.M{"token_hash": hashToken(tokenString)}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.Revoked {
+		return nil, ErrInvalidRefreshToken
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	// Only the first of several concurrent refreshes with the same token wins
+	now := time.Now()
+	filter := bson.M{"_id": stored.ID, "used_at": bson.M{"$exists": false}, "revoked": false}
+	err = refreshCollection.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used_at": now}}).Err()
+	if err == mongo.ErrNoDocuments {
+		log.Printf("Refresh token reuse for user %s, revoking family %s", stored.UserID.Hex(), stored.FamilyID)
+		if err := revokeFamily(ctx, stored.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored.UsedAt = &now
+	return &stored, nil
+}
+
+// revokeFamily revokes every refresh token handed out since one login and
+// the access tokens issued with them
+func revokeFamily(ctx context.Context, familyID string) error {
+	_, err := GetCollection("refresh_tokens").UpdateMany(ctx,
+		bson.M{"family_id": familyID},
+		bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return err
+	}
+	return revokeSession(ctx, familyID)
+}
+
+// revokeUserTokens revokes every refresh and access token of a user
+func revokeUserTokens(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := GetCollection("refresh_tokens").UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return err
+	}
+	return RevokeUser(ctx, userID)
+}
+
+// ensureTokenIndexes makes refresh, password reset and email verification
+// tokens and single sign-on states unique by hash and lets MongoDB delete
+// them and revocation list entries once they expired
+func ensureTokenIndexes(ctx context.Context) error {
+	_, err := GetCollection("refresh_tokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = GetCollection("revoked_tokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "revoked_at", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"password_resets", "email_verifications"} {
+		_, err = GetCollection(name).Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = GetCollection("oidc_logins").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "state_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/mail"
+	"example.com/collaborative-coding-editor/middleware"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Shortest time between two verification mails to a user
+const verificationResendInterval = time.Minute
+
+// Verify Email Request in the payload
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// validEmail -> true if the string is a bare email address
+func validEmail(email string) bool {
+	addr, err := netmail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// VerifyEmail -> marks the email of the user a verification token was sent
+// to as verified
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid Request Payload", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	verificationCollection := GetCollection("email_verifications")
+	filter := bson.M{"token_hash": hashToken(req.Token), "expires_at": bson.M{"$gt": time.Now()}}
+	var verification models.EmailVerification
+	err := verificationCollection.FindOneAndDelete(ctx, filter).Decode(&verification)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error using email verification: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+
+	// The token only verifies the address it was sent to
+	result, err := GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": verification.UserID, "email": verification.Email},
+		bson.M{"$set": bson.M{"email_verified": true}})
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+	if _, err := verificationCollection.DeleteMany(ctx, bson.M{"user_id": verification.UserID}); err != nil {
+		log.Printf("Error deleting email verifications: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified"})
+}
+
+// ResendVerification -> mails a new verification link to the logged in user
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userIDStr, _ := claims["user_id"].(string)
+	userID, err := primitive.ObjectIDFromHex(userIDStr)
+	if err != nil {
+		http.Error(w, "Invalid User Id", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email already verified", http.StatusBadRequest)
+		return
+	}
+
+	// One mail a minute is enough to get through
+	recent, err := GetCollection("email_verifications").CountDocuments(ctx, bson.M{
+		"user_id":    userID,
+		"created_at": bson.M{"$gt": time.Now().Add(-verificationResendInterval)},
+	})
+	if err != nil {
+		log.Printf("Error checking email verifications: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if recent > 0 {
+		http.Error(w, "Verification email was just sent, please wait a minute", http.StatusTooManyRequests)
+		return
+	}
+
+	token, err := createEmailVerification(ctx, &user)
+	if err != nil {
+		log.Printf("Error creating email verification: %v", err)
+		http.Error(w, "Error processing request", http.StatusInternalServerError)
+		return
+	}
+	go sendEmailVerification(user, token)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+// VerifiedEmail returns the email of a user and whether it was verified.
+// It reads the user, the claims of a token may predate the verification.
+func VerifiedEmail(ctx context.Context, userID string) (string, bool, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return "", false, err
+	}
+	var user models.User
+	if err := GetCollection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		return "", false, err
+	}
+	return user.Email, user.EmailVerified, nil
+}
+
+// createEmailVerification stores a new verification token for the user's
+// current email, replacing any earlier one, and returns the token
+func createEmailVerification(ctx context.Context, user *models.User) (string, error) {
+	token, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	verificationCollection := GetCollection("email_verifications")
+	if _, err := verificationCollection.DeleteMany(ctx, bson.M{"user_id": user.ID}); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = verificationCollection.InsertOne(ctx, models.EmailVerification{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(config.AppConfig.EmailVerificationTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Mail the verification link to the user
+func sendEmailVerification(user models.User, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := mail.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nplease confirm that this is your email by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. Until then you cannot accept invitations sent to this address. "+
+			"If you did not create an account, you can ignore this mail.\n",
+			user.Username, appLink("/verify-email", token), config.AppConfig.EmailVerificationTTL),
+	})
+	if err != nil {
+		log.Printf("Error sending verification mail to user %s: %v", user.ID.Hex(), err)
+	}
+}
+
+// markExistingUsersVerified treats the users who registered before emails
+// were verified as verified so that their invitations keep working
+func markExistingUsersVerified(ctx context.Context) error {
+	_, err := GetCollection("users").UpdateMany(ctx,
+		bson.M{"email_verified": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"email_verified": true}})
+	return err
+}
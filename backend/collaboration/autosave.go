@@ -0,0 +1,114 @@
+package collaboration
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/session"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Longest time changes stay unsaved while edits keep coming in
+const autosaveMaxDelay = 30 * time.Second
+
+// Saves the documents of a room, replaced in tests
+var autoSave = session.AutoSave
+
+// Record that the document changed and who changed it, and schedule a save
+// once the room has been quiet for the autosave delay. Every hub of a room
+// applies the change, only the one on the instance it came through saves it.
+func (h *Hub) markDirty(message Message) {
+	if message.origin != h.instance {
+		return
+	}
+	if !h.dirty {
+		h.dirty = true
+		h.dirtySince = time.Now()
+	}
+	h.lastEditor = message.SenderID
+	if h.contributors == nil {
+		h.contributors = make(map[string]bool)
+	}
+	h.contributors[message.SenderID] = true
+
+	delay := config.AppConfig.AutosaveDelay
+	if remaining := autosaveMaxDelay - time.Since(h.dirtySince); remaining < delay {
+		delay = max(remaining, 0)
+	}
+	h.scheduleAutosave(delay)
+}
+
+// autosaveTimeout -> fires when unsaved changes are due to be saved
+func (h *Hub) autosaveTimeout() <-chan time.Time {
+	if h.autosave == nil {
+		return nil
+	}
+	return h.autosave.C
+}
+
+// Save the document to the room's session if it changed since the last save
+func (h *Hub) flush() {
+	if !h.dirty {
+		return
+	}
+	roomID, err := primitive.ObjectIDFromHex(h.RoomId)
+	if err != nil {
+		return
+	}
+
+	contributors := make([]string, 0, len(h.contributors))
+	for userID := range h.contributors {
+		contributors = append(contributors, userID)
+	}
+	sort.Strings(contributors)
+
+	files := make(map[string]string, len(h.files)-1)
+	for path, f := range h.files {
+		if path != h.mainFile {
+			files[path] = f.text()
+		}
+	}
+
+	revision, err := autoSave(roomID, h.saved, h.text(), files, h.lastEditor, contributors)
+	if err == session.ErrStaleRevision {
+		if h.staleSaved != h.saved {
+			// Whoever saved passes the session on to the room, try again once it did
+			log.Printf("Session of room %s was saved since revision %d, retrying the autosave", h.RoomId, h.saved)
+			h.staleSaved = h.saved
+			h.scheduleAutosave(config.AppConfig.AutosaveDelay)
+			return
+		}
+		// The room was not told in time, e.g. the message was lost on the
+		// backplane. The live documents are what everybody sees, they win.
+		log.Printf("Room %s missed revision %d of its session, saving over it", h.RoomId, revision)
+		revision, err = autoSave(roomID, revision, h.text(), files, h.lastEditor, contributors)
+	}
+	if err != nil {
+		log.Printf("Error saving session for room %s: %v", h.RoomId, err)
+		return
+	}
+	h.saved = revision
+	h.markClean()
+	h.publish(envelope{Kind: envelopeSaved, Revision: revision})
+}
+
+// Schedule the autosave to run after delay
+func (h *Hub) scheduleAutosave(delay time.Duration) {
+	if h.autosave == nil {
+		h.autosave = time.NewTimer(delay)
+	} else {
+		h.autosave.Reset(delay)
+	}
+}
+
+// Forget unsaved changes, the document matches the saved session
+func (h *Hub) markClean() {
+	h.dirty = false
+	h.contributors = nil
+	if h.autosave != nil {
+		h.autosave.Stop()
+		h.autosave = nil
+	}
+}
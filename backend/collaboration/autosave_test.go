@@ -0,0 +1,90 @@
+package collaboration
+
+import (
+	"testing"
+
+	"example.com/collaborative-coding-editor/session"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// savedSession answers autosaves as the session store would with the given revision
+type savedSession struct {
+	revision int64
+	bases    []int64
+}
+
+func (s *savedSession) save(roomID primitive.ObjectID, base int64, code string, files map[string]string, lastEditor string, contributors []string) (int64, error) {
+	s.bases = append(s.bases, base)
+	if base != s.revision {
+		return s.revision, session.ErrStaleRevision
+	}
+	s.revision++
+	return s.revision, nil
+}
+
+func useSavedSession(t *testing.T, revision int64) *savedSession {
+	t.Helper()
+	s := &savedSession{revision: revision}
+	prev := autoSave
+	autoSave = s.save
+	t.Cleanup(func() { autoSave = prev })
+	return s
+}
+
+func newDirtyHub(t *testing.T, saved int64) *Hub {
+	t.Helper()
+	h := newTestHub(t)
+	h.RoomId = primitive.NewObjectID().Hex()
+	h.saved = saved
+	h.dirty = true
+	return h
+}
+
+func TestAutosaveFromLoadedRevision(t *testing.T) {
+	store := useSavedSession(t, 3)
+	h := newDirtyHub(t, 3)
+
+	h.flush()
+	if h.dirty || h.saved != 4 || len(store.bases) != 1 {
+		t.Fatalf("dirty %v, saved %d, saves %v", h.dirty, h.saved, store.bases)
+	}
+	// Other hubs of the room learn the revision
+	h.receive(envelope{Kind: envelopeSaved, Instance: "other", Revision: 7})
+	if h.saved != 7 {
+		t.Fatalf("saved %d after another instance saved 7", h.saved)
+	}
+}
+
+func TestAutosaveWaitsForNewerRevision(t *testing.T) {
+	store := useSavedSession(t, 5)
+	h := newDirtyHub(t, 4)
+
+	// Revision 5 was saved elsewhere and has not reached the room yet
+	h.flush()
+	if !h.dirty || h.autosave == nil || store.revision != 5 {
+		t.Fatalf("stale autosave: dirty %v, retry %v, revision %d", h.dirty, h.autosave != nil, store.revision)
+	}
+	h.receive(envelope{Kind: envelopeWorkspace, Instance: "other", Revision: 5})
+	h.flush()
+	if h.dirty || h.saved != 6 {
+		t.Fatalf("dirty %v, saved %d after the revision arrived", h.dirty, h.saved)
+	}
+	if want := []int64{4, 5}; len(store.bases) != 2 || store.bases[0] != want[0] || store.bases[1] != want[1] {
+		t.Fatalf("saved on %v, want %v", store.bases, want)
+	}
+}
+
+func TestAutosaveOverMissedRevision(t *testing.T) {
+	store := useSavedSession(t, 5)
+	h := newDirtyHub(t, 4)
+
+	h.flush()
+	// Still nothing heard of revision 5, the live documents are saved over it
+	h.flush()
+	if h.dirty || h.saved != 6 {
+		t.Fatalf("dirty %v, saved %d", h.dirty, h.saved)
+	}
+	if want := []int64{4, 4, 5}; len(store.bases) != 3 || store.bases[2] != want[2] {
+		t.Fatalf("saved on %v, want %v", store.bases, want)
+	}
+}
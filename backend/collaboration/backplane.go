@@ -0,0 +1,203 @@
+package collaboration
+
+import (
+	"log"
+	"sync"
+
+	"example.com/collaborative-coding-editor/config"
+)
+
+// Backplane carries the messages of a room between backend instances.
+// Every subscriber of a room must receive its messages in the same order,
+// hubs rely on that to apply edits identically on every instance.
+type Backplane interface {
+	// Publish a payload to every subscriber of the room, including this instance
+	Publish(roomID string, payload []byte) error
+	// Subscribe to the payloads published to the room
+	Subscribe(roomID string) (Subscription, error)
+	// Distributed -> true if other instances may share the rooms
+	Distributed() bool
+}
+
+// Subscription delivers the payloads of one room in publish order. A nil
+// payload means the subscription was interrupted and payloads may be lost.
+type Subscription interface {
+	Messages() <-chan []byte
+	Close() error
+}
+
+// Payloads a subscription holds for a reader that fell behind. Beyond that
+// they are dropped and the reader is told that messages were lost.
+const maxSubscriptionQueue = 10000
+
+// Backplane used by new hubs
+var backplane Backplane = NewLocalBackplane()
+
+// ConnectBackplane selects the backplane configured for this instance
+func ConnectBackplane() {
+	switch config.AppConfig.Backplane {
+	case "", "local":
+		backplane = NewLocalBackplane()
+	case "redis":
+		redis, err := NewRedisBackplane(config.AppConfig.RedisURL)
+		if err != nil {
+			log.Fatalf("Redis backplane error: %v", err)
+		}
+		backplane = redis
+		log.Println("Connected to Redis backplane")
+	default:
+		log.Fatalf("Unknown backplane: %s", config.AppConfig.Backplane)
+	}
+}
+
+// LocalBackplane connects the hubs of a single process
+type LocalBackplane struct {
+	mu   sync.Mutex
+	subs map[string]map[*localSubscription]bool
+}
+
+// Create an in-process backplane
+func NewLocalBackplane() *LocalBackplane {
+	return &LocalBackplane{subs: make(map[string]map[*localSubscription]bool)}
+}
+
+// Publish queues the payload for every subscriber, it never blocks on a slow reader
+func (b *LocalBackplane) Publish(roomID string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[roomID] {
+		sub.push(payload)
+	}
+	return nil
+}
+
+// Subscribe to a room
+func (b *LocalBackplane) Subscribe(roomID string) (Subscription, error) {
+	sub := &localSubscription{
+		out:    make(chan []byte),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	sub.unsubscribe = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[roomID], sub)
+		if len(b.subs[roomID]) == 0 {
+			delete(b.subs, roomID)
+		}
+	}
+
+	b.mu.Lock()
+	if b.subs[roomID] == nil {
+		b.subs[roomID] = make(map[*localSubscription]bool)
+	}
+	b.subs[roomID][sub] = true
+	b.mu.Unlock()
+
+	go sub.pump()
+	return sub, nil
+}
+
+// Distributed -> false, only hubs of this process are connected
+func (b *LocalBackplane) Distributed() bool {
+	return false
+}
+
+// localSubscription buffers payloads in a queue so that a hub publishing to
+// its own room can never deadlock on its subscription
+type localSubscription struct {
+	mu          sync.Mutex
+	queue       [][]byte
+	signal      chan struct{}
+	out         chan []byte
+	done        chan struct{}
+	once        sync.Once
+	unsubscribe func()
+}
+
+func (s *localSubscription) push(payload []byte) {
+	s.mu.Lock()
+	if len(s.queue) >= maxSubscriptionQueue {
+		s.queue = [][]byte{nil}
+	}
+	s.queue = append(s.queue, payload)
+	s.mu.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *localSubscription) pump() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, payload := range queue {
+			select {
+			case s.out <- payload:
+			case <-s.done:
+				return
+			}
+		}
+
+		select {
+		case <-s.signal:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *localSubscription) Messages() <-chan []byte {
+	return s.out
+}
+
+func (s *localSubscription) Close() error {
+	s.once.Do(func() {
+		s.unsubscribe()
+		close(s.done)
+	})
+	return nil
+}
+
+// Kinds of envelopes exchanged by hubs
+const (
+	envelopeMessage       = "message"
+	envelopeJoin          = "join"
+	envelopeLeave         = "leave"
+	envelopeStateRequest  = "state_request"
+	envelopeStateResponse = "state_response"
+	envelopeClose         = "close"
+	envelopeRestore       = "restore"
+	envelopeWorkspace     = "workspace"
+	envelopeHeartbeat     = "heartbeat"
+	// Revision a hub saved the room's documents as
+	envelopeSaved = "saved"
+	// Roster of a room asked for by an instance without a hub for it
+	envelopePresenceRequest  = "presence_request"
+	envelopePresenceResponse = "presence_response"
+)
+
+// envelope is what hubs publish on the backplane
+type envelope struct {
+	Kind      string   `json:"kind"`
+	Instance  string   `json:"instance"`             // hub that published the envelope
+	ClientKey string   `json:"client_key,omitempty"` // connection the envelope is about
+	ClientID  string   `json:"client_id,omitempty"`
+	UserID    string   `json:"user_id,omitempty"`
+	UserName  string   `json:"user_name,omitempty"`
+	Message   *Message `json:"message,omitempty"`
+
+	// State hand-over between hubs
+	Nonce  string    `json:"nonce,omitempty"`
+	Target string    `json:"target,omitempty"`
+	State  *hubState `json:"state,omitempty"`
+	// Answer to a presence request
+	Participants []Participant `json:"participants,omitempty"`
+	// Session revision of a saved change
+	Revision int64 `json:"revision,omitempty"`
+}
@@ -0,0 +1,459 @@
+package collaboration
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout    = 5 * time.Second
+	redisCommandTimeout = 5 * time.Second
+	redisRetryDelay     = time.Second
+	// Payloads waiting for the publisher connection before Publish gives up
+	redisPublishQueue = 4096
+)
+
+var ErrPublishQueueFull = errors.New("redis: publish queue full")
+
+// RedisBackplane shares rooms between instances through Redis pub/sub.
+// It speaks the RESP protocol directly, so any server implementing
+// PUBLISH and SUBSCRIBE (Redis, KeyDB, a test fake) can be used. Publishing
+// uses one connection, written by its own goroutine so that hubs never wait
+// on the network, and every room of the instance is subscribed on another one.
+type RedisBackplane struct {
+	addr     string
+	username string
+	password string
+
+	// Publisher connection, only used by write once the backplane is running
+	pub    *redisConn
+	outbox chan redisPublish
+
+	// Subscriber connection and the rooms subscribed on it, guarded by subMu
+	subMu sync.Mutex
+	sub   *redisConn
+	rooms map[string]*redisRoom
+	// SUBSCRIBE commands sent on sub and not confirmed yet, by channel
+	unconfirmed map[string]int
+}
+
+// redisRoom is a room channel with its local subscriptions
+type redisRoom struct {
+	subs map[*localSubscription]bool
+	// Closed once the server confirmed the subscription
+	confirmed chan struct{}
+}
+
+// redisPublish is a payload waiting for the publisher connection
+type redisPublish struct {
+	channel string
+	payload []byte
+}
+
+// Create a Redis backplane from a redis://[user:password@]host:port URL
+func NewRedisBackplane(rawURL string) (*RedisBackplane, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis url scheme %q", u.Scheme)
+	}
+
+	b := &RedisBackplane{
+		addr:        u.Host,
+		outbox:      make(chan redisPublish, redisPublishQueue),
+		rooms:       make(map[string]*redisRoom),
+		unconfirmed: make(map[string]int),
+	}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		b.password, _ = u.User.Password()
+		if b.password == "" {
+			b.password = u.User.Username()
+		} else {
+			b.username = u.User.Username()
+		}
+	}
+
+	// Fail early if the server cannot be reached
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("PING"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.pub = conn
+	go b.write()
+	return b, nil
+}
+
+func redisChannel(roomID string) string {
+	return "collaboration:room:" + roomID
+}
+
+// Publish queues the payload for the publisher connection. It never blocks,
+// if the queue is full the payload is dropped and the room's subscriptions
+// are told that messages were lost.
+func (b *RedisBackplane) Publish(roomID string, payload []byte) error {
+	channel := redisChannel(roomID)
+	select {
+	case b.outbox <- redisPublish{channel: channel, payload: payload}:
+		return nil
+	default:
+		b.interrupt(channel)
+		return ErrPublishQueueFull
+	}
+}
+
+// write publishes the queued payloads in order
+func (b *RedisBackplane) write() {
+	for p := range b.outbox {
+		if err := b.publish(p.channel, p.payload); err != nil {
+			log.Printf("Error publishing to %s: %v", p.channel, err)
+			b.interrupt(p.channel)
+		}
+	}
+}
+
+// publish sends one payload, reconnecting once on failure. Every command
+// has a deadline, so an unresponsive server only holds up the writer.
+func (b *RedisBackplane) publish(channel string, payload []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = b.dial(); err != nil {
+				continue
+			}
+		}
+		if _, err = b.pub.do("PUBLISH", channel, string(payload)); err == nil {
+			return nil
+		}
+		b.pub.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+// interrupt tells the local subscriptions of a channel that messages were lost
+func (b *RedisBackplane) interrupt(channel string) {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	if room := b.rooms[channel]; room != nil {
+		for sub := range room.subs {
+			sub.push(nil)
+		}
+	}
+}
+
+// Subscribe to the room channel on the shared subscriber connection. It
+// returns once the server confirmed the subscription, so everything
+// published afterwards is delivered.
+func (b *RedisBackplane) Subscribe(roomID string) (Subscription, error) {
+	channel := redisChannel(roomID)
+	sub := &localSubscription{
+		out:    make(chan []byte),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	sub.unsubscribe = func() { b.unsubscribe(channel, sub) }
+
+	b.subMu.Lock()
+	// With rooms in use a missing connection is being reconnected, which
+	// subscribes to the new room as well
+	if b.sub == nil && len(b.rooms) == 0 {
+		if err := b.connectSubscriber(); err != nil {
+			b.subMu.Unlock()
+			return nil, err
+		}
+	}
+	room := b.rooms[channel]
+	if room == nil {
+		room = &redisRoom{subs: make(map[*localSubscription]bool), confirmed: make(chan struct{})}
+		b.rooms[channel] = room
+		if b.sub != nil {
+			b.unconfirmed[channel]++
+			if err := b.sub.send("SUBSCRIBE", channel); err != nil {
+				// The reader notices the broken connection and subscribes again
+				log.Printf("Error subscribing to room %s: %v", roomID, err)
+			}
+		}
+	}
+	room.subs[sub] = true
+	confirmed := room.confirmed
+	b.subMu.Unlock()
+
+	select {
+	case <-confirmed:
+	case <-time.After(redisCommandTimeout):
+		b.unsubscribe(channel, sub)
+		return nil, fmt.Errorf("redis: subscription to room %s not confirmed", roomID)
+	}
+	go sub.pump()
+	return sub, nil
+}
+
+// Distributed -> true, other instances share the Redis server
+func (b *RedisBackplane) Distributed() bool {
+	return true
+}
+
+func (b *RedisBackplane) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", b.addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if b.password != "" {
+		args := []string{"AUTH", b.password}
+		if b.username != "" {
+			args = []string{"AUTH", b.username, b.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// connectSubscriber opens the subscriber connection and subscribes to every
+// room in use, must be called with subMu held
+func (b *RedisBackplane) connectSubscriber() error {
+	conn, err := b.dial()
+	if err != nil {
+		return err
+	}
+	// Pushed messages arrive at any time, reads must not time out
+	conn.conn.SetDeadline(time.Time{})
+
+	b.unconfirmed = make(map[string]int)
+	if len(b.rooms) > 0 {
+		args := []string{"SUBSCRIBE"}
+		for channel, room := range b.rooms {
+			args = append(args, channel)
+			b.unconfirmed[channel]++
+			room.confirmed = make(chan struct{})
+		}
+		if err := conn.send(args...); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	b.sub = conn
+	go b.read(conn)
+	return nil
+}
+
+// unsubscribe removes a local subscription and the channel once it has none
+func (b *RedisBackplane) unsubscribe(channel string, sub *localSubscription) {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	room := b.rooms[channel]
+	if room == nil || !room.subs[sub] {
+		return
+	}
+	delete(room.subs, sub)
+	if len(room.subs) > 0 {
+		return
+	}
+	delete(b.rooms, channel)
+	if b.sub != nil {
+		if err := b.sub.send("UNSUBSCRIBE", channel); err != nil {
+			log.Printf("Error unsubscribing from %s: %v", channel, err)
+		}
+	}
+}
+
+// read dispatches pushed messages to the subscriptions until the
+// connection fails, then connects again
+func (b *RedisBackplane) read(conn *redisConn) {
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			log.Printf("Redis subscriber connection lost: %v", err)
+			conn.Close()
+			break
+		}
+		b.dispatch(reply)
+	}
+
+	b.subMu.Lock()
+	if b.sub == conn {
+		b.sub = nil
+	}
+	b.subMu.Unlock()
+	b.reconnect()
+}
+
+// dispatch handles one pushed reply of the subscriber connection
+func (b *RedisBackplane) dispatch(reply interface{}) {
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) != 3 {
+		return
+	}
+	kind, _ := parts[0].(string)
+	channel, _ := parts[1].(string)
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	room := b.rooms[channel]
+	switch kind {
+	case "subscribe":
+		// Only the reply to the last SUBSCRIBE of a channel means it is in place
+		if b.unconfirmed[channel]--; b.unconfirmed[channel] <= 0 {
+			delete(b.unconfirmed, channel)
+			if room != nil {
+				room.confirm()
+			}
+		}
+	case "message":
+		payload, ok := parts[2].(string)
+		if !ok || room == nil {
+			return
+		}
+		for sub := range room.subs {
+			sub.push([]byte(payload))
+		}
+	}
+}
+
+// reconnect subscribes again once the server is back and tells every
+// subscription that messages may have been lost in between. Without rooms
+// the connection is opened again by the next subscription.
+func (b *RedisBackplane) reconnect() {
+	for {
+		time.Sleep(redisRetryDelay)
+
+		b.subMu.Lock()
+		if b.sub != nil || len(b.rooms) == 0 {
+			b.subMu.Unlock()
+			return
+		}
+		if err := b.connectSubscriber(); err != nil {
+			b.subMu.Unlock()
+			log.Printf("Error reconnecting Redis subscriber: %v", err)
+			continue
+		}
+		var subs []*localSubscription
+		for _, room := range b.rooms {
+			for sub := range room.subs {
+				subs = append(subs, sub)
+			}
+		}
+		b.subMu.Unlock()
+
+		for _, sub := range subs {
+			sub.push(nil)
+		}
+		return
+	}
+}
+
+// confirm marks the subscription as in place
+func (r *redisRoom) confirm() {
+	select {
+	case <-r.confirmed:
+	default:
+		close(r.confirmed)
+	}
+}
+
+// redisConn is a single RESP connection
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisCommandTimeout))
+	if err := c.write(args); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// send writes a command whose reply is read elsewhere, as on a subscriber connection
+func (c *redisConn) send(args ...string) error {
+	c.conn.SetWriteDeadline(time.Now().Add(redisCommandTimeout))
+	return c.write(args)
+}
+
+func (c *redisConn) write(args []string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// readReply parses one RESP value. Bulk strings are returned as string,
+// integers as int64, arrays as []interface{} and errors as error.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, errors.New("redis: " + body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,427 @@
+package collaboration
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a RESP server implementing the commands the backplane uses
+type fakeRedis struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	conns map[*fakeRedisConn]bool
+	subs  map[string]map[*fakeRedisConn]bool
+	// Connections that subscribed to at least one channel
+	subscribers map[*fakeRedisConn]bool
+	// PUBLISH is left unanswered, as by a stuck server
+	stalled bool
+}
+
+type fakeRedisConn struct {
+	*redisConn
+	mu sync.Mutex
+}
+
+func (c *fakeRedisConn) reply(resp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write([]byte(resp))
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:          ln,
+		conns:       make(map[*fakeRedisConn]bool),
+		subs:        make(map[string]map[*fakeRedisConn]bool),
+		subscribers: make(map[*fakeRedisConn]bool),
+	}
+	go f.accept()
+	t.Cleanup(func() {
+		ln.Close()
+		f.drop()
+	})
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	return "redis://" + f.ln.Addr().String()
+}
+
+func (f *fakeRedis) accept() {
+	for {
+		netConn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeRedisConn{redisConn: &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}}
+		f.mu.Lock()
+		f.conns[c] = true
+		f.mu.Unlock()
+		go f.serve(c)
+	}
+}
+
+func (f *fakeRedis) serve(c *fakeRedisConn) {
+	defer f.forget(c)
+	for {
+		cmd, err := c.readReply()
+		if err != nil {
+			return
+		}
+		parts, _ := cmd.([]interface{})
+		args := make([]string, len(parts))
+		for i, p := range parts {
+			args[i], _ = p.(string)
+		}
+		if len(args) == 0 {
+			c.reply("-ERR empty command\r\n")
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			c.reply("+PONG\r\n")
+		case "AUTH":
+			c.reply("+OK\r\n")
+		case "PUBLISH":
+			f.mu.Lock()
+			if f.stalled {
+				f.mu.Unlock()
+				continue
+			}
+			var receivers []*fakeRedisConn
+			for sub := range f.subs[args[1]] {
+				receivers = append(receivers, sub)
+			}
+			f.mu.Unlock()
+			for _, sub := range receivers {
+				sub.reply("*3\r\n" + bulk("message") + bulk(args[1]) + bulk(args[2]))
+			}
+			c.reply(fmt.Sprintf(":%d\r\n", len(receivers)))
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			kind := strings.ToLower(args[0])
+			for _, channel := range args[1:] {
+				f.mu.Lock()
+				if kind == "subscribe" {
+					if f.subs[channel] == nil {
+						f.subs[channel] = make(map[*fakeRedisConn]bool)
+					}
+					f.subs[channel][c] = true
+					f.subscribers[c] = true
+				} else {
+					delete(f.subs[channel], c)
+				}
+				f.mu.Unlock()
+				c.reply("*3\r\n" + bulk(kind) + bulk(channel) + ":1\r\n")
+			}
+		default:
+			c.reply("-ERR unknown command\r\n")
+		}
+	}
+}
+
+func (f *fakeRedis) forget(c *fakeRedisConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, c)
+	for _, subs := range f.subs {
+		delete(subs, c)
+	}
+	c.Close()
+}
+
+// drop closes every client connection, as a restarting server would
+func (f *fakeRedis) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.conns {
+		c.Close()
+	}
+}
+
+// stall stops answering PUBLISH
+func (f *fakeRedis) stall() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stalled = true
+}
+
+// subscriberCount -> connections that ever subscribed to a channel
+func (f *fakeRedis) subscriberCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers)
+}
+
+// receive -> next payload of a subscription, failing the test after a timeout
+func receive(t *testing.T, sub Subscription) []byte {
+	t.Helper()
+	select {
+	case payload := <-sub.Messages():
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+// expectNothing fails the test if the subscription delivers a payload soon
+func expectNothing(t *testing.T, sub Subscription) {
+	t.Helper()
+	select {
+	case payload := <-sub.Messages():
+		t.Fatalf("unexpected message %q", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisCodec(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &redisConn{conn: client, reader: bufio.NewReader(client)}
+
+	go conn.write([]string{"PUBLISH", "room", "héllo\r\n"})
+	want := "*3\r\n$7\r\nPUBLISH\r\n$4\r\nroom\r\n$8\r\nhéllo\r\n\r\n"
+	got := make([]byte, len(want))
+	if _, err := bufio.NewReader(server).Read(got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("write = %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		resp string
+		want interface{}
+		err  string
+	}{
+		{resp: "+OK\r\n", want: "OK"},
+		{resp: "-ERR wrong type\r\n", err: "redis: ERR wrong type"},
+		{resp: ":42\r\n", want: int64(42)},
+		{resp: "$5\r\nhe\r\no\r\n", want: "he\r\no"},
+		{resp: "$0\r\n\r\n", want: ""},
+		{resp: "$-1\r\n", want: nil},
+		{resp: "*-1\r\n", want: nil},
+		{resp: "*3\r\n$7\r\nmessage\r\n$1\r\nc\r\n*1\r\n:1\r\n", want: []interface{}{"message", "c", []interface{}{int64(1)}}},
+		{resp: "?1\r\n", err: `redis: unexpected reply type '?'`},
+		{resp: "+\n", err: "redis: malformed reply"},
+	}
+	for _, tt := range tests {
+		go server.Write([]byte(tt.resp))
+		got, err := conn.readReply()
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("readReply(%q) error = %v, want %q", tt.resp, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readReply(%q) error = %v", tt.resp, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("readReply(%q) = %#v, want %#v", tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestNewRedisBackplaneRejectsScheme(t *testing.T) {
+	if _, err := NewRedisBackplane("http://localhost:6379"); err == nil {
+		t.Fatal("expected an error for a non redis url")
+	}
+}
+
+func TestRedisBackplanePublishSubscribe(t *testing.T) {
+	f := newFakeRedis(t)
+	b1, err := NewRedisBackplane(f.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := NewRedisBackplane(f.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := b1.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b1.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := b2.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomB, err := b2.Subscribe("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b2.Publish("a", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b2.Publish("a", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []Subscription{first, second, other} {
+		for _, want := range []string{"one", "two"} {
+			if got := receive(t, sub); string(got) != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		}
+	}
+	expectNothing(t, roomB)
+
+	// Every room of an instance shares one subscriber connection
+	if n := f.subscriberCount(); n != 2 {
+		t.Fatalf("%d subscriber connections, want 2", n)
+	}
+
+	// Closing one subscription keeps the channel for the others
+	first.Close()
+	if err := b1.Publish("a", []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, second); string(got) != "three" {
+		t.Fatalf("got %q, want three", got)
+	}
+	if got := receive(t, other); string(got) != "three" {
+		t.Fatalf("got %q, want three", got)
+	}
+
+	// The last subscription of a room unsubscribes from its channel
+	second.Close()
+	b1.subMu.Lock()
+	_, subscribed := b1.rooms[redisChannel("a")]
+	b1.subMu.Unlock()
+	if subscribed {
+		t.Fatal("room a still subscribed after its last subscription closed")
+	}
+}
+
+func TestRedisBackplaneReconnect(t *testing.T) {
+	f := newFakeRedis(t)
+	b, err := NewRedisBackplane(f.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := b.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	f.drop()
+
+	// A nil payload tells the hub messages may have been lost
+	if got := receive(t, sub); got != nil {
+		t.Fatalf("got %q after the connection dropped, want nil", got)
+	}
+	if err := b.Publish("room", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, sub); string(got) != "again" {
+		t.Fatalf("got %q, want again", got)
+	}
+}
+
+func TestRedisPublishDoesNotWaitForServer(t *testing.T) {
+	f := newFakeRedis(t)
+	b, err := NewRedisBackplane(f.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := b.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	f.stall()
+	start := time.Now()
+	// One payload is held by the writer, the others fill the queue
+	for i := 0; i <= redisPublishQueue && err == nil; i++ {
+		err = b.Publish("room", []byte("stuck"))
+	}
+	err = b.Publish("room", []byte("dropped"))
+	if err != ErrPublishQueueFull {
+		t.Fatalf("publish to a full queue = %v, want %v", err, ErrPublishQueueFull)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publishing took %v with a stuck server", elapsed)
+	}
+	// The dropped payload is reported to the room
+	if got := receive(t, sub); got != nil {
+		t.Fatalf("got %q after a dropped publish, want nil", got)
+	}
+}
+
+func TestLocalSubscriptionQueueIsBounded(t *testing.T) {
+	// Not pumped, as for a hub that stopped reading
+	sub := &localSubscription{signal: make(chan struct{}, 1)}
+	for i := 0; i < maxSubscriptionQueue; i++ {
+		sub.push([]byte("old"))
+	}
+	sub.push([]byte("new"))
+	if len(sub.queue) != 2 || sub.queue[0] != nil || string(sub.queue[1]) != "new" {
+		t.Fatalf("queue of %d payloads after overflowing, want the lost marker and the newest", len(sub.queue))
+	}
+}
+
+func TestExpireMembers(t *testing.T) {
+	local := NewLocalBackplane()
+	sub, _ := local.Subscribe("room")
+	defer sub.Close()
+
+	h := &Hub{
+		RoomId:    "room",
+		instance:  "self",
+		backplane: local,
+		members: map[string]*member{
+			"mine":     {instance: "self", key: "mine"},
+			"alive":    {instance: "alive", key: "alive"},
+			"crashed":  {instance: "crashed", key: "crashed"},
+			"handover": {instance: "handover", key: "handover"},
+		},
+		seen: map[string]time.Time{
+			"alive":   time.Now(),
+			"crashed": time.Now().Add(-2 * memberExpiry),
+		},
+	}
+	h.expireMembers()
+
+	var env envelope
+	if err := json.Unmarshal(receive(t, sub), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Kind != envelopeLeave || env.ClientKey != "crashed" || env.Instance != "self" {
+		t.Fatalf("got %+v, want a leave of the crashed instance's connection", env)
+	}
+	expectNothing(t, sub)
+
+	if _, ok := h.seen["handover"]; !ok {
+		t.Fatal("instance known from a hand-over has no grace period")
+	}
+	if _, ok := h.seen["crashed"]; ok {
+		t.Fatal("expired instance is still remembered")
+	}
+}
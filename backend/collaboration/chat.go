@@ -1,27 +1,28 @@
 package collaboration
 
 import (
-	"context"
 	"log"
-	"time"
 
-	"example.com/collaborative-coding-editor/auth"
-	"go.mongodb.org/mongo-driver/bson"
+	"example.com/collaborative-coding-editor/session"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func SaveChatMessage(msg Message, roomID string) {
-	collection := auth.GetCollection("chat_logs")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Stores chat messages, replaced in tests
+var saveChat = SaveChatMessage
 
-	_, err := collection.InsertOne(ctx, bson.M{
-		"room_id":     roomID,
-		"sender_id":   msg.SenderID,
-		"sender_name": msg.SenderName,
-		"content":     msg.Content,
-		"timestamp":   msg.Timestamp,
+// SaveChatMessage stores a chat message under the room it was sent in
+func SaveChatMessage(msg Message, roomID string) {
+	objectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		log.Printf("Error saving chat message: invalid room %q", roomID)
+		return
+	}
+	err = session.SaveChat(objectID, session.ChatLogEntry{
+		SenderID:   msg.SenderID,
+		SenderName: msg.SenderName,
+		Content:    msg.Content,
+		Timestamp:  msg.Timestamp,
 	})
-
 	if err != nil {
 		log.Printf("Error saving chat message: %v", err)
 	}
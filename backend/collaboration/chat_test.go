@@ -0,0 +1,60 @@
+package collaboration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestChatIsSavedUnderTheConnectionsRoom(t *testing.T) {
+	h := newTestHub(t)
+	h.RoomId = "65a000000000000000000001"
+	t.Cleanup(func() { close(h.done) })
+
+	saved := make(chan [2]string, 1)
+	prev := saveChat
+	saveChat = func(msg Message, roomID string) { saved <- [2]string{roomID, msg.Content} }
+	t.Cleanup(func() { saveChat = prev })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := &Client{key: newClientID(), id: "c1", hub: h, conn: conn, send: make(chan Message, 1), userID: "ada", userName: "Ada"}
+		client.readPump()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The frontend sends no room, a forged one must not move the message elsewhere
+	for _, roomID := range []string{"", "65a000000000000000000002"} {
+		if err := conn.WriteJSON(Message{Type: MessageTypeChat, Content: "hi", RoomID: roomID}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case message := <-h.Broadcast:
+			if message.RoomID != h.RoomId || message.SenderID != "ada" {
+				t.Fatalf("room %q: submitted %+v", roomID, message)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("chat message not submitted")
+		}
+		select {
+		case got := <-saved:
+			if got != [2]string{h.RoomId, "hi"} {
+				t.Fatalf("room %q: saved %v", roomID, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("chat message not saved")
+		}
+	}
+}
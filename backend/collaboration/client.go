@@ -4,27 +4,44 @@ import (
 	"log"
 	"time"
 
+	"example.com/collaborative-coding-editor/middleware"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// Maximum size of a message read from a client, large enough for full buffer edits
+	maxMessageSize = 512 * 1024
+	// How often live connections check that their access token was not revoked
+	revocationCheckInterval = 5 * time.Second
+)
+
 // Client -> A single websocket connection
 type Client struct {
+	key      string // unique key of this connection
+	id       string // connection id, kept by the client across reconnects
 	hub      *Hub
 	conn     *websocket.Conn
 	send     chan Message
 	userID   string
 	userName string
+	// Last sequence number the client saw before reconnecting, -1 for a
+	// fresh connection, and the epoch it belongs to
+	since int64
+	epoch string
+	// Claims of the access token the client connected with
+	claims jwt.MapClaims
 }
 
 // ReadPump -> listens for incoming messages from Websocket connection
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.Unregister <- c
+		c.hub.exit(c)
 		c.conn.Close()
 	}()
 
 	// Set the limit and deadline
-	c.conn.SetReadLimit(512)
+	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -43,12 +60,18 @@ func (c *Client) readPump() {
 		msg.SenderID = c.userID
 		msg.Timestamp = time.Now()
 		msg.SenderName = c.userName
+		msg.sender = c.key
+		msg.ClientID = c.id
+		// Messages belong to the room of the connection, whatever the client says
+		msg.RoomID = c.hub.RoomId
 
 		// If this is a chant msg then save the message
 		if msg.Type == MessageTypeChat {
-			go SaveChatMessage(msg, msg.RoomID)
+			go saveChat(msg, msg.RoomID)
+		}
+		if !c.hub.submit(msg) {
+			break
 		}
-		c.hub.Broadcast <- msg
 
 	}
 }
@@ -84,3 +107,27 @@ func (c *Client) writePump() {
 		}
 	}
 }
+
+// Disconnect local clients whose access token was revoked since they
+// connected, e.g. because the user logged out or reset the password
+func (h *Hub) dropRevoked() {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for client := range h.Clients {
+		if middleware.Revoked(client.claims) {
+			log.Printf("Access token of %s revoked, disconnecting", client.userID)
+			close(client.send)
+			delete(h.Clients, client)
+		}
+	}
+}
+
+// Disconnect every local client, they reconnect and load the room again
+func (h *Hub) dropClients() {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for client := range h.Clients {
+		close(client.send)
+		delete(h.Clients, client)
+	}
+}
@@ -0,0 +1,330 @@
+package collaboration
+
+import "sort"
+
+// Site of the items the server inserts itself, e.g. for whole buffer edits.
+// Clients may not use it.
+const crdtServerSite = "server"
+
+// Most items and deleted ids held back waiting for an item they reference.
+// Beyond it the oldest are dropped, a peer missing them can sync again.
+const maxCRDTPending = 10000
+
+// ItemID identifies a character inserted by a peer. Clock is a Lamport
+// timestamp, so every later insert by the same peer has a larger clock.
+type ItemID struct {
+	Client string `json:"client"`
+	Clock  int    `json:"clock"`
+}
+
+// CRDTItem is a run of characters inserted by one peer. The first
+// character follows Origin (nil for the start of the document) and every
+// further character follows the previous one with the next clock.
+type CRDTItem struct {
+	ID      ItemID  `json:"id"`
+	Origin  *ItemID `json:"origin,omitempty"`
+	Content string  `json:"content"`
+}
+
+// ItemRange covers Length consecutive clocks of one peer
+type ItemRange struct {
+	Client string `json:"client"`
+	Clock  int    `json:"clock"`
+	Length int    `json:"length"`
+}
+
+// CRDTUpdate carries inserted items and deleted ranges between peers
+type CRDTUpdate struct {
+	Items   []CRDTItem  `json:"items,omitempty"`
+	Deletes []ItemRange `json:"deletes,omitempty"`
+}
+
+// Empty -> true if the update carries nothing
+func (u CRDTUpdate) Empty() bool {
+	return len(u.Items) == 0 && len(u.Deletes) == 0
+}
+
+// StateVector maps each peer to the highest clock integrated from it
+type StateVector map[string]int
+
+type crdtItem struct {
+	id      ItemID
+	origin  *ItemID
+	content rune
+	deleted bool
+	// Following item in document order
+	next *crdtItem
+}
+
+// CRDTDocument is a replicated growable array (RGA) sequence. Concurrent
+// inserts after the same origin are ordered by descending ItemID, so every
+// peer that integrated the same items ends up with the same text.
+type CRDTDocument struct {
+	// Items in document order as a list after a sentinel, so that an item
+	// is placed from its origin found by id without scanning the document
+	start   crdtItem
+	size    int
+	byID    map[ItemID]*crdtItem
+	clients map[string][]*crdtItem // per peer in clock order
+	state   StateVector
+	clock   int
+
+	// Items and deletes waiting for an item they reference
+	pending        []crdtItem
+	pendingDeletes []ItemID
+}
+
+// Create an empty CRDT document
+func NewCRDTDocument() *CRDTDocument {
+	return &CRDTDocument{
+		byID:    make(map[ItemID]*crdtItem),
+		clients: make(map[string][]*crdtItem),
+		state:   make(StateVector),
+	}
+}
+
+// Text -> visible content of the document
+func (d *CRDTDocument) Text() string {
+	runes := make([]rune, 0, d.size)
+	for it := d.start.next; it != nil; it = it.next {
+		if !it.deleted {
+			runes = append(runes, it.content)
+		}
+	}
+	return string(runes)
+}
+
+// StateVector -> copy of the document state vector
+func (d *CRDTDocument) StateVector() StateVector {
+	sv := make(StateVector, len(d.state))
+	for client, clock := range d.state {
+		sv[client] = clock
+	}
+	return sv
+}
+
+func greater(a, b ItemID) bool {
+	return a.Clock > b.Clock || (a.Clock == b.Clock && a.Client > b.Client)
+}
+
+// Apply an update from a peer and return the part of it that was new
+// to this document, which is all that needs forwarding to other peers
+func (d *CRDTDocument) Apply(update CRDTUpdate) CRDTUpdate {
+	var applied CRDTUpdate
+
+	for _, run := range update.Items {
+		for _, it := range expand(run) {
+			if it.id.Clock <= d.state[it.id.Client] {
+				continue
+			}
+			if _, ok := d.byID[it.id]; ok {
+				continue
+			}
+			d.pending = append(d.pending, it)
+		}
+	}
+	// Origins always have a smaller clock, so clock order integrates most items in one pass
+	sort.SliceStable(d.pending, func(i, j int) bool { return greater(d.pending[j].id, d.pending[i].id) })
+
+	var integrated []*crdtItem
+	for progress := true; progress; {
+		progress = false
+		blocked := make(map[string]bool)
+		remaining := d.pending[:0]
+		for _, it := range d.pending {
+			if _, ok := d.byID[it.id]; ok || it.id.Clock <= d.state[it.id.Client] {
+				continue
+			}
+			// A peer's items are integrated strictly in clock order
+			if blocked[it.id.Client] || !d.integrate(it) {
+				blocked[it.id.Client] = true
+				remaining = append(remaining, it)
+				continue
+			}
+			integrated = append(integrated, d.byID[it.id])
+			progress = true
+		}
+		d.pending = remaining
+	}
+	if n := len(d.pending); n > maxCRDTPending {
+		d.pending = append([]crdtItem(nil), d.pending[n-maxCRDTPending:]...)
+	}
+	applied.Items = encodeItems(integrated)
+
+	for _, r := range update.Deletes {
+		// Clocks far beyond anything seen cannot be meant, only so many can wait
+		first := max(r.Clock, 1)
+		end := r.Clock + min(r.Length, d.clock+maxCRDTPending+1-r.Clock)
+		for clock := first; clock < end; clock++ {
+			d.pendingDeletes = append(d.pendingDeletes, ItemID{Client: r.Client, Clock: clock})
+		}
+	}
+	var deleted []ItemID
+	remaining := d.pendingDeletes[:0]
+	for _, id := range d.pendingDeletes {
+		it, ok := d.byID[id]
+		if !ok {
+			remaining = append(remaining, id)
+			continue
+		}
+		if !it.deleted {
+			it.deleted = true
+			deleted = append(deleted, id)
+		}
+	}
+	if n := len(remaining); n > maxCRDTPending {
+		remaining = append([]ItemID(nil), remaining[n-maxCRDTPending:]...)
+	}
+	d.pendingDeletes = remaining
+	applied.Deletes = encodeRanges(deleted)
+
+	return applied
+}
+
+// Known -> highest clock of the peer integrated or carried by the update.
+// Everything a peer deletes was delivered to it before, or is in the same update.
+func (d *CRDTDocument) known(client string, update CRDTUpdate) int {
+	clock := d.state[client]
+	for _, run := range update.Items {
+		if run.ID.Client == client {
+			clock = max(clock, run.ID.Clock+len([]rune(run.Content))-1)
+		}
+	}
+	return clock
+}
+
+// integrate places a single item after its origin, false if the origin is unknown
+func (d *CRDTDocument) integrate(it crdtItem) bool {
+	prev := &d.start
+	if it.origin != nil {
+		origin, ok := d.byID[*it.origin]
+		if !ok {
+			return false
+		}
+		prev = origin
+	}
+	// Skip newer concurrent inserts after the same origin and their descendants
+	for prev.next != nil && greater(prev.next.id, it.id) {
+		prev = prev.next
+	}
+
+	item := &crdtItem{id: it.id, origin: it.origin, content: it.content, next: prev.next}
+	prev.next = item
+	d.size++
+
+	d.byID[item.id] = item
+	d.clients[item.id.Client] = append(d.clients[item.id.Client], item)
+	d.state[item.id.Client] = item.id.Clock
+	d.clock = max(d.clock, item.id.Clock)
+	return true
+}
+
+// Missing -> everything the peer with the given state vector has not seen,
+// together with the full delete set since deletes are not versioned
+func (d *CRDTDocument) Missing(sv StateVector) CRDTUpdate {
+	var items []*crdtItem
+	var deleted []ItemID
+	for client, list := range d.clients {
+		known := sv[client]
+		for _, it := range list {
+			if it.id.Clock > known {
+				items = append(items, it)
+			}
+			if it.deleted {
+				deleted = append(deleted, it.id)
+			}
+		}
+	}
+	return CRDTUpdate{Items: encodeItems(items), Deletes: encodeRanges(deleted)}
+}
+
+// ApplyOperation converts a positional operation into CRDT items authored
+// by client and applies it. The resulting update is returned for peers.
+func (d *CRDTDocument) ApplyOperation(client string, op Operation) (CRDTUpdate, error) {
+	if err := op.Validate(); err != nil {
+		return CRDTUpdate{}, err
+	}
+	visible := make([]*crdtItem, 0, d.size)
+	for it := d.start.next; it != nil; it = it.next {
+		if !it.deleted {
+			visible = append(visible, it)
+		}
+	}
+	if op.BaseLen() != len(visible) {
+		return CRDTUpdate{}, ErrLengthMismatch
+	}
+
+	var update CRDTUpdate
+	var origin *ItemID
+	pos := 0
+	for _, o := range op {
+		switch {
+		case o.isRetain():
+			pos += o.Retain
+			id := visible[pos-1].id
+			origin = &id
+		case o.isInsert():
+			d.clock++
+			run := CRDTItem{ID: ItemID{Client: client, Clock: d.clock}, Origin: origin, Content: o.Insert}
+			d.clock += len([]rune(o.Insert)) - 1
+			update.Items = append(update.Items, run)
+			id := ItemID{Client: client, Clock: d.clock}
+			origin = &id
+		case o.isDelete():
+			var ids []ItemID
+			for _, it := range visible[pos : pos+o.Delete] {
+				ids = append(ids, it.id)
+			}
+			update.Deletes = append(update.Deletes, encodeRanges(ids)...)
+			pos += o.Delete
+		}
+	}
+	return d.Apply(update), nil
+}
+
+// expand a run into single character items
+func expand(run CRDTItem) []crdtItem {
+	runes := []rune(run.Content)
+	out := make([]crdtItem, 0, len(runes))
+	origin := run.Origin
+	for k, r := range runes {
+		id := ItemID{Client: run.ID.Client, Clock: run.ID.Clock + k}
+		out = append(out, crdtItem{id: id, origin: origin, content: r})
+		prev := id
+		origin = &prev
+	}
+	return out
+}
+
+// encodeItems merges consecutive characters of one peer back into runs
+func encodeItems(items []*crdtItem) []CRDTItem {
+	var runs []CRDTItem
+	for _, it := range items {
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			lastID := ItemID{Client: last.ID.Client, Clock: last.ID.Clock + len([]rune(last.Content)) - 1}
+			if it.origin != nil && *it.origin == lastID && it.id.Client == lastID.Client && it.id.Clock == lastID.Clock+1 {
+				last.Content += string(it.content)
+				continue
+			}
+		}
+		runs = append(runs, CRDTItem{ID: it.id, Origin: it.origin, Content: string(it.content)})
+	}
+	return runs
+}
+
+// encodeRanges merges consecutive clocks of one peer into ranges
+func encodeRanges(ids []ItemID) []ItemRange {
+	var ranges []ItemRange
+	for _, id := range ids {
+		if n := len(ranges); n > 0 {
+			last := &ranges[n-1]
+			if last.Client == id.Client && last.Clock+last.Length == id.Clock {
+				last.Length++
+				continue
+			}
+		}
+		ranges = append(ranges, ItemRange{Client: id.Client, Clock: id.Clock, Length: 1})
+	}
+	return ranges
+}
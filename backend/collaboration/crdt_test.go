@@ -0,0 +1,242 @@
+package collaboration
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insert applies an insert of text at pos by client and returns the update
+func insert(t *testing.T, d *CRDTDocument, client string, pos int, text string) CRDTUpdate {
+	t.Helper()
+	length := len([]rune(d.Text()))
+	op := Operation{}
+	if pos > 0 {
+		op = append(op, Op{Retain: pos})
+	}
+	op = append(op, Op{Insert: text})
+	if pos < length {
+		op = append(op, Op{Retain: length - pos})
+	}
+	update, err := d.ApplyOperation(client, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return update
+}
+
+func TestCRDTConcurrentInsertsConverge(t *testing.T) {
+	base := NewCRDTDocument()
+	seed := insert(t, base, "a", 0, "ac")
+
+	peers := make([]*CRDTDocument, 3)
+	for i := range peers {
+		peers[i] = NewCRDTDocument()
+		peers[i].Apply(seed)
+	}
+	// Three peers insert at the same position without seeing each other
+	updates := []CRDTUpdate{
+		insert(t, peers[0], "a", 1, "b"),
+		insert(t, peers[1], "b", 1, "XY"),
+		insert(t, peers[2], "c", 1, "z"),
+	}
+
+	orders := [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}}
+	var want string
+	for i, order := range orders {
+		d := NewCRDTDocument()
+		d.Apply(seed)
+		for _, k := range order {
+			d.Apply(updates[k])
+		}
+		if i == 0 {
+			want = d.Text()
+		} else if got := d.Text(); got != want {
+			t.Fatalf("order %v: %q, want %q", order, got, want)
+		}
+	}
+	if len(want) != 6 || want[0] != 'a' || want[5] != 'c' || !strings.Contains(want, "XY") {
+		t.Fatalf("merged text %q", want)
+	}
+}
+
+func TestCRDTOutOfOrderDelivery(t *testing.T) {
+	src := NewCRDTDocument()
+	first := insert(t, src, "a", 0, "hello")
+	second := insert(t, src, "a", 5, " world")
+	remove, err := src.ApplyOperation("a", Operation{{Delete: 6}, {Retain: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Text() != "world" {
+		t.Fatalf("source text %q", src.Text())
+	}
+
+	// The delete and the second insert arrive before what they refer to
+	d := NewCRDTDocument()
+	if applied := d.Apply(remove); !applied.Empty() {
+		t.Fatalf("applied %+v before its items arrived", applied)
+	}
+	d.Apply(second)
+	if d.Text() != "" {
+		t.Fatalf("text %q before the first insert arrived", d.Text())
+	}
+	applied := d.Apply(first)
+	if d.Text() != "world" {
+		t.Fatalf("text %q, want world", d.Text())
+	}
+	if len(applied.Items) == 0 || len(applied.Deletes) == 0 {
+		t.Fatalf("applied %+v, want the held back items and deletes", applied)
+	}
+
+	// Applying the same updates again changes nothing
+	for _, u := range []CRDTUpdate{first, second, remove} {
+		if again := d.Apply(u); !again.Empty() {
+			t.Fatalf("duplicate update applied %+v", again)
+		}
+	}
+}
+
+func TestCRDTMissing(t *testing.T) {
+	a := NewCRDTDocument()
+	insert(t, a, "a", 0, "abc")
+	b := NewCRDTDocument()
+	b.Apply(a.Missing(nil))
+	insert(t, a, "a", 3, "def")
+	if _, err := a.ApplyOperation("a", Operation{{Delete: 1}, {Retain: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := a.Missing(b.StateVector())
+	for _, run := range missing.Items {
+		if run.ID.Clock <= 3 {
+			t.Fatalf("missing update resends %+v", run)
+		}
+	}
+	b.Apply(missing)
+	if b.Text() != a.Text() || b.Text() != "bcdef" {
+		t.Fatalf("synced text %q, want %q", b.Text(), a.Text())
+	}
+}
+
+func TestCRDTRandomEditsConverge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	peers := []*CRDTDocument{NewCRDTDocument(), NewCRDTDocument(), NewCRDTDocument()}
+	sites := []string{"a", "b", "c"}
+	// Updates made by each peer, and how many of them each peer has seen
+	made := make([][]CRDTUpdate, len(peers))
+	seen := make([][]int, len(peers))
+	for i := range seen {
+		seen[i] = make([]int, len(peers))
+	}
+	// deliver the next updates of one site to a peer, in the order they
+	// were made as the hub forwards them
+	deliver := func(to, from, n int) {
+		for ; n > 0 && seen[to][from] < len(made[from]); n-- {
+			peers[to].Apply(made[from][seen[to][from]])
+			seen[to][from]++
+		}
+	}
+
+	for round := 0; round < 300; round++ {
+		k := rng.Intn(len(peers))
+		d := peers[k]
+		length := len([]rune(d.Text()))
+		var update CRDTUpdate
+		if length > 0 && rng.Intn(3) == 0 {
+			pos := rng.Intn(length)
+			n := 1 + rng.Intn(length-pos)
+			op := Operation{}
+			if pos > 0 {
+				op = append(op, Op{Retain: pos})
+			}
+			op = append(op, Op{Delete: n})
+			if pos+n < length {
+				op = append(op, Op{Retain: length - pos - n})
+			}
+			var err error
+			if update, err = d.ApplyOperation(sites[k], op); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			update = insert(t, d, sites[k], rng.Intn(length+1), string(rune('a'+rng.Intn(26))))
+		}
+		made[k] = append(made[k], update)
+		seen[k][k]++
+
+		// Other peers hear of some updates late, sites interleaved at random
+		to, from := rng.Intn(len(peers)), rng.Intn(len(peers))
+		if to != from {
+			deliver(to, from, rng.Intn(4))
+		}
+	}
+	for to := range peers {
+		for from := range peers {
+			deliver(to, from, len(made[from]))
+		}
+	}
+	for i, p := range peers[1:] {
+		if p.Text() != peers[0].Text() {
+			t.Fatalf("peer %d: %q, want %q", i+1, p.Text(), peers[0].Text())
+		}
+	}
+}
+
+func TestCRDTLongDocumentIntegratesQuickly(t *testing.T) {
+	// Typing one character at a time is the common case, every insert
+	// follows the previous one
+	d := NewCRDTDocument()
+	start := time.Now()
+	for i := 0; i < 20000; i++ {
+		d.Apply(CRDTUpdate{Items: []CRDTItem{{
+			ID:      ItemID{Client: "a", Clock: i + 1},
+			Origin:  originOf(i),
+			Content: "x",
+		}}})
+	}
+	if n := len(d.Text()); n != 20000 {
+		t.Fatalf("length %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("integrating 20000 items took %s", elapsed)
+	}
+}
+
+func originOf(clock int) *ItemID {
+	if clock == 0 {
+		return nil
+	}
+	return &ItemID{Client: "a", Clock: clock}
+}
+
+func TestCRDTPendingIsBounded(t *testing.T) {
+	d := NewCRDTDocument()
+	insert(t, d, "a", 0, "abc")
+
+	start := time.Now()
+	d.Apply(CRDTUpdate{Deletes: []ItemRange{{Client: "a", Clock: 2, Length: 1 << 60}}})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("huge delete range took %s", elapsed)
+	}
+	if d.Text() != "a" {
+		t.Fatalf("text %q, want the known items deleted", d.Text())
+	}
+	if len(d.pendingDeletes) > maxCRDTPending {
+		t.Fatalf("%d deletes pending", len(d.pendingDeletes))
+	}
+
+	// Items whose origins never arrive
+	var orphans CRDTUpdate
+	for i := 0; i < maxCRDTPending+100; i++ {
+		orphans.Items = append(orphans.Items, CRDTItem{
+			ID:      ItemID{Client: "b", Clock: 2*i + 2},
+			Origin:  &ItemID{Client: "c", Clock: i + 1},
+			Content: "x",
+		})
+	}
+	d.Apply(orphans)
+	if len(d.pending) > maxCRDTPending {
+		t.Fatalf("%d items pending", len(d.pending))
+	}
+}
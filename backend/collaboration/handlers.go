@@ -1,23 +1,28 @@
 package collaboration
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
-	"example.com/collaborative-coding-editor/config"
 	"example.com/collaborative-coding-editor/middleware"
+	"example.com/collaborative-coding-editor/session"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Global mapping of rooms and their hubs
 var (
 	hubs     = make(map[string]*Hub)
 	hubMutex sync.Mutex
+	// Set by Shutdown, no new hubs or connections are accepted afterwards
+	shuttingDown bool
 )
 
 // This upgrades the HTTP to websocket connection
@@ -25,17 +30,20 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-// Return hub for the room
+// Return hub for the room, nil once the server is shutting down
 func GetHub(roomID string) *Hub {
 	hubMutex.Lock()
 	defer hubMutex.Unlock()
 
+	if shuttingDown {
+		return nil
+	}
 	if hub, exists := hubs[roomID]; exists {
 		return hub
 	}
 
 	// if doent exists create a new hub
-	hub := NewHub()
+	hub := NewHub(roomID)
 	hubs[roomID] = hub
 
 	// run the hub
@@ -43,67 +51,53 @@ func GetHub(roomID string) *Hub {
 	return hub
 }
 
+// newClientID -> random connection id
+func newClientID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Accepting -> false once the server is shutting down
+func accepting() bool {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+	return !shuttingDown
+}
+
+// LookupHub returns the hub of a room without creating one
+func LookupHub(roomID string) (*Hub, bool) {
+	hubMutex.Lock()
+	defer hubMutex.Unlock()
+
+	hub, exists := hubs[roomID]
+	return hub, exists
+}
+
 // Upgrades the connection and registers the client
 // WebSocketHandler upgrades the connection and registers the client.
 func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
-	// Try to get claims from context.
-	var claims jwt.MapClaims
-	if ctxClaims := r.Context().Value(middleware.UserKey); ctxClaims != nil {
-		var ok bool
-		claims, ok = ctxClaims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
-		}
-	} else {
-		// If no claims in context, try to get token from query parameter.
-		tokenString := r.URL.Query().Get("token")
-		if tokenString == "" {
-			http.Error(w, "Unauthorized: missing token", http.StatusUnauthorized)
-			return
-		}
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(config.AppConfig.JWTSecret), nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized: invalid token", http.StatusUnauthorized)
-			return
-		}
-		var ok bool
-		claims, ok = token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Unauthorized: invalid token claims", http.StatusUnauthorized)
-			return
-		}
-	}
-
-	// Verify token expiration.
-	if exp, ok := claims["exp"].(float64); ok {
-		if int64(exp) < time.Now().Unix() {
-			http.Error(w, "Token expired", http.StatusUnauthorized)
-			return
-		}
+	claims, userID, userName, ok := authenticate(w, r)
+	if !ok {
+		return
 	}
 
-	// Extract the user ID.
-	userID, ok := claims["user_id"].(string)
+	// Extract the room ID from URL variables.
+	roomID := mux.Vars(r)["room_id"]
+	objectID, ok := parseRoomID(w, roomID)
 	if !ok {
-		http.Error(w, "Invalid user id", http.StatusUnauthorized)
 		return
 	}
-	userName, ok := claims["username"].(string)
-	if userName == "" {
-		userName = userID
+
+	// Only the admin and participants of an open room may connect.
+	if !session.RequireAccess(w, objectID, userID, session.AccessWrite) {
+		return
 	}
 
-	// Extract the room ID from URL variables.
-	vars := mux.Vars(r)
-	roomID, ok := vars["room_id"]
-	if !ok || roomID == "" {
-		http.Error(w, "Room ID is required", http.StatusBadRequest)
+	if !accepting() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -114,32 +108,107 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Obtain the hub for the room.
-	hub := GetHub(roomID)
+	// Reconnecting clients pass their connection id, the last sequence number
+	// they saw and the epoch of the snapshot it counts from.
+	// The id is the client's CRDT site, the server's own is not available.
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" || clientID == crdtServerSite {
+		clientID = newClientID()
+	}
+	since := int64(-1)
+	if s := r.URL.Query().Get("since"); s != "" {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+			since = n
+		}
+	}
 
 	// Create a new client.
 	client := &Client{
-		hub:      hub,
+		key:      newClientID(),
+		id:       clientID,
+		since:    since,
+		claims:   claims,
+		epoch:    r.URL.Query().Get("epoch"),
 		conn:     conn,
 		send:     make(chan Message, 256),
 		userID:   userID,
 		userName: userName,
 	}
 
-	// Broadcast the join event
-	joinMsg := Message{
-		Type:       MessageTypeChat,
-		SenderID:   client.userID,
-		SenderName: client.userName,
-		Content:    fmt.Sprintf("%s joined the room", client.userName),
-		Timestamp:  time.Now(),
+	// Register the client with the room's hub, which announces the join.
+	// A hub that stopped in the meantime is replaced by a new one.
+	for {
+		client.hub = GetHub(roomID)
+		if client.hub == nil {
+			conn.Close()
+			return
+		}
+		if client.hub.enter(client) {
+			break
+		}
 	}
-	hub.Broadcast <- joinMsg
-
-	// Register the client with the hub.
-	hub.Register <- client
 
 	// Start client read and write pumps.
 	go client.writePump()
 	client.readPump()
 }
+
+// authenticate reads the user from the request context or the token query
+// parameter, answering the request if there is none
+func authenticate(w http.ResponseWriter, r *http.Request) (claims jwt.MapClaims, userID, userName string, ok bool) {
+	// Try to get claims from context.
+	if ctxClaims := r.Context().Value(middleware.UserKey); ctxClaims != nil {
+		claims, ok = ctxClaims.(jwt.MapClaims)
+		if !ok {
+			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+			return nil, "", "", false
+		}
+	} else {
+		// If no claims in context, try to get token from query parameter.
+		tokenString := r.URL.Query().Get("token")
+		if tokenString == "" {
+			http.Error(w, "Unauthorized: missing token", http.StatusUnauthorized)
+			return nil, "", "", false
+		}
+		var err error
+		claims, err = middleware.ParseAccessToken(tokenString)
+		switch err {
+		case nil:
+		case middleware.ErrTokenExpired:
+			http.Error(w, "Token expired", http.StatusUnauthorized)
+			return nil, "", "", false
+		case middleware.ErrTokenRevoked:
+			http.Error(w, "Token revoked", http.StatusUnauthorized)
+			return nil, "", "", false
+		default:
+			http.Error(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+			return nil, "", "", false
+		}
+	}
+
+	// Extract the user ID.
+	userID, ok = claims["user_id"].(string)
+	if !ok {
+		http.Error(w, "Invalid user id", http.StatusUnauthorized)
+		return nil, "", "", false
+	}
+	userName, _ = claims["username"].(string)
+	if userName == "" {
+		userName = userID
+	}
+	return claims, userID, userName, true
+}
+
+// parseRoomID -> ObjectID of a room id, answering the request if it is invalid
+func parseRoomID(w http.ResponseWriter, roomID string) (primitive.ObjectID, bool) {
+	if roomID == "" {
+		http.Error(w, "Room ID is required", http.StatusBadRequest)
+		return primitive.NilObjectID, false
+	}
+	objectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return primitive.NilObjectID, false
+	}
+	return objectID, true
+}
@@ -1,11 +1,26 @@
 package collaboration
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"sync"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/session"
+)
+
+// Merge strategies for concurrent edits
+const (
+	MergeStrategyOT   = "ot"
+	MergeStrategyCRDT = "crdt"
 )
 
-// Hub maintains a set of active clients and broadcast messages
+// Hub maintains a set of active clients and broadcast messages.
+// Everything that changes room state is published to the backplane first
+// and applied when it comes back, so hubs of the same room on different
+// instances apply the same messages in the same order.
 type Hub struct {
 	// RoomID
 	RoomId string
@@ -17,51 +32,670 @@ type Hub struct {
 	Register chan *Client
 	//Unregister requests from clients
 	Unregister chan *Client
+	// Changes made by the server, e.g. through the session API
+	changes chan envelope
+	// Requests for the live contents of the workspace files
+	contentRequests chan chan map[string]string
 	//Lock to guard the Clinets mao
 	Mutex sync.Mutex
+
+	// Identifies this hub on the backplane
+	instance     string
+	backplane    Backplane
+	subscription Subscription
+	// Clients waiting for their join to come back from the backplane
+	pending map[string]*Client
+	// Connections on every instance, guarded by Mutex
+	members map[string]*member
+	// Last time each instance was heard of, and the heartbeat of this one
+	seen      map[string]time.Time
+	heartbeat *time.Ticker
+	// State hand-over from another instance, nil once the hub is in sync
+	sync *stateSync
+	// Running while nobody is connected here, the hub stops when it fires
+	idle *time.Timer
+	// Checks the access tokens of local clients
+	revocations *time.Ticker
+	// Set once the hub should stop, done is closed when it has
+	stopped bool
+	done    chan struct{}
+	// Closed when the server shuts down
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// Authoritative documents of the workspace files by path and the
+	// folders of the workspace, only touched from Run
+	mainFile string
+	files    map[string]*fileState
+	folders  map[string]bool
+	// Files keep CRDT state when the CRDT strategy is used
+	useCRDT bool
+	// Sequence number of the last broadcast message and the most recent ones.
+	// The epoch names the history the numbers belong to, a new hub with no
+	// other instance to take over from starts a new one.
+	seq    int64
+	epoch  string
+	replay *replayBuffer
+	// Session revision the documents were loaded from or last saved as,
+	// and the one an autosave was last rejected at
+	saved      int64
+	staleSaved int64
+	// Unsaved changes, who made them and the pending autosave
+	dirty        bool
+	dirtySince   time.Time
+	lastEditor   string
+	contributors map[string]bool
+	autosave     *time.Timer
+	// Writes the changes made through this instance for playback, nil until the first one
+	recorder *recorder
 }
 
 // Create a new Hub instance
-func NewHub() *Hub {
-	return &Hub{
-		Clients:    make(map[*Client]bool),
-		Broadcast:  make(chan Message),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
+func NewHub(roomID string) *Hub {
+	hub := &Hub{
+		RoomId:          roomID,
+		Clients:         make(map[*Client]bool),
+		Broadcast:       make(chan Message),
+		Register:        make(chan *Client),
+		Unregister:      make(chan *Client),
+		changes:         make(chan envelope),
+		contentRequests: make(chan chan map[string]string),
+		instance:        newClientID(),
+		backplane:       backplane,
+		pending:         make(map[string]*Client),
+		members:         make(map[string]*member),
+		seen:            make(map[string]time.Time),
+		done:            make(chan struct{}),
+		quit:            make(chan struct{}),
+		epoch:           newClientID(),
+		staleSaved:      -1,
+		replay:          newReplayBuffer(config.AppConfig.ReplayBufferSize),
+		useCRDT:         config.AppConfig.MergeStrategy == MergeStrategyCRDT,
+	}
+	hub.loadWorkspace(session.DefaultMainFile, "", nil)
+	return hub
+}
+
+// Seed the room workspace from the last saved session
+func (h *Hub) load() {
+	sess, err := session.LoadSession(h.RoomId)
+	if err != nil {
+		log.Printf("Error loading session for room %s: %v", h.RoomId, err)
+		return
+	}
+	if sess == nil {
+		return
 	}
+	h.loadWorkspace(session.MainFile(sess), sess.Code, sess.Files)
+	h.saved = sess.Revision
+}
+
+// Subscribe to the room on the backplane, falling back to a private
+// in-process backplane so the room keeps working on this instance
+func (h *Hub) subscribe() {
+	sub, err := h.backplane.Subscribe(h.RoomId)
+	if err != nil {
+		log.Printf("Error subscribing to room %s, serving it locally: %v", h.RoomId, err)
+		h.backplane = NewLocalBackplane()
+		sub, _ = h.backplane.Subscribe(h.RoomId)
+	}
+	h.subscription = sub
 }
 
 // Starts the Hub main loop
 func (h *Hub) Run() {
-	for {
+	h.load()
+	h.subscribe()
+	h.startSync()
+	h.startHeartbeat()
+	h.checkIdle()
+	h.revocations = time.NewTicker(revocationCheckInterval)
+
+	for !h.stopped {
 		select {
 		case client := <-h.Register:
 			h.Mutex.Lock()
-			h.Clients[client] = true
+			h.pending[client.key] = client
 			h.Mutex.Unlock()
-			log.Printf("Client Registered: %s", client.userID)
+			h.checkIdle()
+			h.publish(envelope{Kind: envelopeJoin, ClientKey: client.key, ClientID: client.id, UserID: client.userID, UserName: client.userName})
 
 		case client := <-h.Unregister:
 			h.Mutex.Lock()
+			delete(h.pending, client.key)
 			if _, ok := h.Clients[client]; ok {
 				delete(h.Clients, client)
 				close(client.send)
 				log.Printf("Client Unregistered: %s", client.userID)
 			}
+			last := len(h.Clients) == 0 && len(h.pending) == 0
 			h.Mutex.Unlock()
+			h.checkIdle()
+			h.publish(envelope{Kind: envelopeLeave, ClientKey: client.key})
+			if last {
+				// Nobody is left to lose the changes, save them now
+				h.flush()
+			}
 
 		case message := <-h.Broadcast:
-			h.Mutex.Lock()
-			for client := range h.Clients {
-				select {
-				case client.send <- message:
-				default:
-					// If the clients send buffer is full remove the client
-					close(client.send)
-					delete(h.Clients, client)
+			h.publish(envelope{Kind: envelopeMessage, ClientKey: message.sender, Message: &message})
+
+		case env := <-h.changes:
+			h.publish(env)
+
+		case reply := <-h.pendingContentRequests():
+			reply <- h.contents()
+
+		case payload := <-h.subscription.Messages():
+			if payload == nil {
+				// Messages were lost on the backplane, take the state over again.
+				// Without other instances the clients load the room again instead.
+				if !h.backplane.Distributed() {
+					h.dropClients()
 				}
+				h.startSync()
+				continue
 			}
-			h.Mutex.Unlock()
+			var env envelope
+			if err := json.Unmarshal(payload, &env); err != nil {
+				log.Printf("Error decoding backplane message for room %s: %v", h.RoomId, err)
+				continue
+			}
+			h.receive(env)
+
+		case <-h.syncTimeout():
+			h.finishSync(nil)
+
+		case <-h.revocations.C:
+			h.dropRevoked()
+
+		case <-h.heartbeatC():
+			h.publish(envelope{Kind: envelopeHeartbeat})
+			h.expireMembers()
+
+		case <-h.autosaveTimeout():
+			h.autosave = nil
+			h.flush()
+
+		case <-h.quit:
+			h.restart()
+
+		case <-h.idleTimeout():
+			h.idle = nil
+			log.Printf("Room %s idle, stopping hub", h.RoomId)
+			h.stopped = true
+		}
+	}
+	h.shutdown()
+}
+
+// Publish an envelope for every hub of the room, including this one
+func (h *Hub) publish(env envelope) {
+	env.Instance = h.instance
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Error encoding backplane message for room %s: %v", h.RoomId, err)
+		return
+	}
+	if err := h.backplane.Publish(h.RoomId, payload); err != nil {
+		log.Printf("Error publishing to room %s: %v", h.RoomId, err)
+	}
+}
+
+// Apply an envelope received from the backplane
+func (h *Hub) receive(env envelope) {
+	h.seen[env.Instance] = time.Now()
+	if env.Kind == envelopeHeartbeat {
+		return
+	}
+	if h.sync != nil && h.holdForSync(env) {
+		return
+	}
+	if env.Message != nil {
+		env.Message.origin = env.Instance
+	}
+
+	switch env.Kind {
+	case envelopeJoin:
+		h.join(env)
+	case envelopeLeave:
+		h.leave(env)
+	case envelopeStateRequest:
+		h.answerSync(env)
+	case envelopePresenceRequest:
+		h.answerPresence(env)
+	case envelopeClose:
+		if env.Message != nil {
+			h.broadcast(*env.Message, false)
+		}
+		h.stopped = true
+	case envelopeRestore:
+		if env.Message == nil {
+			return
+		}
+		// The restored workspace is already saved, only the live documents change
+		h.saved = max(h.saved, env.Revision)
+		h.startRecording(*env.Message)
+		h.restoreWorkspace(*env.Message)
+		h.markClean()
+		if h.recording(*env.Message) {
+			h.recordSnapshot(env.Message.SenderID, env.Message.SenderName)
+		}
+	case envelopeWorkspace:
+		h.saved = max(h.saved, env.Revision)
+		if env.Message != nil {
+			h.applyWorkspace(*env.Message)
+		}
+	case envelopeSaved:
+		h.saved = max(h.saved, env.Revision)
+	case envelopeMessage:
+		if env.Message == nil {
+			return
+		}
+		message := *env.Message
+		h.Mutex.Lock()
+		message.from = h.members[env.ClientKey]
+		h.Mutex.Unlock()
+		h.handle(message)
+	}
+}
+
+// Dispatch a message from a client or the server
+func (h *Hub) handle(message Message) {
+	switch message.Type {
+	case MessageTypeEdit, MessageTypeFileEdit:
+		if h.useCRDT {
+			h.handleLegacyCRDTEdit(message)
+		} else {
+			h.handleEdit(message)
+		}
+	case MessageTypeCRDTUpdate:
+		h.handleCRDTUpdate(message)
+	case MessageTypeCRDTSync:
+		h.handleCRDTSync(message)
+	case MessageTypeCursor, MessageTypeSelection:
+		h.handlePresence(message)
+	case MessageTypeChat:
+		h.broadcast(message, false)
+	default:
+		// Everything else is sent by the server only, clients must not forge it
+		log.Printf("Dropped %q message from %s in room %s", message.Type, message.SenderID, h.RoomId)
+	}
+}
+
+// Add a connection to the roster and bring a local client up to date
+func (h *Hub) join(env envelope) {
+	m := &member{
+		instance: env.Instance,
+		key:      env.ClientKey,
+		clientID: env.ClientID,
+		userID:   env.UserID,
+		userName: env.UserName,
+	}
+
+	h.Mutex.Lock()
+	h.members[m.key] = m
+	var client *Client
+	if env.Instance == h.instance {
+		if client = h.pending[m.key]; client != nil {
+			delete(h.pending, m.key)
+			h.Clients[client] = true
+		}
+	}
+	h.Mutex.Unlock()
+
+	// Announce the user's first connection to everybody else
+	if h.connections(m.userID) == 1 {
+		h.broadcast(h.presenceMessage(MessageTypePresenceJoin, m,
+			fmt.Sprintf("%s joined the room", m.userName)), true)
+	}
+
+	if client != nil {
+		log.Printf("Client Registered: %s", client.userID)
+		h.welcome(client)
+	}
+}
+
+// Remove a connection and announce the user's leave once the last connection is gone
+func (h *Hub) leave(env envelope) {
+	h.Mutex.Lock()
+	m, ok := h.members[env.ClientKey]
+	delete(h.members, env.ClientKey)
+	h.Mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	if h.connections(m.userID) == 0 {
+		h.broadcast(h.presenceMessage(MessageTypePresenceLeave, m,
+			fmt.Sprintf("%s left the room", m.userName)), false)
+	}
+}
+
+// Send a newly registered client the document, roster and cursors
+func (h *Hub) welcome(client *Client) {
+	// Reconnecting clients get what they missed, everybody else the current document
+	h.catchUp(client)
+	h.send(client, Message{
+		Type:         MessageTypePresenceSnapshot,
+		SenderName:   "System",
+		Timestamp:    time.Now(),
+		RoomID:       h.RoomId,
+		Participants: h.Presence(),
+	})
+	h.sendCursors(client)
+	if h.useCRDT {
+		// Start the sync handshake for every file, the client answers with its own state vectors
+		for path, f := range h.files {
+			h.send(client, Message{
+				Type:        MessageTypeCRDTSync,
+				Timestamp:   time.Now(),
+				RoomID:      h.RoomId,
+				Path:        path,
+				StateVector: f.crdt.StateVector(),
+			})
+		}
+	}
+}
+
+// Replay the messages a reconnecting client missed, or send a snapshot
+// when the gap is no longer in the replay buffer or the client's sequence
+// number is from another epoch, e.g. of a hub that was stopped since
+func (h *Hub) catchUp(client *Client) {
+	if client.since >= 0 && client.epoch == h.epoch {
+		missed, ok := h.replay.since(client.since, h.seq)
+		// Leave room in the send buffer for the messages that follow
+		if ok && len(missed) <= cap(client.send)/2 {
+			for _, entry := range missed {
+				switch {
+				case entry.exclude != client.id:
+					h.send(client, entry.message)
+				case entry.message.Type == MessageTypeEdit || entry.message.Type == MessageTypeFileEdit:
+					// The client's own edit, its ack may have been lost with the connection
+					h.send(client, h.ack(entry.message))
+				}
+			}
+			return
+		}
+	}
+	snapshot := h.snapshot()
+	snapshot.ClientID = client.id
+	h.send(client, snapshot)
+}
+
+// Apply an edit to a workspace file and fan out the transformed operation.
+// The sender gets an ack, everybody else the operation with the new revision.
+func (h *Hub) handleEdit(message Message) {
+	h.startRecording(message)
+	path := h.resolve(message.Path)
+	f := h.files[path]
+	if f == nil {
+		log.Printf("Rejected edit from %s in room %s: no file %q", message.SenderID, h.RoomId, path)
+		h.reply(message, h.snapshot())
+		return
+	}
+
+	ops := message.Ops
+	revision := message.Revision
+	if ops == nil {
+		// Legacy clients send the whole buffer, turn it into an operation on the latest revision
+		ops = ReplaceOperation(f.document.Text(), message.Content)
+		revision = f.document.Revision()
+	}
+
+	applied, err := f.document.Apply(revision, ops)
+	if err != nil {
+		log.Printf("Rejected edit from %s in room %s: %v", message.SenderID, h.RoomId, err)
+		h.reply(message, h.snapshot())
+		return
+	}
+
+	h.markDirty(message)
+	message.Type = h.editType(path)
+	message.Path = path
+	message.Ops = applied
+	message.Revision = f.document.Revision()
+	// Full text is kept for clients that do not apply operations
+	message.Content = f.document.Text()
+	message.RoomID = h.RoomId
+	h.broadcast(message, true)
+	message.Seq = h.seq
+	h.reply(message, h.ack(message))
+	h.recordEdit(message, path, applied)
+}
+
+// ack -> acknowledgement of a broadcast edit for its sender, carrying the
+// revision and sequence number the edit was broadcast with
+func (h *Hub) ack(edit Message) Message {
+	return Message{
+		Type:      MessageTypeAck,
+		Timestamp: time.Now(),
+		RoomID:    h.RoomId,
+		Seq:       edit.Seq,
+		Revision:  edit.Revision,
+		Path:      edit.Path,
+	}
+}
+
+// Integrate a CRDT update and forward only the part other peers have not seen
+func (h *Hub) handleCRDTUpdate(message Message) {
+	f := h.file(message.Path)
+	if f == nil || f.crdt == nil || message.Update == nil {
+		return
+	}
+	// Peers only insert items of their own site, anything else would let
+	// them take over the clocks of another peer or the server
+	for _, item := range message.Update.Items {
+		if item.ID.Client != message.ClientID || item.ID.Client == crdtServerSite {
+			log.Printf("Rejected CRDT update from %s in room %s: items of site %q", message.SenderID, h.RoomId, item.ID.Client)
+			return
+		}
+	}
+	// Clients only delete items they have seen, which the hub has too
+	for _, r := range message.Update.Deletes {
+		if r.Clock < 1 || r.Length < 1 || r.Length > f.crdt.known(r.Client, *message.Update)-r.Clock+1 {
+			log.Printf("Rejected CRDT update from %s in room %s: delete of unknown items of site %q", message.SenderID, h.RoomId, r.Client)
+			return
+		}
+	}
+	h.startRecording(message)
+	var before string
+	if h.recording(message) {
+		before = f.crdt.Text()
+	}
+	applied := f.crdt.Apply(*message.Update)
+	if applied.Empty() {
+		return
+	}
+	h.markDirty(message)
+	message.Update = &applied
+	message.Content = ""
+	message.RoomID = h.RoomId
+	h.broadcast(message, true)
+	if h.recording(message) {
+		h.recordEdit(message, h.resolve(message.Path), ReplaceOperation(before, f.crdt.Text()))
+	}
+}
+
+// Answer a client's state vector with the updates it is missing
+func (h *Hub) handleCRDTSync(message Message) {
+	f := h.file(message.Path)
+	if f == nil || f.crdt == nil {
+		return
+	}
+	missing := f.crdt.Missing(message.StateVector)
+	h.reply(message, Message{
+		Type:        MessageTypeCRDTUpdate,
+		SenderName:  "System",
+		Timestamp:   time.Now(),
+		RoomID:      h.RoomId,
+		Path:        message.Path,
+		Update:      &missing,
+		StateVector: f.crdt.StateVector(),
+	})
+}
+
+// Whole buffer edits in CRDT mode are converted into items authored by the server
+func (h *Hub) handleLegacyCRDTEdit(message Message) {
+	path := h.resolve(message.Path)
+	f := h.files[path]
+	if f == nil {
+		log.Printf("Rejected edit from %s in room %s: no file %q", message.SenderID, h.RoomId, path)
+		return
+	}
+	h.startRecording(message)
+	op := ReplaceOperation(f.crdt.Text(), message.Content)
+	update, err := f.crdt.ApplyOperation(crdtServerSite, op)
+	if err != nil {
+		log.Printf("Rejected edit from %s in room %s: %v", message.SenderID, h.RoomId, err)
+		return
+	}
+	if update.Empty() {
+		return
+	}
+	h.markDirty(message)
+	message.Type = MessageTypeCRDTUpdate
+	message.Path = path
+	message.Update = &update
+	message.Content = ""
+	message.RoomID = h.RoomId
+	h.broadcast(message, true)
+	h.recordEdit(message, path, op)
+}
+
+// Remember a client's cursor or selection and share it with everybody else
+func (h *Hub) handlePresence(message Message) {
+	if message.from == nil {
+		return
+	}
+	message.Color = colorFor(message.SenderID)
+	message.Content = ""
+	message.RoomID = h.RoomId
+	if message.Type == MessageTypeCursor {
+		message.Selection = nil
+	} else {
+		message.Cursor = nil
+	}
+
+	stored := message
+	stored.from = nil
+	h.Mutex.Lock()
+	if message.Type == MessageTypeCursor {
+		message.from.cursor = &stored
+	} else {
+		message.from.selection = &stored
+	}
+	h.Mutex.Unlock()
+	h.broadcast(message, true)
+}
+
+// Send the latest cursors and selections of everybody present to a client
+func (h *Hub) sendCursors(client *Client) {
+	h.Mutex.Lock()
+	var latest []Message
+	for key, m := range h.members {
+		if key == client.key {
+			continue
+		}
+		if m.cursor != nil {
+			latest = append(latest, *m.cursor)
+		}
+		if m.selection != nil {
+			latest = append(latest, *m.selection)
 		}
 	}
+	h.Mutex.Unlock()
+
+	for _, msg := range latest {
+		h.send(client, msg)
+	}
+}
+
+// Text -> current text of the main file for the room's merge strategy
+func (h *Hub) text() string {
+	return h.files[h.mainFile].text()
+}
+
+// Snapshot message with the main file in Content and every file of the
+// workspace in Files. In CRDT mode it also carries the full CRDT state so
+// the client can merge further updates.
+func (h *Hub) snapshot() Message {
+	main := h.files[h.mainFile]
+	msg := Message{
+		Type:       MessageTypeSnapshot,
+		SenderName: "System",
+		Content:    main.text(),
+		Timestamp:  time.Now(),
+		RoomID:     h.RoomId,
+		Revision:   main.document.Revision(),
+		Seq:        h.seq,
+		Epoch:      h.epoch,
+		Files:      h.fileStates(true),
+	}
+	if main.crdt != nil {
+		state := main.crdt.Missing(nil)
+		msg.Update = &state
+		msg.StateVector = main.crdt.StateVector()
+	}
+	return msg
+}
+
+// Send a message to every local client, skipping its sender if asked.
+// Every broadcast gets the next sequence number and is kept for replay.
+func (h *Hub) broadcast(message Message, excludeSender bool) {
+	h.seq++
+	message.Seq = h.seq
+
+	var exclude string
+	entry := replayEntry{message: message}
+	if excludeSender && message.from != nil {
+		exclude = message.from.key
+		entry.exclude = message.from.clientID
+	}
+	entry.message.from = nil
+	h.replay.add(entry)
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for client := range h.Clients {
+		if exclude != "" && client.key == exclude {
+			continue
+		}
+		h.deliver(client, message)
+	}
+}
+
+// Send a message back to the sender of another one if it is connected here
+func (h *Hub) reply(to Message, message Message) {
+	if to.from == nil || to.from.instance != h.instance {
+		return
+	}
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for client := range h.Clients {
+		if client.key == to.from.key {
+			h.deliver(client, message)
+			return
+		}
+	}
+}
+
+// Send a message to a single client
+func (h *Hub) send(client *Client, message Message) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	if _, ok := h.Clients[client]; ok {
+		h.deliver(client, message)
+	}
+}
+
+// deliver queues the message for the client, must be called with Mutex held
+func (h *Hub) deliver(client *Client, message Message) {
+	select {
+	case client.send <- message:
+	default:
+		// If the clients send buffer is full remove the client
+		close(client.send)
+		delete(h.Clients, client)
+	}
 }
@@ -0,0 +1,236 @@
+package collaboration
+
+import (
+	"testing"
+
+	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/middleware"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestHub -> hub that is not running, with OT documents and a small replay buffer
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	return newStrategyHub(t, MergeStrategyOT)
+}
+
+func newStrategyHub(t *testing.T, strategy string) *Hub {
+	t.Helper()
+	prev := config.AppConfig
+	config.AppConfig = &config.Config{ReplayBufferSize: 16, MergeStrategy: strategy}
+	t.Cleanup(func() { config.AppConfig = prev })
+	return NewHub("room")
+}
+
+// connect adds a client to the hub as a join would
+func connect(h *Hub, since int64, epoch string) *Client {
+	client := &Client{key: newClientID(), id: newClientID(), send: make(chan Message, 16), since: since, epoch: epoch}
+	h.Mutex.Lock()
+	h.Clients[client] = true
+	h.Mutex.Unlock()
+	return client
+}
+
+// sent -> messages queued for a client
+func sent(client *Client) []Message {
+	var messages []Message
+	for {
+		select {
+		case msg := <-client.send:
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestCatchUpReplaysSameEpoch(t *testing.T) {
+	h := newTestHub(t)
+	for _, text := range []string{"one", "two", "three"} {
+		h.broadcast(Message{Type: MessageTypeChat, Content: text}, false)
+	}
+
+	client := connect(h, 1, h.epoch)
+	h.catchUp(client)
+	got := sent(client)
+	if len(got) != 2 || got[0].Content != "two" || got[1].Content != "three" || got[1].Seq != 3 {
+		t.Fatalf("replayed %+v, want messages 2 and 3", got)
+	}
+}
+
+func TestCatchUpSnapshotOtherEpoch(t *testing.T) {
+	h := newTestHub(t)
+	for _, text := range []string{"one", "two"} {
+		h.broadcast(Message{Type: MessageTypeChat, Content: text}, false)
+	}
+
+	// A sequence number of a stopped hub of the room, or none at all
+	for _, epoch := range []string{"stale", ""} {
+		client := connect(h, 1, epoch)
+		h.catchUp(client)
+		got := sent(client)
+		if len(got) != 1 || got[0].Type != MessageTypeSnapshot {
+			t.Fatalf("epoch %q: got %+v, want a snapshot", epoch, got)
+		}
+		if got[0].Epoch != h.epoch || got[0].Seq != 2 || got[0].ClientID != client.id {
+			t.Fatalf("epoch %q: snapshot %+v", epoch, got[0])
+		}
+	}
+}
+
+func TestImportStateKeepsEpoch(t *testing.T) {
+	from := newTestHub(t)
+	from.broadcast(Message{Type: MessageTypeChat, Content: "one"}, false)
+	to := newTestHub(t)
+	if to.epoch == from.epoch {
+		t.Fatal("hubs started with the same epoch")
+	}
+
+	to.importState(from.exportState())
+	if to.epoch != from.epoch || to.seq != from.seq {
+		t.Fatalf("epoch %q seq %d, want %q and %d", to.epoch, to.seq, from.epoch, from.seq)
+	}
+}
+
+func TestHandleDropsServerMessageTypes(t *testing.T) {
+	h := newTestHub(t)
+	client := connect(h, -1, "")
+
+	for _, msgType := range []MessageType{MessageTypeSnapshot, MessageTypeAck, MessageTypePresenceJoin,
+		MessageTypeServerRestarting, MessageTypeRoomClosed, MessageTypeFileDeleted, "made_up"} {
+		h.handle(Message{Type: msgType, Content: "forged"})
+	}
+	if got := sent(client); len(got) != 0 {
+		t.Fatalf("forged messages relayed: %+v", got)
+	}
+
+	h.handle(Message{Type: MessageTypeChat, Content: "hi"})
+	if got := sent(client); len(got) != 1 || got[0].Content != "hi" {
+		t.Fatalf("chat relayed as %+v", got)
+	}
+}
+
+func TestHandleCRDTUpdateRejectsOtherSites(t *testing.T) {
+	h := newStrategyHub(t, MergeStrategyCRDT)
+	client := connect(h, -1, "")
+	update := func(clientID, site string) Message {
+		return Message{Type: MessageTypeCRDTUpdate, ClientID: clientID, Update: &CRDTUpdate{
+			Items: []CRDTItem{{ID: ItemID{Client: site, Clock: 1}, Content: "x"}},
+		}}
+	}
+
+	h.handle(update("c1", "c2"))
+	h.handle(update(crdtServerSite, crdtServerSite))
+	if got := sent(client); len(got) != 0 || h.text() != "" {
+		t.Fatalf("forged update applied: text %q, sent %+v", h.text(), got)
+	}
+
+	h.handle(update("c1", "c1"))
+	if got := sent(client); len(got) != 1 || h.text() != "x" {
+		t.Fatalf("own update: text %q, sent %+v", h.text(), got)
+	}
+}
+
+func TestDropRevokedDisconnectsClients(t *testing.T) {
+	h := newTestHub(t)
+	prev := middleware.TokenRevoked
+	middleware.TokenRevoked = func(claims jwt.MapClaims) bool { return claims["user_id"] == "mallory" }
+	t.Cleanup(func() { middleware.TokenRevoked = prev })
+
+	revoked := connect(h, -1, "")
+	revoked.claims = jwt.MapClaims{"user_id": "mallory"}
+	valid := connect(h, -1, "")
+	valid.claims = jwt.MapClaims{"user_id": "ada"}
+
+	h.dropRevoked()
+	if _, ok := <-revoked.send; ok {
+		t.Fatal("revoked client's connection still open")
+	}
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	if h.Clients[revoked] || !h.Clients[valid] {
+		t.Fatalf("clients after the check: %v", h.Clients)
+	}
+}
+
+func TestContentsWaitForStateHandOver(t *testing.T) {
+	h := newTestHub(t)
+	h.files["lib/util.py"] = h.newFile("def util(): pass\n")
+	h.handle(Message{Type: MessageTypeEdit, Content: "print(1)\n"})
+
+	contents := h.contents()
+	if contents[h.mainFile] != "print(1)\n" || contents["lib/util.py"] != "def util(): pass\n" {
+		t.Fatalf("contents %v", contents)
+	}
+
+	h.sync = &stateSync{}
+	if h.pendingContentRequests() != nil {
+		t.Fatal("contents handed out before the hub took over the room state")
+	}
+	h.sync = nil
+	if h.pendingContentRequests() == nil {
+		t.Fatal("contents held back from a hub in sync")
+	}
+}
+
+func TestHandleCRDTUpdateRejectsUnknownDeletes(t *testing.T) {
+	h := newStrategyHub(t, MergeStrategyCRDT)
+	client := connect(h, -1, "")
+	h.handle(Message{Type: MessageTypeCRDTUpdate, ClientID: "c1", Update: &CRDTUpdate{
+		Items: []CRDTItem{{ID: ItemID{Client: "c1", Clock: 1}, Content: "abc"}},
+	}})
+	sent(client)
+
+	for _, r := range []ItemRange{
+		{Client: "c1", Clock: 1, Length: 1 << 60},
+		{Client: "c1", Clock: 4, Length: 1},
+		{Client: "c2", Clock: 1, Length: 1},
+		{Client: "c1", Clock: 0, Length: 1},
+		{Client: "c1", Clock: 1, Length: 0},
+	} {
+		h.handle(Message{Type: MessageTypeCRDTUpdate, ClientID: "c1", Update: &CRDTUpdate{Deletes: []ItemRange{r}}})
+	}
+	if got := sent(client); len(got) != 0 || h.text() != "abc" {
+		t.Fatalf("unknown deletes applied: text %q, sent %+v", h.text(), got)
+	}
+
+	// Deleting known items, and items of the same update, is fine
+	h.handle(Message{Type: MessageTypeCRDTUpdate, ClientID: "c1", Update: &CRDTUpdate{
+		Items:   []CRDTItem{{ID: ItemID{Client: "c1", Clock: 4}, Origin: &ItemID{Client: "c1", Clock: 3}, Content: "d"}},
+		Deletes: []ItemRange{{Client: "c1", Clock: 1, Length: 1}, {Client: "c1", Clock: 4, Length: 1}},
+	}})
+	if h.text() != "bc" {
+		t.Fatalf("text %q, want bc", h.text())
+	}
+}
+
+func TestCatchUpAcksOwnEdits(t *testing.T) {
+	h := newTestHub(t)
+	writer := connect(h, -1, "")
+	own := &member{instance: h.instance, key: writer.key, clientID: writer.id}
+	other := &member{instance: h.instance, key: newClientID(), clientID: newClientID()}
+
+	h.handleEdit(Message{Type: MessageTypeEdit, Ops: ReplaceOperation("", "a"), from: own})
+	h.handleEdit(Message{Type: MessageTypeEdit, Revision: 1, Ops: ReplaceOperation("a", "ab"), from: other})
+	h.broadcast(Message{Type: MessageTypeCursor, Cursor: &Position{}, from: own}, true)
+
+	live := sent(writer)
+	if len(live) != 2 || live[0].Type != MessageTypeAck || live[0].Seq != 1 || live[0].Revision != 1 {
+		t.Fatalf("sent %+v, want the ack of seq 1 and the other edit", live)
+	}
+
+	// The same client reconnects without having seen its ack
+	h.Mutex.Lock()
+	delete(h.Clients, writer)
+	h.Mutex.Unlock()
+	again := connect(h, 0, h.epoch)
+	again.id = writer.id
+	h.catchUp(again)
+	got := sent(again)
+	if len(got) != 2 || got[0].Type != MessageTypeAck || got[0].Seq != 1 || got[0].Revision != 1 {
+		t.Fatalf("replayed %+v, want an ack of the own edit first", got)
+	}
+	if got[1].Type != MessageTypeEdit || got[1].Seq != 2 || got[1].Revision != 2 {
+		t.Fatalf("replayed %+v, want the other edit after the ack", got)
+	}
+}
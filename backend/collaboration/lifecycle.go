@@ -0,0 +1,196 @@
+package collaboration
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+)
+
+// Hand a client to the hub, false if the hub has stopped in the meantime
+func (h *Hub) enter(client *Client) bool {
+	select {
+	case h.Register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Take a client out of the hub, a stopped hub has already dropped it
+func (h *Hub) exit(client *Client) {
+	select {
+	case h.Unregister <- client:
+	case <-h.done:
+	}
+}
+
+// Hand a message to the hub, false once the hub has stopped
+func (h *Hub) submit(message Message) bool {
+	select {
+	case h.Broadcast <- message:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Hand a server made change to the hub, false once the hub has stopped
+func (h *Hub) change(env envelope) bool {
+	select {
+	case h.changes <- env:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Ask the hub for the live contents of the workspace files, false once the hub has stopped
+func (h *Hub) liveContents() (map[string]string, bool) {
+	reply := make(chan map[string]string, 1)
+	select {
+	case h.contentRequests <- reply:
+		return <-reply, true
+	case <-h.done:
+		return nil, false
+	}
+}
+
+// Done -> closed once the hub has stopped
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// CloseRoom sends a final message to everybody in the room on every
+// instance, disconnects them and stops the room's hubs
+func CloseRoom(roomID string, message Message) error {
+	payload, err := json.Marshal(envelope{Kind: envelopeClose, Message: &message})
+	if err != nil {
+		return err
+	}
+	return backplane.Publish(roomID, payload)
+}
+
+// Stop the hub because this server is going down. Other instances keep
+// serving the room, so only local clients are told and removed.
+func (h *Hub) Stop() {
+	h.quitOnce.Do(func() { close(h.quit) })
+}
+
+// Tell local clients the server is restarting and leave the room on the backplane
+func (h *Hub) restart() {
+	message := Message{
+		Type:       MessageTypeServerRestarting,
+		SenderID:   "server",
+		SenderName: "Server",
+		Content:    "The server is restarting, you will be reconnected shortly",
+		RoomID:     h.RoomId,
+		Timestamp:  time.Now(),
+	}
+
+	h.Mutex.Lock()
+	var keys []string
+	for client := range h.Clients {
+		keys = append(keys, client.key)
+		h.deliver(client, message)
+	}
+	h.Mutex.Unlock()
+
+	for _, key := range keys {
+		h.publish(envelope{Kind: envelopeLeave, ClientKey: key})
+	}
+	h.stopped = true
+}
+
+// Shutdown stops every hub of this instance, saving their documents, and
+// waits for them to finish or for the context to expire. New WebSocket
+// connections are refused from now on.
+func Shutdown(ctx context.Context) error {
+	hubMutex.Lock()
+	shuttingDown = true
+	running := make([]*Hub, 0, len(hubs))
+	for _, hub := range hubs {
+		running = append(running, hub)
+	}
+	hubMutex.Unlock()
+
+	for _, hub := range running {
+		hub.Stop()
+	}
+	for _, hub := range running {
+		select {
+		case <-hub.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Start or stop the idle timer depending on whether anybody is connected here
+func (h *Hub) checkIdle() {
+	h.Mutex.Lock()
+	idle := len(h.Clients) == 0 && len(h.pending) == 0
+	h.Mutex.Unlock()
+
+	if !idle {
+		if h.idle != nil {
+			h.idle.Stop()
+			h.idle = nil
+		}
+		return
+	}
+	if h.idle == nil {
+		h.idle = time.NewTimer(config.AppConfig.HubIdleTimeout)
+	}
+}
+
+// idleTimeout -> fires when the hub had no clients for the idle period
+func (h *Hub) idleTimeout() <-chan time.Time {
+	if h.idle == nil {
+		return nil
+	}
+	return h.idle.C
+}
+
+// Remove the hub from the registry, save its document and disconnect
+// everybody. Clients and handlers waiting on the hub see Done and move on.
+func (h *Hub) shutdown() {
+	hubMutex.Lock()
+	if hubs[h.RoomId] == h {
+		delete(hubs, h.RoomId)
+	}
+	hubMutex.Unlock()
+
+	h.flush()
+
+	h.Mutex.Lock()
+	for client := range h.Clients {
+		close(client.send)
+		delete(h.Clients, client)
+	}
+	h.pending = make(map[string]*Client)
+	h.Mutex.Unlock()
+
+	if h.idle != nil {
+		h.idle.Stop()
+	}
+	if h.sync != nil {
+		h.sync.timer.Stop()
+	}
+	if h.autosave != nil {
+		h.autosave.Stop()
+	}
+	if h.heartbeat != nil {
+		h.heartbeat.Stop()
+	}
+	h.revocations.Stop()
+	h.subscription.Close()
+	if h.recorder != nil {
+		h.recorder.close()
+	}
+	close(h.done)
+	log.Printf("Hub stopped for room %s", h.RoomId)
+}
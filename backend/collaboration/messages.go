@@ -12,14 +12,77 @@ const (
 	MessageTypeChat MessageType = "chat"
 	// Room closed
 	MessageTypeRoomClosed MessageType = "room_closed"
+	// Acknowledges an edit to its sender with the new revision and the edit's sequence number
+	MessageTypeAck MessageType = "ack"
+	// Full document, sent when a client has to resynchronise
+	MessageTypeSnapshot MessageType = "snapshot"
+	// CRDT items and deletes exchanged between peers
+	MessageTypeCRDTUpdate MessageType = "crdt_update"
+	// CRDT state vector, answered with the updates the sender is missing
+	MessageTypeCRDTSync MessageType = "crdt_sync"
+	// Cursor position of a user
+	MessageTypeCursor MessageType = "cursor"
+	// Selection range of a user
+	MessageTypeSelection MessageType = "selection"
+	// A user connected to the room
+	MessageTypePresenceJoin MessageType = "presence_join"
+	// A user left the room
+	MessageTypePresenceLeave MessageType = "presence_leave"
+	// Everybody currently in the room, sent to new clients
+	MessageTypePresenceSnapshot MessageType = "presence_snapshot"
+	// The server is going down, clients should reconnect shortly
+	MessageTypeServerRestarting MessageType = "server_restarting"
+	// Edit of a workspace file other than the main file
+	MessageTypeFileEdit MessageType = "file_edit"
+	// A file or folder was added to the workspace
+	MessageTypeFileCreated MessageType = "file_created"
+	// A file or folder was renamed or moved
+	MessageTypeFileMoved MessageType = "file_moved"
+	// A file or folder was deleted
+	MessageTypeFileDeleted MessageType = "file_deleted"
+	// Playback state, or a pause, resume or speed change sent by a viewer
+	MessageTypePlayback MessageType = "playback"
 )
 
 // Message to be sent over WebSocket
 type Message struct {
-	Type       MessageType `json:"type"`
-	SenderID   string      `json:"sender_id"`
-	SenderName string      `json:"sender_name"`
-	Content    string      `json:"content"` // mesage content or edit delta
-	Timestamp  time.Time   `json:"timestamp"`
-	RoomID     string      `json:"room_id"`
+	Type         MessageType   `json:"type"`
+	SenderID     string        `json:"sender_id"`
+	SenderName   string        `json:"sender_name"`
+	Content      string        `json:"content"` // mesage content or edit delta
+	Timestamp    time.Time     `json:"timestamp"`
+	RoomID       string        `json:"room_id"`
+	Seq          int64         `json:"seq,omitempty"`          // per-room sequence number of broadcast messages
+	Epoch        string        `json:"epoch,omitempty"`        // history the sequence numbers belong to, sent with snapshots
+	ClientID     string        `json:"client_id,omitempty"`    // connection of the sender, or of the recipient on snapshots
+	Revision     int           `json:"revision,omitempty"`     // document revision an edit is based on or produced
+	Ops          Operation     `json:"ops,omitempty"`          // edit operation, replaces Content for edits
+	Update       *CRDTUpdate   `json:"update,omitempty"`       // CRDT update
+	StateVector  StateVector   `json:"state_vector,omitempty"` // CRDT state vector
+	Cursor       *Position     `json:"cursor,omitempty"`       // cursor position
+	Selection    *Selection    `json:"selection,omitempty"`    // selection range
+	Color        string        `json:"color,omitempty"`        // stable color of the sender
+	Participants []Participant `json:"participants,omitempty"` // users present in the room
+	Path         string        `json:"path,omitempty"`         // workspace file of an edit, CRDT message or cursor, empty for the main file
+	NewPath      string        `json:"new_path,omitempty"`     // destination of a moved file
+	Files        []FileState   `json:"files,omitempty"`        // workspace files of a snapshot or created file
+	Speed        float64       `json:"speed,omitempty"`        // playback speed
+
+	// Connection key of the local client the message was read from
+	sender string
+	// Connection the message came from, nil for server generated messages
+	from *member
+	// Instance that published the message to the backplane
+	origin string
+}
+
+// FileState is the content of a workspace file as sent to clients
+type FileState struct {
+	Path        string      `json:"path"`
+	Folder      bool        `json:"folder,omitempty"`
+	Main        bool        `json:"main,omitempty"`
+	Content     string      `json:"content,omitempty"`
+	Revision    int         `json:"revision,omitempty"`
+	Update      *CRDTUpdate `json:"update,omitempty"` // CRDT state of the file
+	StateVector StateVector `json:"state_vector,omitempty"`
 }
@@ -0,0 +1,306 @@
+package collaboration
+
+import (
+	"errors"
+	"strings"
+)
+
+// Maximum number of applied operations kept per document for transforming
+// edits made against an older revision
+const maxHistory = 1000
+
+var (
+	ErrInvalidOperation   = errors.New("invalid operation")
+	ErrLengthMismatch     = errors.New("operation length does not match the document")
+	ErrRevisionOutOfRange = errors.New("revision is not available for transformation")
+)
+
+// Op is one component of an Operation. Exactly one of the fields is set:
+// Retain skips characters, Insert adds text and Delete removes characters.
+// All lengths are counted in Unicode code points.
+type Op struct {
+	Retain int    `json:"retain,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Delete int    `json:"delete,omitempty"`
+}
+
+// Operation is a sequence of components spanning the whole document
+type Operation []Op
+
+func (o Op) isRetain() bool { return o.Retain > 0 }
+func (o Op) isInsert() bool { return o.Insert != "" }
+func (o Op) isDelete() bool { return o.Delete > 0 }
+
+// Validate checks that every component sets exactly one field
+func (o Operation) Validate() error {
+	for _, op := range o {
+		set := 0
+		if op.isRetain() {
+			set++
+		}
+		if op.isInsert() {
+			set++
+		}
+		if op.isDelete() {
+			set++
+		}
+		if set != 1 || op.Retain < 0 || op.Delete < 0 {
+			return ErrInvalidOperation
+		}
+	}
+	return nil
+}
+
+// BaseLen -> length of the document the operation applies to
+func (o Operation) BaseLen() int {
+	n := 0
+	for _, op := range o {
+		n += op.Retain + op.Delete
+	}
+	return n
+}
+
+// TargetLen -> length of the document after the operation is applied
+func (o Operation) TargetLen() int {
+	n := 0
+	for _, op := range o {
+		n += op.Retain + len([]rune(op.Insert))
+	}
+	return n
+}
+
+func (o *Operation) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	ops := *o
+	if l := len(ops); l > 0 && ops[l-1].isRetain() {
+		ops[l-1].Retain += n
+	} else {
+		ops = append(ops, Op{Retain: n})
+	}
+	*o = ops
+}
+
+func (o *Operation) insert(s string) {
+	if s == "" {
+		return
+	}
+	ops := *o
+	l := len(ops)
+	switch {
+	case l > 0 && ops[l-1].isInsert():
+		ops[l-1].Insert += s
+	case l > 0 && ops[l-1].isDelete():
+		// Keep inserts before deletes so equivalent operations look the same
+		if l > 1 && ops[l-2].isInsert() {
+			ops[l-2].Insert += s
+		} else {
+			ops = append(ops, ops[l-1])
+			ops[l-1] = Op{Insert: s}
+		}
+	default:
+		ops = append(ops, Op{Insert: s})
+	}
+	*o = ops
+}
+
+func (o *Operation) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	ops := *o
+	if l := len(ops); l > 0 && ops[l-1].isDelete() {
+		ops[l-1].Delete += n
+	} else {
+		ops = append(ops, Op{Delete: n})
+	}
+	*o = ops
+}
+
+// Apply the operation to text and return the result
+func (o Operation) Apply(text string) (string, error) {
+	src := []rune(text)
+	if o.BaseLen() != len(src) {
+		return "", ErrLengthMismatch
+	}
+
+	var b strings.Builder
+	pos := 0
+	for _, op := range o {
+		switch {
+		case op.isRetain():
+			b.WriteString(string(src[pos : pos+op.Retain]))
+			pos += op.Retain
+		case op.isInsert():
+			b.WriteString(op.Insert)
+		case op.isDelete():
+			pos += op.Delete
+		}
+	}
+	return b.String(), nil
+}
+
+// Transform two operations made against the same document. It returns
+// a' and b' such that applying a then b' gives the same result as
+// applying b then a'. Inserts from a win ties at the same position.
+func Transform(a, b Operation) (Operation, Operation, error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, ErrLengthMismatch
+	}
+
+	var aPrime, bPrime Operation
+	i, j := 0, 0
+	var opA, opB Op
+	hasA, hasB := false, false
+	next := func(ops Operation, idx *int) (Op, bool) {
+		if *idx >= len(ops) {
+			return Op{}, false
+		}
+		op := ops[*idx]
+		*idx++
+		return op, true
+	}
+	opA, hasA = next(a, &i)
+	opB, hasB = next(b, &j)
+
+	for hasA || hasB {
+		if hasA && opA.isInsert() {
+			aPrime.insert(opA.Insert)
+			bPrime.retain(len([]rune(opA.Insert)))
+			opA, hasA = next(a, &i)
+			continue
+		}
+		if hasB && opB.isInsert() {
+			aPrime.retain(len([]rune(opB.Insert)))
+			bPrime.insert(opB.Insert)
+			opB, hasB = next(b, &j)
+			continue
+		}
+		if !hasA || !hasB {
+			return nil, nil, ErrLengthMismatch
+		}
+
+		lenA := opA.Retain + opA.Delete
+		lenB := opB.Retain + opB.Delete
+		n := min(lenA, lenB)
+
+		switch {
+		case opA.isRetain() && opB.isRetain():
+			aPrime.retain(n)
+			bPrime.retain(n)
+		case opA.isDelete() && opB.isRetain():
+			aPrime.delete(n)
+		case opA.isRetain() && opB.isDelete():
+			bPrime.delete(n)
+		}
+		// Both deleting the same range leaves nothing to do for either side
+
+		if lenA == n {
+			opA, hasA = next(a, &i)
+		} else {
+			opA = shorten(opA, n)
+		}
+		if lenB == n {
+			opB, hasB = next(b, &j)
+		} else {
+			opB = shorten(opB, n)
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+func shorten(op Op, n int) Op {
+	if op.isRetain() {
+		op.Retain -= n
+	} else {
+		op.Delete -= n
+	}
+	return op
+}
+
+// ReplaceOperation builds an operation turning oldText into newText. It is
+// used for clients that still send the whole buffer instead of operations.
+func ReplaceOperation(oldText, newText string) Operation {
+	oldRunes, newRunes := []rune(oldText), []rune(newText)
+
+	prefix := 0
+	for prefix < len(oldRunes) && prefix < len(newRunes) && oldRunes[prefix] == newRunes[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldRunes)-prefix && suffix < len(newRunes)-prefix &&
+		oldRunes[len(oldRunes)-1-suffix] == newRunes[len(newRunes)-1-suffix] {
+		suffix++
+	}
+
+	var op Operation
+	op.retain(prefix)
+	op.insert(string(newRunes[prefix : len(newRunes)-suffix]))
+	op.delete(len(oldRunes) - prefix - suffix)
+	op.retain(suffix)
+	return op
+}
+
+// Document is the authoritative text of a room together with the
+// operations applied to it since the oldest revision still transformable
+type Document struct {
+	text         string
+	revision     int
+	history      []Operation
+	historyStart int
+}
+
+// Create a new document at the given revision
+func NewDocument(text string, revision int) *Document {
+	return &Document{
+		text:         text,
+		revision:     revision,
+		historyStart: revision,
+	}
+}
+
+// Text -> current content of the document
+func (d *Document) Text() string {
+	return d.text
+}
+
+// Revision -> number of operations applied to the document
+func (d *Document) Revision() int {
+	return d.revision
+}
+
+// Apply an operation made against the given revision. The operation is
+// transformed against everything applied since, and the transformed
+// operation that was actually applied is returned.
+func (d *Document) Apply(revision int, op Operation) (Operation, error) {
+	if err := op.Validate(); err != nil {
+		return nil, err
+	}
+	if revision < d.historyStart || revision > d.revision {
+		return nil, ErrRevisionOutOfRange
+	}
+
+	for _, concurrent := range d.history[revision-d.historyStart:] {
+		var err error
+		op, _, err = Transform(op, concurrent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	text, err := op.Apply(d.text)
+	if err != nil {
+		return nil, err
+	}
+
+	d.text = text
+	d.revision++
+	d.history = append(d.history, op)
+	if len(d.history) > maxHistory {
+		d.history = d.history[1:]
+		d.historyStart++
+	}
+	return op, nil
+}
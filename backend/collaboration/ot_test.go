@@ -0,0 +1,121 @@
+package collaboration
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// randomOperation -> random edit spanning a document of length n
+func randomOperation(rng *rand.Rand, n int) Operation {
+	var op Operation
+	for n > 0 {
+		k := 1 + rng.Intn(n)
+		switch rng.Intn(3) {
+		case 0:
+			op.retain(k)
+		case 1:
+			op.delete(k)
+		default:
+			op.insert(string([]rune("aé😀z")[rng.Intn(4)]))
+			continue
+		}
+		n -= k
+	}
+	if rng.Intn(2) == 0 {
+		op.insert("end")
+	}
+	return op
+}
+
+func apply(t *testing.T, text string, op Operation) string {
+	t.Helper()
+	out, err := op.Apply(text)
+	if err != nil {
+		t.Fatalf("apply %+v to %q: %v", op, text, err)
+	}
+	return out
+}
+
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 2000; round++ {
+		doc := string([]rune("héllo wörld")[:rng.Intn(12)])
+		n := len([]rune(doc))
+		a, b := randomOperation(rng, n), randomOperation(rng, n)
+
+		aPrime, bPrime, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("transform %+v and %+v: %v", a, b, err)
+		}
+		viaA := apply(t, apply(t, doc, a), bPrime)
+		viaB := apply(t, apply(t, doc, b), aPrime)
+		if viaA != viaB {
+			t.Fatalf("%q with %+v and %+v: %q != %q", doc, a, b, viaA, viaB)
+		}
+	}
+}
+
+func TestTransformTies(t *testing.T) {
+	a := Operation{{Retain: 1}, {Insert: "A"}, {Retain: 1}}
+	b := Operation{{Retain: 1}, {Insert: "B"}, {Retain: 1}}
+	aPrime, bPrime, err := Transform(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := apply(t, apply(t, "xy", a), bPrime); got != "xABy" {
+		t.Fatalf("inserts at the same position merged to %q, want a's first", got)
+	}
+	if got := apply(t, apply(t, "xy", b), aPrime); got != "xABy" {
+		t.Fatalf("inserts at the same position merged to %q, want a's first", got)
+	}
+
+	// Deleting the same text twice deletes it once
+	del := Operation{{Delete: 2}, {Retain: 1}}
+	_, delPrime, err := Transform(del, del)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := apply(t, apply(t, "abc", del), delPrime); got != "c" {
+		t.Fatalf("overlapping deletes gave %q", got)
+	}
+
+	if _, _, err := Transform(Operation{{Retain: 1}}, Operation{{Retain: 2}}); err != ErrLengthMismatch {
+		t.Fatalf("error = %v, want ErrLengthMismatch", err)
+	}
+}
+
+func TestDocumentAppliesConcurrentEdits(t *testing.T) {
+	d := NewDocument("abc", 0)
+	// Two clients edit revision 0 without seeing each other
+	if _, err := d.Apply(0, Operation{{Insert: ">"}, {Retain: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := d.Apply(0, Operation{{Retain: 2}, {Delete: 1}, {Insert: "C"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Text() != ">abC" || d.Revision() != 2 {
+		t.Fatalf("text %q at revision %d", d.Text(), d.Revision())
+	}
+	if applied.BaseLen() != 4 {
+		t.Fatalf("applied %+v, want it transformed past the insert", applied)
+	}
+	if _, err := d.Apply(3, Operation{{Retain: 4}}); err != ErrRevisionOutOfRange {
+		t.Fatalf("error = %v, want ErrRevisionOutOfRange", err)
+	}
+}
+
+func TestReplaceOperation(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	texts := []string{"", "a", "hello", "hello world", "héllo wörld", "wörld", "😀😀"}
+	for round := 0; round < 200; round++ {
+		from, to := texts[rng.Intn(len(texts))], texts[rng.Intn(len(texts))]
+		op := ReplaceOperation(from, to)
+		if err := op.Validate(); err != nil {
+			t.Fatalf("%q -> %q: %+v invalid: %v", from, to, op, err)
+		}
+		if got := apply(t, from, op); got != to {
+			t.Fatalf("%q -> %q gave %q", from, to, got)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package collaboration
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/collaborative-coding-editor/middleware"
+	"example.com/collaborative-coding-editor/session"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Range of playback speeds, 1 replays in real time
+	minPlaybackSpeed = 0.1
+	maxPlaybackSpeed = 64
+	// Longest pause between two replayed events, idle stretches are skipped
+	maxPlaybackGap = 3 * time.Second
+)
+
+// Playback states sent to viewers
+const (
+	playbackPlaying  = "playing"
+	playbackPaused   = "paused"
+	playbackFinished = "finished"
+	playbackFailed   = "failed"
+)
+
+// player replays the recorded history of a room to one read-only viewer
+type player struct {
+	conn     *websocket.Conn
+	claims   jwt.MapClaims
+	playback *session.Playback
+	speed    float64
+	paused   bool
+	// Position in the playback in milliseconds
+	position int64
+	// Current content of every file so that edits also carry the full text
+	mainFile string
+	files    map[string]string
+	// Controls sent by the viewer, closed when the connection is gone
+	controls chan Message
+}
+
+// PlaybackHandler replays the history of a room over a WebSocket.
+// ?speed= sets the initial speed, ?from= and ?to= (RFC 3339) the time range.
+// The viewer can send playback messages with content "pause", "resume" or
+// "speed" and the new speed, anything else is ignored.
+func PlaybackHandler(w http.ResponseWriter, r *http.Request) {
+	claims, userID, _, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	roomID, ok := parseRoomID(w, mux.Vars(r)["room_id"])
+	if !ok {
+		return
+	}
+	// Closed rooms can still be replayed by their admin and participants
+	if !session.RequireAccess(w, roomID, userID, session.AccessRead) {
+		return
+	}
+
+	speed := 1.0
+	if s := r.URL.Query().Get("speed"); s != "" {
+		var err error
+		speed, err = strconv.ParseFloat(s, 64)
+		if err != nil || speed < minPlaybackSpeed || speed > maxPlaybackSpeed {
+			http.Error(w, "Invalid speed", http.StatusBadRequest)
+			return
+		}
+	}
+	from, to, err := session.PlaybackRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	playback, err := session.LoadPlayback(roomID, from, to)
+	if err != nil {
+		http.Error(w, "Error retrieving playback", http.StatusInternalServerError)
+		return
+	}
+	if playback == nil {
+		http.Error(w, "No playback recorded for this session", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	p := &player{
+		conn:     conn,
+		claims:   claims,
+		playback: playback,
+		speed:    speed,
+		files:    make(map[string]string),
+		controls: make(chan Message, 16),
+	}
+	go p.readControls()
+	p.run()
+	conn.Close()
+}
+
+// readControls passes the viewer's playback messages on until the connection closes
+func (p *player) readControls() {
+	defer close(p.controls)
+	p.conn.SetReadLimit(4096)
+	for {
+		var msg Message
+		if err := p.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type == MessageTypePlayback {
+			select {
+			case p.controls <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// run sends the events at their recorded pace until the playback ends or
+// the viewer goes away
+func (p *player) run() {
+	ping := time.NewTicker(54 * time.Second)
+	defer ping.Stop()
+	revocations := time.NewTicker(revocationCheckInterval)
+	defer revocations.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	if !p.status(playbackPlaying) {
+		return
+	}
+	for i := 0; i < len(p.playback.Events); {
+		event := p.playback.Events[i]
+		var wait time.Duration
+		waiting := !p.paused
+		if waiting {
+			wait = p.delay(event.Offset)
+			timer.Reset(wait)
+		}
+		started := time.Now()
+
+		select {
+		case <-p.timerC(timer, waiting):
+			p.position = event.Offset
+			msg, err := p.message(i)
+			if err != nil {
+				// Later edits build on this one, going on would show wrong text
+				log.Printf("Error replaying edit of %s in room %s: %v", event.Path, p.playback.RoomID, err)
+				p.fail("The recording is damaged and cannot be replayed further")
+				return
+			}
+			if !p.send(msg) {
+				return
+			}
+			i++
+
+		case msg, ok := <-p.controls:
+			if !ok {
+				return
+			}
+			p.interrupt(timer, event.Offset, started, wait)
+			if !p.control(msg) {
+				return
+			}
+
+		case <-revocations.C:
+			if middleware.Revoked(p.claims) {
+				p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				p.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Token revoked"))
+				return
+			}
+			p.interrupt(timer, event.Offset, started, wait)
+
+		case <-ping.C:
+			p.interrupt(timer, event.Offset, started, wait)
+			p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := p.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+	p.status(playbackFinished)
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	p.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// Stop waiting for the event at offset, keeping the part of the gap already waited
+func (p *player) interrupt(timer *time.Timer, offset int64, started time.Time, wait time.Duration) {
+	timer.Stop()
+	if p.paused || wait <= 0 {
+		return
+	}
+	elapsed := min(time.Since(started), wait)
+	p.position += int64(float64(offset-p.position) * float64(elapsed) / float64(wait))
+}
+
+// timerC -> channel of the timer, nil while paused
+func (p *player) timerC(timer *time.Timer, waiting bool) <-chan time.Time {
+	if !waiting {
+		return nil
+	}
+	return timer.C
+}
+
+// delay -> time to wait before the event at offset at the current speed
+func (p *player) delay(offset int64) time.Duration {
+	wait := time.Duration(float64(time.Duration(offset-p.position)*time.Millisecond) / p.speed)
+	return max(0, min(wait, maxPlaybackGap))
+}
+
+// Apply a control message from the viewer, false if the connection failed
+func (p *player) control(msg Message) bool {
+	switch msg.Content {
+	case "pause":
+		p.paused = true
+		return p.status(playbackPaused)
+	case "resume":
+		p.paused = false
+		return p.status(playbackPlaying)
+	case "speed":
+		if msg.Speed >= minPlaybackSpeed && msg.Speed <= maxPlaybackSpeed {
+			p.speed = msg.Speed
+		}
+		if p.paused {
+			return p.status(playbackPaused)
+		}
+		return p.status(playbackPlaying)
+	}
+	return true
+}
+
+// Tell the viewer the playback state, speed and position
+func (p *player) status(state string) bool {
+	return p.send(Message{
+		Type:      MessageTypePlayback,
+		Content:   state,
+		Speed:     p.speed,
+		RoomID:    p.playback.RoomID,
+		Timestamp: p.playback.Start.Add(time.Duration(p.position) * time.Millisecond),
+	})
+}
+
+// Tell the viewer the playback cannot go on and close the connection
+func (p *player) fail(reason string) {
+	p.send(Message{
+		Type:      MessageTypePlayback,
+		Content:   playbackFailed,
+		Speed:     p.speed,
+		RoomID:    p.playback.RoomID,
+		Timestamp: p.playback.Start.Add(time.Duration(p.position) * time.Millisecond),
+	})
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	p.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason))
+}
+
+// message -> the live message an event stands for, as the room's clients
+// received it at the time, or an error if an edit does not fit the text
+func (p *player) message(i int) (Message, error) {
+	event := p.playback.Events[i]
+	msg := Message{
+		SenderID:   event.User,
+		SenderName: p.playback.Users[event.User],
+		Timestamp:  p.playback.Start.Add(time.Duration(event.Offset) * time.Millisecond),
+		RoomID:     p.playback.RoomID,
+		Seq:        int64(i + 1),
+		Path:       event.Path,
+		NewPath:    event.NewPath,
+	}
+	switch event.Type {
+	case "snapshot":
+		p.mainFile = event.Path
+		p.files = make(map[string]string)
+		for _, f := range event.Files {
+			msg.Files = append(msg.Files, FileState{Path: f.Path, Folder: f.Folder, Main: f.Path == event.Path, Content: f.Content})
+			if !f.Folder {
+				p.files[f.Path] = f.Content
+			}
+		}
+		msg.Type = MessageTypeSnapshot
+		msg.Content = p.files[p.mainFile]
+
+	case "edit":
+		msg.Type = MessageTypeFileEdit
+		if event.Path == p.mainFile {
+			msg.Type = MessageTypeEdit
+		}
+		msg.Ops = operation(event.Ops)
+		text, err := msg.Ops.Apply(p.files[event.Path])
+		if err != nil {
+			return Message{}, err
+		}
+		p.files[event.Path] = text
+		msg.Content = text
+
+	case "file_created":
+		msg.Type = MessageTypeFileCreated
+		for _, f := range event.Files {
+			msg.Files = append(msg.Files, FileState{Path: f.Path, Folder: f.Folder, Content: f.Content})
+			if !f.Folder {
+				p.files[f.Path] = f.Content
+			}
+		}
+
+	case "file_moved":
+		msg.Type = MessageTypeFileMoved
+		for path, text := range p.files {
+			if under(path, event.Path) {
+				delete(p.files, path)
+				p.files[event.NewPath+strings.TrimPrefix(path, event.Path)] = text
+			}
+		}
+		if under(p.mainFile, event.Path) {
+			p.mainFile = event.NewPath + strings.TrimPrefix(p.mainFile, event.Path)
+		}
+
+	case "file_deleted":
+		msg.Type = MessageTypeFileDeleted
+		for path := range p.files {
+			if under(path, event.Path) && path != p.mainFile {
+				delete(p.files, path)
+			}
+		}
+
+	case "chat":
+		msg.Type = MessageTypeChat
+		msg.Content = event.Text
+	}
+	return msg, nil
+}
+
+// Write a message to the viewer, false if the connection failed
+func (p *player) send(msg Message) bool {
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := p.conn.WriteJSON(msg); err != nil {
+		log.Printf("Error writing JSON: %v", err)
+		return false
+	}
+	return true
+}
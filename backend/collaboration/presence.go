@@ -0,0 +1,227 @@
+package collaboration
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+const (
+	// How long to wait for another instance to tell the roster of a room
+	presenceRequestTimeout = time.Second
+	// How often a hub tells the other instances of the room it is alive
+	heartbeatInterval = 10 * time.Second
+	// Connections of an instance not heard of for this long are dropped
+	memberExpiry = 3 * heartbeatInterval
+)
+
+// Colors handed out to users for cursors and selections
+var presenceColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4",
+	"#42d4f4", "#f032e6", "#469990", "#9a6324", "#800000",
+}
+
+// Position in the editor as reported by the client
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Selection range in the editor
+type Selection struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Participant is a user connected to a room
+type Participant struct {
+	UserID      string `json:"user_id"`
+	UserName    string `json:"user_name"`
+	Color       string `json:"color"`
+	Connections int    `json:"connections"`
+}
+
+// member is a connection to the room on any instance
+type member struct {
+	instance string
+	key      string
+	clientID string
+	userID   string
+	userName string
+
+	// Latest cursor and selection messages
+	cursor    *Message
+	selection *Message
+}
+
+// Presence -> users currently connected to the room on any instance, one entry per user
+func (h *Hub) Presence() []Participant {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	byUser := make(map[string]*Participant)
+	for _, m := range h.members {
+		p, ok := byUser[m.userID]
+		if !ok {
+			p = &Participant{UserID: m.userID, UserName: m.userName, Color: colorFor(m.userID)}
+			byUser[m.userID] = p
+		}
+		p.Connections++
+	}
+
+	participants := make([]Participant, 0, len(byUser))
+	for _, p := range byUser {
+		participants = append(participants, *p)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		if participants[i].UserName != participants[j].UserName {
+			return participants[i].UserName < participants[j].UserName
+		}
+		return participants[i].UserID < participants[j].UserID
+	})
+	return participants
+}
+
+// RoomPresence -> users connected to a room on any instance. Without a hub
+// here the hubs of other instances are asked, a room nobody answers for
+// has nobody connected.
+func RoomPresence(roomID string) ([]Participant, error) {
+	if hub, ok := LookupHub(roomID); ok {
+		return hub.Presence(), nil
+	}
+	if !backplane.Distributed() {
+		return []Participant{}, nil
+	}
+
+	sub, err := backplane.Subscribe(roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	request := envelope{Kind: envelopePresenceRequest, Instance: newClientID(), Nonce: newClientID()}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := backplane.Publish(roomID, payload); err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(presenceRequestTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case payload := <-sub.Messages():
+			var env envelope
+			if payload == nil || json.Unmarshal(payload, &env) != nil {
+				continue
+			}
+			if env.Kind == envelopePresenceResponse && env.Target == request.Instance && env.Nonce == request.Nonce {
+				if env.Participants == nil {
+					env.Participants = []Participant{}
+				}
+				return env.Participants, nil
+			}
+		case <-timeout.C:
+			return []Participant{}, nil
+		}
+	}
+}
+
+// Tell an instance without a hub for the room who is connected
+func (h *Hub) answerPresence(env envelope) {
+	if h.sync != nil {
+		// The roster is not complete before the hand-over
+		return
+	}
+	h.publish(envelope{
+		Kind:         envelopePresenceResponse,
+		Nonce:        env.Nonce,
+		Target:       env.Instance,
+		Participants: h.Presence(),
+	})
+}
+
+// connections -> number of connections of a user on any instance
+func (h *Hub) connections(userID string) int {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	n := 0
+	for _, m := range h.members {
+		if m.userID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// presenceMessage builds a join or leave event for a connection
+func (h *Hub) presenceMessage(msgType MessageType, m *member, content string) Message {
+	return Message{
+		Type:       msgType,
+		SenderID:   m.userID,
+		SenderName: m.userName,
+		Content:    content,
+		Timestamp:  time.Now(),
+		RoomID:     h.RoomId,
+		Color:      colorFor(m.userID),
+		from:       m,
+	}
+}
+
+// colorFor -> stable color for a user, the same on every connection
+func colorFor(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return presenceColors[h.Sum32()%uint32(len(presenceColors))]
+}
+
+// Send heartbeats when other instances may share the room
+func (h *Hub) startHeartbeat() {
+	if h.backplane.Distributed() {
+		h.heartbeat = time.NewTicker(heartbeatInterval)
+	}
+}
+
+// heartbeatC -> ticks when the hub should send its heartbeat, nil without one
+func (h *Hub) heartbeatC() <-chan time.Time {
+	if h.heartbeat == nil {
+		return nil
+	}
+	return h.heartbeat.C
+}
+
+// Remove the connections of instances that went away without leaving the
+// room, e.g. because they crashed. The leaves are published so that every
+// hub drops them at the same point of the stream.
+func (h *Hub) expireMembers() {
+	now := time.Now()
+	var expired []string
+	h.Mutex.Lock()
+	for key, m := range h.members {
+		if m.instance == h.instance {
+			continue
+		}
+		seen, ok := h.seen[m.instance]
+		if !ok {
+			// Known from a state hand-over, give it time to send a heartbeat
+			h.seen[m.instance] = now
+			continue
+		}
+		if now.Sub(seen) > memberExpiry {
+			expired = append(expired, key)
+		}
+	}
+	h.Mutex.Unlock()
+
+	for instance, seen := range h.seen {
+		if now.Sub(seen) > memberExpiry {
+			delete(h.seen, instance)
+		}
+	}
+	for _, key := range expired {
+		h.publish(envelope{Kind: envelopeLeave, ClientKey: key})
+	}
+}
@@ -0,0 +1,86 @@
+package collaboration
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// useBackplane replaces the backplane of new hubs for a test
+func useBackplane(t *testing.T, b Backplane) {
+	t.Helper()
+	prev := backplane
+	backplane = b
+	t.Cleanup(func() { backplane = prev })
+}
+
+func TestRoomPresenceWithoutHubs(t *testing.T) {
+	useBackplane(t, NewLocalBackplane())
+	participants, err := RoomPresence("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if participants == nil || len(participants) != 0 {
+		t.Fatalf("participants = %#v, want an empty list", participants)
+	}
+}
+
+func TestRoomPresenceAsksOtherInstances(t *testing.T) {
+	f := newFakeRedis(t)
+	b, err := NewRedisBackplane(f.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	useBackplane(t, b)
+
+	// A hub of the room on another instance
+	other, err := NewRedisBackplane(f.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Hub{
+		RoomId:    "room",
+		instance:  "other",
+		backplane: other,
+		members: map[string]*member{
+			"a1": {instance: "other", key: "a1", userID: "ada", userName: "Ada"},
+			"a2": {instance: "third", key: "a2", userID: "ada", userName: "Ada"},
+			"b1": {instance: "other", key: "b1", userID: "bob", userName: "Bob"},
+		},
+	}
+	sub, err := other.Subscribe("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	go func() {
+		for payload := range sub.Messages() {
+			var env envelope
+			if json.Unmarshal(payload, &env) == nil && env.Kind == envelopePresenceRequest {
+				h.answerPresence(env)
+			}
+		}
+	}()
+
+	participants, err := RoomPresence("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(participants) != 2 {
+		t.Fatalf("participants = %+v, want Ada and Bob", participants)
+	}
+	if p := participants[0]; p.UserID != "ada" || p.Connections != 2 || p.Color != colorFor("ada") {
+		t.Fatalf("first participant = %+v", p)
+	}
+	if p := participants[1]; p.UserID != "bob" || p.Connections != 1 {
+		t.Fatalf("second participant = %+v", p)
+	}
+
+	// Nobody answers for a room that is not live anywhere
+	participants, err = RoomPresence("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(participants) != 0 {
+		t.Fatalf("participants = %+v, want none", participants)
+	}
+}
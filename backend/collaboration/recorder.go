@@ -0,0 +1,187 @@
+package collaboration
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Events are written in batches of at most this many
+	recordBatchSize = 100
+	// Longest time an event waits before it is written
+	recordInterval = time.Second
+	// Events waiting to be written, further events are dropped
+	recordBuffer = 4096
+)
+
+// recorder writes the playback events of a room to the database in the
+// background so that recording never holds up the hub
+type recorder struct {
+	roomID primitive.ObjectID
+	events chan models.PlaybackEvent
+	done   chan struct{}
+}
+
+// Start a recorder for a room, nil if the room id is not an ObjectID
+func newRecorder(roomID string) *recorder {
+	id, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return nil
+	}
+	r := &recorder{
+		roomID: id,
+		events: make(chan models.PlaybackEvent, recordBuffer),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Queue an event for writing
+func (r *recorder) add(event models.PlaybackEvent) {
+	event.RoomID = r.roomID
+	select {
+	case r.events <- event:
+	default:
+		log.Printf("Playback buffer full for room %s, dropping %s event", r.roomID.Hex(), event.Type)
+	}
+}
+
+// Write the queued events and stop
+func (r *recorder) close() {
+	close(r.events)
+	<-r.done
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(recordInterval)
+	defer ticker.Stop()
+
+	var batch []interface{}
+	for {
+		select {
+		case event, ok := <-r.events:
+			if !ok {
+				r.write(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= recordBatchSize {
+				r.write(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			r.write(batch)
+			batch = nil
+		}
+	}
+}
+
+func (r *recorder) write(batch []interface{}) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := auth.GetCollection("playback_events").InsertMany(ctx, batch); err != nil {
+		log.Printf("Error saving playback events for room %s: %v", r.roomID.Hex(), err)
+	}
+}
+
+// recording -> true if the hub records the message. Every hub of a room
+// applies it, only the one on the instance that published it records it.
+func (h *Hub) recording(message Message) bool {
+	return message.origin != "" && message.origin == h.instance
+}
+
+// Start recording before the first change this hub records is applied,
+// with a snapshot of the workspace as it was
+func (h *Hub) startRecording(message Message) {
+	if h.recorder != nil || !h.recording(message) {
+		return
+	}
+	if h.recorder = newRecorder(h.RoomId); h.recorder != nil {
+		h.recordSnapshot("", "")
+	}
+}
+
+// Queue a playback event. Events are stamped when the hub applied them,
+// which is the order their operations have to be replayed in.
+func (h *Hub) record(event models.PlaybackEvent) {
+	if h.recorder == nil {
+		return
+	}
+	event.Seq = h.seq
+	event.Timestamp = time.Now()
+	h.recorder.add(event)
+}
+
+// Record the whole workspace, playback can start from any snapshot
+func (h *Hub) recordSnapshot(userID, userName string) {
+	event := models.PlaybackEvent{
+		Type:     "snapshot",
+		Path:     h.mainFile,
+		UserID:   userID,
+		UserName: userName,
+	}
+	for _, state := range h.fileStates(true) {
+		event.Files = append(event.Files, models.WorkspaceFile{Path: state.Path, Folder: state.Folder, Content: state.Content})
+	}
+	h.record(event)
+}
+
+// Record an edit of a file as an operation on its previous content
+func (h *Hub) recordEdit(message Message, path string, op Operation) {
+	if !h.recording(message) {
+		return
+	}
+	h.record(models.PlaybackEvent{
+		Type:     "edit",
+		Path:     path,
+		Ops:      textOps(op),
+		UserID:   message.SenderID,
+		UserName: message.SenderName,
+	})
+}
+
+// Record a file tree change
+func (h *Hub) recordWorkspace(message Message) {
+	if !h.recording(message) {
+		return
+	}
+	event := models.PlaybackEvent{
+		Type:     string(message.Type),
+		Path:     message.Path,
+		NewPath:  message.NewPath,
+		UserID:   message.SenderID,
+		UserName: message.SenderName,
+	}
+	for _, f := range message.Files {
+		event.Files = append(event.Files, models.WorkspaceFile{Path: f.Path, Folder: f.Folder, Content: f.Content})
+	}
+	h.record(event)
+}
+
+// textOps -> stored form of an operation
+func textOps(op Operation) []models.TextOp {
+	ops := make([]models.TextOp, len(op))
+	for i, o := range op {
+		ops[i] = models.TextOp{Retain: o.Retain, Insert: o.Insert, Delete: o.Delete}
+	}
+	return ops
+}
+
+// operation -> operation of a stored edit
+func operation(ops []models.TextOp) Operation {
+	op := make(Operation, len(ops))
+	for i, o := range ops {
+		op[i] = Op{Retain: o.Retain, Insert: o.Insert, Delete: o.Delete}
+	}
+	return op
+}
@@ -0,0 +1,58 @@
+package collaboration
+
+// replayEntry is a broadcast message kept for clients that reconnect
+type replayEntry struct {
+	message Message
+	// Connection the message was not delivered to, usually its sender
+	exclude string
+}
+
+// replayBuffer is a bounded ring of the most recent broadcast messages
+type replayBuffer struct {
+	entries []replayEntry
+	next    int
+	full    bool
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{entries: make([]replayEntry, size)}
+}
+
+// add a message, overwriting the oldest one once the buffer is full
+func (b *replayBuffer) add(entry replayEntry) {
+	if len(b.entries) == 0 {
+		return
+	}
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// since returns the messages after seq in order. It reports false when
+// messages after seq were already overwritten or seq is unknown.
+func (b *replayBuffer) since(seq, current int64) ([]replayEntry, bool) {
+	if seq > current {
+		return nil, false
+	}
+	if seq == current {
+		return nil, true
+	}
+
+	var ordered []replayEntry
+	if b.full {
+		ordered = append(ordered, b.entries[b.next:]...)
+	}
+	ordered = append(ordered, b.entries[:b.next]...)
+	if len(ordered) == 0 || ordered[0].message.Seq > seq+1 {
+		return nil, false
+	}
+
+	for i, entry := range ordered {
+		if entry.message.Seq > seq {
+			return ordered[i:], true
+		}
+	}
+	return nil, true
+}
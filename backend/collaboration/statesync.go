@@ -0,0 +1,200 @@
+package collaboration
+
+import (
+	"log"
+	"time"
+)
+
+// How long a new hub waits for another instance to hand over the room state
+const stateSyncTimeout = 2 * time.Second
+
+// hubState is the replicated state of a room handed to a hub that
+// joins late or lost messages on the backplane
+type hubState struct {
+	MainFile string        `json:"main_file"`
+	Files    []FileState   `json:"files"`
+	Seq      int64         `json:"seq"`
+	Epoch    string        `json:"epoch"`
+	Saved    int64         `json:"saved"`
+	Members  []memberState `json:"members"`
+}
+
+type memberState struct {
+	Instance  string   `json:"instance"`
+	ClientKey string   `json:"client_key"`
+	ClientID  string   `json:"client_id"`
+	UserID    string   `json:"user_id"`
+	UserName  string   `json:"user_name"`
+	Cursor    *Message `json:"cursor,omitempty"`
+	Selection *Message `json:"selection,omitempty"`
+}
+
+// stateSync tracks a pending hand-over. The hub publishes a request and
+// holds back everything after it on the stream; the first answer holds
+// the state exactly as of the request, so replaying what was held back on
+// top of it gives the same state as on every other instance.
+type stateSync struct {
+	nonce     string
+	requested bool
+	held      []envelope
+	timer     *time.Timer
+}
+
+// Ask the other instances for the room state
+func (h *Hub) startSync() {
+	if !h.backplane.Distributed() {
+		return
+	}
+	if h.sync != nil {
+		h.sync.timer.Stop()
+	}
+	h.sync = &stateSync{nonce: newClientID(), timer: time.NewTimer(stateSyncTimeout)}
+	h.publish(envelope{Kind: envelopeStateRequest, Nonce: h.sync.nonce})
+}
+
+// syncTimeout -> fires when nobody answered the state request in time
+func (h *Hub) syncTimeout() <-chan time.Time {
+	if h.sync == nil {
+		return nil
+	}
+	return h.sync.timer.C
+}
+
+// holdForSync reports whether the envelope was consumed by the pending hand-over
+func (h *Hub) holdForSync(env envelope) bool {
+	s := h.sync
+	switch {
+	case env.Kind == envelopeStateRequest && env.Instance == h.instance:
+		if env.Nonce == s.nonce {
+			s.requested = true
+		}
+		return true
+	case env.Kind == envelopeStateResponse:
+		if s.requested && env.Target == h.instance && env.Nonce == s.nonce && env.State != nil {
+			h.finishSync(env.State)
+		}
+		return true
+	case !s.requested:
+		// Still before our request on the stream, the answer will include it
+		return false
+	case env.Kind == envelopeStateRequest:
+		// Only hubs in sync answer, and only at the position of the request
+		return true
+	}
+	s.held = append(s.held, env)
+	return true
+}
+
+// finishSync adopts the handed over state, if any, and applies what was held back
+func (h *Hub) finishSync(state *hubState) {
+	s := h.sync
+	if s == nil {
+		return
+	}
+	s.timer.Stop()
+	h.sync = nil
+
+	// Clients connected before the hand-over may have seen a different document
+	h.Mutex.Lock()
+	stale := make([]*Client, 0, len(h.Clients))
+	for client := range h.Clients {
+		stale = append(stale, client)
+	}
+	h.Mutex.Unlock()
+
+	if state != nil {
+		h.importState(state)
+	} else {
+		log.Printf("No state hand-over for room %s, continuing with the saved session", h.RoomId)
+		stale = nil
+	}
+	for _, client := range stale {
+		snapshot := h.snapshot()
+		snapshot.ClientID = client.id
+		h.send(client, snapshot)
+	}
+	for _, env := range s.held {
+		h.receive(env)
+	}
+}
+
+// Answer another hub's state request with the state at this point of the stream
+func (h *Hub) answerSync(env envelope) {
+	if env.Instance == h.instance {
+		return
+	}
+	h.publish(envelope{
+		Kind:   envelopeStateResponse,
+		Nonce:  env.Nonce,
+		Target: env.Instance,
+		State:  h.exportState(),
+	})
+}
+
+func (h *Hub) exportState() *hubState {
+	state := &hubState{
+		MainFile: h.mainFile,
+		Files:    h.fileStates(true),
+		Seq:      h.seq,
+		Epoch:    h.epoch,
+		Saved:    h.saved,
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	for _, m := range h.members {
+		state.Members = append(state.Members, memberState{
+			Instance:  m.instance,
+			ClientKey: m.key,
+			ClientID:  m.clientID,
+			UserID:    m.userID,
+			UserName:  m.userName,
+			Cursor:    m.cursor,
+			Selection: m.selection,
+		})
+	}
+	return state
+}
+
+func (h *Hub) importState(state *hubState) {
+	h.mainFile = state.MainFile
+	h.files = make(map[string]*fileState)
+	h.folders = make(map[string]bool)
+	for _, fs := range state.Files {
+		if fs.Folder {
+			h.folders[fs.Path] = true
+			continue
+		}
+		f := &fileState{document: NewDocument(fs.Content, fs.Revision)}
+		if h.useCRDT {
+			f.crdt = NewCRDTDocument()
+			if fs.Update != nil {
+				f.crdt.Apply(*fs.Update)
+			}
+		}
+		h.files[fs.Path] = f
+	}
+	if h.files[h.mainFile] == nil {
+		h.files[h.mainFile] = h.newFile("")
+	}
+	h.seq = state.Seq
+	h.epoch = state.Epoch
+	h.saved = state.Saved
+	// Sequence numbers before the hand-over were not ours to replay
+	h.replay = newReplayBuffer(len(h.replay.entries))
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	h.members = make(map[string]*member, len(state.Members))
+	for _, ms := range state.Members {
+		h.members[ms.ClientKey] = &member{
+			instance:  ms.Instance,
+			key:       ms.ClientKey,
+			clientID:  ms.ClientID,
+			userID:    ms.UserID,
+			userName:  ms.UserName,
+			cursor:    ms.Cursor,
+			selection: ms.Selection,
+		}
+	}
+}
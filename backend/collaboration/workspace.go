@@ -0,0 +1,306 @@
+package collaboration
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/collaborative-coding-editor/models"
+	"example.com/collaborative-coding-editor/session"
+)
+
+// fileState is the live document of one workspace file
+type fileState struct {
+	document *Document
+	crdt     *CRDTDocument
+}
+
+// Create the live document of a file with the given content
+func (h *Hub) newFile(text string) *fileState {
+	f := &fileState{document: NewDocument(text, 0)}
+	if h.useCRDT {
+		f.crdt = NewCRDTDocument()
+		if text != "" {
+			if _, err := f.crdt.ApplyOperation(crdtServerSite, Operation{{Insert: text}}); err != nil {
+				log.Printf("Error seeding CRDT for room %s: %v", h.RoomId, err)
+			}
+		}
+	}
+	return f
+}
+
+// Text -> current content of the file for the room's merge strategy
+func (f *fileState) text() string {
+	if f.crdt != nil {
+		return f.crdt.Text()
+	}
+	return f.document.Text()
+}
+
+// resolve -> workspace path of a message path, "" being the main file
+func (h *Hub) resolve(path string) string {
+	if path == "" {
+		return h.mainFile
+	}
+	return path
+}
+
+// file -> live document of a workspace file, nil if there is no such file
+func (h *Hub) file(path string) *fileState {
+	return h.files[h.resolve(path)]
+}
+
+// editType -> message type of edits to a file, plain edits for the main
+// file so that clients unaware of workspaces keep working
+func (h *Hub) editType(path string) MessageType {
+	if path == h.mainFile {
+		return MessageTypeEdit
+	}
+	return MessageTypeFileEdit
+}
+
+// Replace the workspace with the files of a saved session
+func (h *Hub) loadWorkspace(mainFile, code string, files []models.WorkspaceFile) {
+	h.mainFile = mainFile
+	h.files = map[string]*fileState{mainFile: h.newFile(code)}
+	h.folders = make(map[string]bool)
+	for _, f := range files {
+		if f.Folder {
+			h.folders[f.Path] = true
+		} else {
+			h.files[f.Path] = h.newFile(f.Content)
+		}
+	}
+}
+
+// fileStates -> every file and folder of the workspace sorted by path,
+// with content and CRDT state if asked for
+func (h *Hub) fileStates(content bool) []FileState {
+	states := make([]FileState, 0, len(h.files)+len(h.folders))
+	for folder := range h.folders {
+		states = append(states, FileState{Path: folder, Folder: true})
+	}
+	for path, f := range h.files {
+		state := FileState{Path: path, Main: path == h.mainFile, Revision: f.document.Revision()}
+		if content {
+			state.Content = f.text()
+			if f.crdt != nil {
+				update := f.crdt.Missing(nil)
+				state.Update = &update
+				state.StateVector = f.crdt.StateVector()
+			}
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Path < states[j].Path })
+	return states
+}
+
+// contents -> current text of every workspace file by path
+func (h *Hub) contents() map[string]string {
+	contents := make(map[string]string, len(h.files))
+	for path, f := range h.files {
+		contents[path] = f.text()
+	}
+	return contents
+}
+
+// pendingContentRequests -> requests for the file contents, held back until
+// the hub took over the state of the other instances
+func (h *Hub) pendingContentRequests() <-chan chan map[string]string {
+	if h.sync != nil {
+		return nil
+	}
+	return h.contentRequests
+}
+
+// under -> true if path is dir itself or inside it
+func under(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// Apply a change to the file tree that was already saved to the session
+func (h *Hub) applyWorkspace(message Message) {
+	h.startRecording(message)
+	switch message.Type {
+	case MessageTypeFileCreated:
+		for _, f := range message.Files {
+			if f.Folder {
+				h.folders[f.Path] = true
+			} else {
+				h.files[f.Path] = h.newFile(f.Content)
+			}
+			h.addParents(f.Path)
+		}
+
+	case MessageTypeFileMoved:
+		from, to := message.Path, message.NewPath
+		for path, f := range h.files {
+			if under(path, from) {
+				delete(h.files, path)
+				h.files[to+strings.TrimPrefix(path, from)] = f
+			}
+		}
+		for folder := range h.folders {
+			if under(folder, from) {
+				delete(h.folders, folder)
+				h.folders[to+strings.TrimPrefix(folder, from)] = true
+			}
+		}
+		if under(h.mainFile, from) {
+			h.mainFile = to + strings.TrimPrefix(h.mainFile, from)
+		}
+		h.addParents(to)
+
+	case MessageTypeFileDeleted:
+		for path := range h.files {
+			if under(path, message.Path) && path != h.mainFile {
+				delete(h.files, path)
+			}
+		}
+		for folder := range h.folders {
+			if under(folder, message.Path) {
+				delete(h.folders, folder)
+			}
+		}
+
+	default:
+		return
+	}
+	message.RoomID = h.RoomId
+	h.broadcast(message, false)
+	h.recordWorkspace(message)
+}
+
+// addParents records the folders above a path
+func (h *Hub) addParents(path string) {
+	for i := strings.LastIndex(path, "/"); i > 0; i = strings.LastIndex(path, "/") {
+		path = path[:i]
+		h.folders[path] = true
+	}
+}
+
+// Bring the live workspace in line with a restored session. Every change
+// is sent to clients as if it was made by the user who restored it.
+func (h *Hub) restoreWorkspace(message Message) {
+	restored := make(map[string]FileState, len(message.Files))
+	for _, f := range message.Files {
+		restored[f.Path] = f
+	}
+
+	// Keep the live document of the main file if it was renamed since
+	if message.Path != h.mainFile {
+		if _, ok := h.files[message.Path]; !ok {
+			h.applyWorkspace(Message{Type: MessageTypeFileMoved, SenderID: message.SenderID, SenderName: message.SenderName,
+				Timestamp: message.Timestamp, Path: h.mainFile, NewPath: message.Path})
+		}
+		h.mainFile = message.Path
+	}
+
+	for _, state := range h.fileStates(false) {
+		if h.files[state.Path] == nil && !h.folders[state.Path] {
+			// Already gone with its folder
+			continue
+		}
+		f, ok := restored[state.Path]
+		if !ok || f.Folder != state.Folder {
+			h.applyWorkspace(Message{Type: MessageTypeFileDeleted, SenderID: message.SenderID, SenderName: message.SenderName,
+				Timestamp: message.Timestamp, Path: state.Path})
+		}
+	}
+	for _, f := range message.Files {
+		if _, ok := h.files[f.Path]; ok && !f.Folder {
+			// Existing files are edited so that clients keep their position in the history
+			h.handle(Message{Type: h.editType(f.Path), SenderID: message.SenderID, SenderName: message.SenderName,
+				Timestamp: message.Timestamp, Path: f.Path, Content: f.Content})
+			continue
+		}
+		if (f.Folder && !h.folders[f.Path]) || (!f.Folder && h.files[f.Path] == nil) {
+			h.applyWorkspace(Message{Type: MessageTypeFileCreated, SenderID: message.SenderID, SenderName: message.SenderName,
+				Timestamp: message.Timestamp, Files: []FileState{f}})
+		}
+	}
+}
+
+// RestoreWorkspace swaps the workspace of a live room for a session that
+// was just saved, e.g. a restored version. Connected clients receive the
+// differences as edits and file changes. Rooms without a hub are left alone.
+func RestoreWorkspace(sess *models.Session, userID string) error {
+	message := Message{
+		Type:       MessageTypeSnapshot,
+		SenderID:   userID,
+		SenderName: "Server",
+		RoomID:     sess.RoomID.Hex(),
+		Timestamp:  time.Now(),
+		Path:       session.MainFile(sess),
+	}
+	for _, f := range session.WorkspaceFiles(sess) {
+		message.Files = append(message.Files, FileState{Path: f.Path, Folder: f.Folder, Content: f.Content})
+	}
+	publishChange(message.RoomID, envelope{Kind: envelopeRestore, Message: &message, Revision: sess.Revision})
+	return nil
+}
+
+// ApplyWorkspaceChange passes a change to the file tree of a room, which
+// was already saved to its session, to the room's hubs
+func ApplyWorkspaceChange(roomID string, change session.WorkspaceChange) error {
+	message := Message{
+		SenderID:   change.UserID,
+		SenderName: "Server",
+		RoomID:     roomID,
+		Timestamp:  time.Now(),
+		Path:       change.Path,
+	}
+	switch change.Action {
+	case session.WorkspaceCreate:
+		message.Type = MessageTypeFileCreated
+		message.Path = ""
+		message.Files = []FileState{{Path: change.File.Path, Folder: change.File.Folder, Content: change.File.Content}}
+	case session.WorkspaceMove:
+		message.Type = MessageTypeFileMoved
+		message.NewPath = change.NewPath
+	case session.WorkspaceDelete:
+		message.Type = MessageTypeFileDeleted
+	default:
+		return nil
+	}
+	publishChange(roomID, envelope{Kind: envelopeWorkspace, Message: &message, Revision: change.Revision})
+	return nil
+}
+
+// LiveContents returns the contents of the files of a live room by path,
+// which may include edits that were not saved yet. Nil if the room is not live.
+func LiveContents(roomID string) map[string]string {
+	for {
+		hub := roomHub(roomID)
+		if hub == nil {
+			return nil
+		}
+		if contents, ok := hub.liveContents(); ok {
+			return contents
+		}
+	}
+}
+
+// publishChange passes a server made change to the room's hub on this
+// instance, which publishes it to every hub of the room and records it
+func publishChange(roomID string, env envelope) {
+	for {
+		hub := roomHub(roomID)
+		if hub == nil || hub.change(env) {
+			return
+		}
+	}
+}
+
+// roomHub -> hub of the room on this instance. With other instances the
+// room may be live elsewhere, so a hub is started here that takes over
+// their state. Otherwise a room without a hub is not live.
+func roomHub(roomID string) *Hub {
+	if backplane.Distributed() {
+		return GetHub(roomID)
+	}
+	hub, _ := LookupHub(roomID)
+	return hub
+}
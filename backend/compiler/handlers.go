@@ -9,14 +9,28 @@ import (
 	"time"
 
 	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/middleware"
+	"example.com/collaborative-coding-editor/session"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// Compile Request
+// Compile Request. The code to run is either Script, the files of a
+// multi-file workspace, or the saved workspace of RoomID.
 type CompileRequest struct {
-	Script       string `json:"script"`
-	Language     string `json:"language"`
-	VersionIndex string `json:"versionIndex"`
-	Stdin        string `json:"stdin,omitempty"`
+	Script       string       `json:"script"`
+	Language     string       `json:"language"`
+	VersionIndex string       `json:"versionIndex"`
+	Stdin        string       `json:"stdin,omitempty"`
+	Files        []SourceFile `json:"files,omitempty"`
+	EntryFile    string       `json:"entryFile,omitempty"` // File that is run, defaults to the workspace main file
+	RoomID       string       `json:"roomId,omitempty"`
+}
+
+// Source file of a multi-file program
+type SourceFile struct {
+	Name    string `json:"name"` // Path within the workspace
+	Content string `json:"content"`
 }
 
 // Jdoodle Request
@@ -27,6 +41,8 @@ type JDoodleRequest struct {
 	Language     string `json:"language"`
 	VersionIndex string `json:"versionIndex"`
 	Stdin        string `json:"stdin,omitempty"`
+	// The other files of a multi-file program, next to the entry file in Script
+	Files []SourceFile `json:"files,omitempty"`
 }
 
 // Jdoodle Response
@@ -47,7 +63,57 @@ func CompileCode(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
-	if compileRequest.Script == "" || compileRequest.Language == "" || compileRequest.VersionIndex == "" {
+	if compileRequest.Language == "" || compileRequest.VersionIndex == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	// Load the workspace of the room if no code was sent
+	if compileRequest.Script == "" && len(compileRequest.Files) == 0 && compileRequest.RoomID != "" {
+		roomID, err := primitive.ObjectIDFromHex(compileRequest.RoomID)
+		if err != nil {
+			http.Error(w, "Invalid roomId", http.StatusBadRequest)
+			return
+		}
+		// Only members of the room may run its code
+		claims, _ := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+		userID, _ := claims["user_id"].(string)
+		if !session.RequireAccess(w, roomID, userID, session.AccessRead) {
+			return
+		}
+		sess, err := session.LoadSession(compileRequest.RoomID)
+		if err != nil {
+			http.Error(w, "Error loading session", http.StatusBadRequest)
+			return
+		}
+		for _, f := range session.WorkspaceFiles(sess) {
+			if !f.Folder {
+				compileRequest.Files = append(compileRequest.Files, SourceFile{Name: f.Path, Content: f.Content})
+			}
+		}
+		if compileRequest.EntryFile == "" {
+			compileRequest.EntryFile = session.MainFile(sess)
+		}
+	}
+
+	// The entry file is sent as the script, everything else next to it
+	var otherFiles []SourceFile
+	if len(compileRequest.Files) > 0 {
+		found := false
+		for _, f := range compileRequest.Files {
+			if !found && (f.Name == compileRequest.EntryFile || (compileRequest.EntryFile == "" && f.Name == session.DefaultMainFile)) {
+				compileRequest.Script = f.Content
+				found = true
+				continue
+			}
+			otherFiles = append(otherFiles, f)
+		}
+		if !found {
+			http.Error(w, "Entry file not found", http.StatusBadRequest)
+			return
+		}
+	}
+	if compileRequest.Script == "" {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
@@ -60,6 +126,7 @@ func CompileCode(w http.ResponseWriter, r *http.Request) {
 		Language:     compileRequest.Language,
 		VersionIndex: compileRequest.VersionIndex,
 		Stdin:        compileRequest.Stdin,
+		Files:        otherFiles,
 	}
 
 	reqBody, err := json.Marshal(jdoodleRequest)
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
@@ -16,6 +17,47 @@ type Config struct {
 	JWTSecret          string
 	RefreshTokenSecret string
 	BCryptCost         int
+	// Lifetime of access and refresh tokens
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// How long a password reset link can be used
+	PasswordResetTTL time.Duration
+	// How long an email verification link can be used
+	EmailVerificationTTL time.Duration
+	// Base URL of the frontend, used for links in emails
+	AppURL string
+
+	// Mail delivery: "smtp" or "outbox", which writes mails to OutboxDir
+	// or the log for local development
+	MailDriver   string
+	MailFrom     string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	OutboxDir    string
+
+	// Merge strategy for concurrent edits: "ot" or "crdt"
+	MergeStrategy string
+	// Number of broadcast messages kept per room for reconnecting clients
+	ReplayBufferSize int
+	// How long a hub without clients stays alive
+	HubIdleTimeout time.Duration
+	// How long the hub waits after the last edit before saving the document
+	AutosaveDelay time.Duration
+	// How long a shutdown waits for rooms and requests to finish
+	ShutdownTimeout time.Duration
+	// Backplane connecting hubs across instances: "local" or "redis"
+	Backplane string
+	RedisURL  string
+
+	// OpenID Connect single sign-on, enabled when OIDCIssuer is set.
+	// OIDCRedirectURL is the callback of this backend registered with the issuer.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       string
 
 	// JDOODLE API
 	JDoodleClientID     string
@@ -38,14 +80,108 @@ func LoadConfig() {
 		bcryptCost = 10
 	}
 
+	accessTokenTTL, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL"))
+	if err != nil || accessTokenTTL <= 0 {
+		accessTokenTTL = 15 * time.Minute
+	}
+
+	refreshTokenTTL, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL"))
+	if err != nil || refreshTokenTTL <= 0 {
+		refreshTokenTTL = 30 * 24 * time.Hour
+	}
+
+	passwordResetTTL, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL"))
+	if err != nil || passwordResetTTL <= 0 {
+		passwordResetTTL = time.Hour
+	}
+
+	emailVerificationTTL, err := time.ParseDuration(os.Getenv("EMAIL_VERIFICATION_TTL"))
+	if err != nil || emailVerificationTTL <= 0 {
+		emailVerificationTTL = 24 * time.Hour
+	}
+
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = "http://localhost:3000"
+	}
+
+	mailDriver := os.Getenv("MAIL_DRIVER")
+	if mailDriver == "" {
+		mailDriver = "outbox"
+	}
+
+	smtpPort := os.Getenv("SMTP_PORT")
+	if smtpPort == "" {
+		smtpPort = "587"
+	}
+
+	oidcRedirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	if oidcRedirectURL == "" {
+		oidcRedirectURL = "http://localhost:8080/auth/oidc/callback"
+	}
+
+	oidcScopes := os.Getenv("OIDC_SCOPES")
+	if oidcScopes == "" {
+		oidcScopes = "openid email profile"
+	}
+
+	mergeStrategy := os.Getenv("MERGE_STRATEGY")
+	if mergeStrategy == "" {
+		mergeStrategy = "ot"
+	}
+
+	replayBufferSize, err := strconv.Atoi(os.Getenv("REPLAY_BUFFER_SIZE"))
+	if err != nil || replayBufferSize <= 0 {
+		replayBufferSize = 1000
+	}
+
+	hubIdleTimeout, err := time.ParseDuration(os.Getenv("HUB_IDLE_TIMEOUT"))
+	if err != nil || hubIdleTimeout <= 0 {
+		hubIdleTimeout = 5 * time.Minute
+	}
+
+	autosaveDelay, err := time.ParseDuration(os.Getenv("AUTOSAVE_DELAY"))
+	if err != nil || autosaveDelay <= 0 {
+		autosaveDelay = 2 * time.Second
+	}
+
+	shutdownTimeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || shutdownTimeout <= 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+
 	AppConfig = &Config{
-		MongoURI:            os.Getenv("MONGO_URI"),
-		DBName:              os.Getenv("DB_NAME"),
-		JWTSecret:           os.Getenv("JWT_SECRET"),
-		RefreshTokenSecret:  os.Getenv("REFRESH_TOKEN_SECRET"),
-		BCryptCost:          bcryptCost,
-		JDoodleClientID:     os.Getenv("JDOODLE_CLIENT_ID"),
-		JDoodleClientSecret: os.Getenv("JDOODLE_CLIENT_SECRET"),
-		JDoodleEndpoint:     os.Getenv("JDOODLE_ENDPOINT"),
+		MongoURI:             os.Getenv("MONGO_URI"),
+		DBName:               os.Getenv("DB_NAME"),
+		JWTSecret:            os.Getenv("JWT_SECRET"),
+		RefreshTokenSecret:   os.Getenv("REFRESH_TOKEN_SECRET"),
+		BCryptCost:           bcryptCost,
+		AccessTokenTTL:       accessTokenTTL,
+		RefreshTokenTTL:      refreshTokenTTL,
+		PasswordResetTTL:     passwordResetTTL,
+		EmailVerificationTTL: emailVerificationTTL,
+		AppURL:               appURL,
+		MailDriver:           mailDriver,
+		MailFrom:             os.Getenv("MAIL_FROM"),
+		SMTPHost:             os.Getenv("SMTP_HOST"),
+		SMTPPort:             smtpPort,
+		SMTPUsername:         os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:         os.Getenv("SMTP_PASSWORD"),
+		OutboxDir:            os.Getenv("MAIL_OUTBOX_DIR"),
+		MergeStrategy:        mergeStrategy,
+		ReplayBufferSize:     replayBufferSize,
+		HubIdleTimeout:       hubIdleTimeout,
+		AutosaveDelay:        autosaveDelay,
+		ShutdownTimeout:      shutdownTimeout,
+		Backplane:            os.Getenv("BACKPLANE"),
+		RedisURL:             os.Getenv("REDIS_URL"),
+		OIDCIssuer:           os.Getenv("OIDC_ISSUER"),
+		OIDCClientID:         os.Getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret:     os.Getenv("OIDC_CLIENT_SECRET"),
+		OIDCRedirectURL:      oidcRedirectURL,
+		OIDCScopes:           oidcScopes,
+		JDoodleClientID:      os.Getenv("JDOODLE_CLIENT_ID"),
+		JDoodleClientSecret:  os.Getenv("JDOODLE_CLIENT_SECRET"),
+		JDoodleEndpoint:      os.Getenv("JDOODLE_ENDPOINT"),
 	}
 }
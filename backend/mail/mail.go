@@ -0,0 +1,171 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/collaborative-coding-editor/config"
+)
+
+// Most mails an outbox keeps in memory
+const outboxSize = 100
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Mailer used by Send
+var mailer Mailer = NewOutboxMailer("", "")
+
+// Setup selects the mailer configured for this instance
+func Setup() {
+	cfg := config.AppConfig
+	switch cfg.MailDriver {
+	case "", "outbox":
+		mailer = NewOutboxMailer(cfg.OutboxDir, cfg.MailFrom)
+		if cfg.OutboxDir != "" {
+			log.Printf("Mails are written to %s", cfg.OutboxDir)
+		}
+	case "smtp":
+		if cfg.SMTPHost == "" || cfg.MailFrom == "" {
+			log.Fatal("SMTP mailer needs SMTP_HOST and MAIL_FROM")
+		}
+		mailer = NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+	default:
+		log.Fatalf("Unknown mail driver: %s", cfg.MailDriver)
+	}
+}
+
+// Use replaces the configured mailer, e.g. with an outbox in tests
+func Use(m Mailer) {
+	mailer = m
+}
+
+// Send delivers a message with the configured mailer
+func Send(ctx context.Context, msg Message) error {
+	return mailer.Send(ctx, msg)
+}
+
+// format -> the message in RFC 5322 form
+func format(from string, msg Message, date time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader -> false if a header value could inject further headers
+func validHeader(values ...string) bool {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// SMTPMailer sends mails through an SMTP server, using STARTTLS if the
+// server offers it
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// Create a mailer for an SMTP server, without authentication if username is empty
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{addr: net.JoinHostPort(host, port), from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if !validHeader(msg.To, msg.Subject) {
+		return fmt.Errorf("invalid mail header")
+	}
+	// smtp.SendMail has no context, the send is abandoned when ctx is done
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg, time.Now()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OutboxMailer keeps mails instead of sending them. They are written to a
+// directory as .eml files, or to the log if no directory is set.
+type OutboxMailer struct {
+	mu   sync.Mutex
+	dir  string
+	from string
+	sent []Message
+	// Mails sent so far, numbers the files of mails sent at the same time
+	count int
+}
+
+// Create an outbox mailer writing to dir, the log if dir is empty
+func NewOutboxMailer(dir, from string) *OutboxMailer {
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	return &OutboxMailer{dir: dir, from: from}
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, msg Message) error {
+	if !validHeader(msg.To, msg.Subject) {
+		return fmt.Errorf("invalid mail header")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	if len(m.sent) > outboxSize {
+		m.sent = m.sent[len(m.sent)-outboxSize:]
+	}
+	m.count++
+
+	now := time.Now()
+	if m.dir == "" {
+		log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%03d.eml", now.UTC().Format("20060102T150405.000000000"), m.count)
+	return os.WriteFile(filepath.Join(m.dir, name), format(m.from, msg, now), 0o600)
+}
+
+// Sent -> the last mails kept, oldest first
+func (m *OutboxMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
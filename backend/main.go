@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"example.com/collaborative-coding-editor/auth"
 	"example.com/collaborative-coding-editor/collaboration"
 	"example.com/collaborative-coding-editor/compiler"
 	"example.com/collaborative-coding-editor/config"
+	"example.com/collaborative-coding-editor/mail"
+	"example.com/collaborative-coding-editor/middleware"
 	"example.com/collaborative-coding-editor/rooms"
 	"example.com/collaborative-coding-editor/session"
 	"github.com/gorilla/handlers"
@@ -31,6 +37,26 @@ func main() {
 
 	// Connect DB
 	auth.Connect()
+	session.EnsureIndexes()
+
+	// Revoked access tokens are rejected by the middleware and the WebSocket handlers
+	auth.StartRevocationSync()
+	middleware.TokenRevoked = auth.TokenRevoked
+
+	// Select how mails are delivered
+	mail.Setup()
+
+	// Enable single sign-on if an issuer is configured
+	auth.SetupOIDC()
+
+	// Connect the backplane shared by the collaboration hubs
+	collaboration.ConnectBackplane()
+
+	// Restored versions and file tree changes are passed on to the live room,
+	// file tree changes keep its unsaved edits
+	session.RestoreHook = collaboration.RestoreWorkspace
+	session.WorkspaceHook = collaboration.ApplyWorkspaceChange
+	session.ContentsHook = collaboration.LiveContents
 
 	// Setup router
 	auth.RegisterAuthRoutes(router)
@@ -40,6 +66,7 @@ func main() {
 
 	// Websocket router
 	router.HandleFunc("/collaboration/{room_id}", collaboration.WebSocketHandler)
+	router.HandleFunc("/collaboration/{room_id}/playback", collaboration.PlaybackHandler)
 
 	// CORS Settings
 	allowedOrigins, allowedMethods, allowedHeaders := defineCorsSettings(router)
@@ -58,8 +85,37 @@ func defineCorsSettings(router *mux.Router) (handlers.CORSOption, handlers.CORSO
 }
 
 func startMuxServer(handler http.Handler) {
-	log.Println("Backend server starting at 8080")
-	if err := http.ListenAndServe(":8080", handler); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	server := &http.Server{Addr: ":8080", Handler: handler}
+
+	go func() {
+		log.Println("Backend server starting at 8080")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.AppConfig.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections and drain REST requests while the rooms save their documents
+	hubsStopped := make(chan error, 1)
+	go func() { hubsStopped <- collaboration.Shutdown(ctx) }()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error draining requests: %v", err)
+	}
+	if err := <-hubsStopped; err != nil {
+		log.Printf("Error stopping rooms: %v", err)
+	}
+
+	if err := auth.Client.Disconnect(ctx); err != nil {
+		log.Printf("Error disconnecting MongoDB: %v", err)
 	}
+	log.Println("Server stopped")
 }
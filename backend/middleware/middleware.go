@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -14,6 +15,16 @@ type key string
 
 const UserKey key = "user"
 
+var (
+	ErrInvalidToken = errors.New("invalid auth token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// TokenRevoked reports whether an access token was revoked before it
+// expired. It is set by main to the revocation store of the auth service.
+var TokenRevoked func(claims jwt.MapClaims) bool
+
 // Validates the access token provided in the Auth Header
 func JWTAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -30,33 +41,61 @@ func JWTAuthentication(next http.Handler) http.Handler {
 			return
 		}
 
-		tokenString := parts[1]
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(config.AppConfig.JWTSecret), nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		claims, err := ParseAccessToken(parts[1])
+		switch err {
+		case nil:
+		case ErrTokenExpired:
+			http.Error(w, "Token expired", http.StatusUnauthorized)
 			return
-		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+		case ErrTokenRevoked:
+			http.Error(w, "Token revoked", http.StatusUnauthorized)
+			return
+		default:
+			http.Error(w, "Invalid auth token", http.StatusUnauthorized)
 			return
-		}
-
-		if exp, ok := claims["exp"].(float64); ok {
-			if int64(exp) < time.Now().Unix() {
-				http.Error(w, "Token expired", http.StatusUnauthorized)
-				return
-			}
 		}
 
 		ctx := context.WithValue(r.Context(), UserKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// ParseAccessToken checks the signature, expiry and revocation of an
+// access token and returns its claims
+func ParseAccessToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(config.AppConfig.JWTSecret), nil
+	})
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrTokenExpired
+	}
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	// Refresh tokens are only good for getting a new access token
+	if !ok || claims["type"] == "refresh" {
+		return nil, ErrInvalidToken
+	}
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if int64(exp) < time.Now().Unix() {
+			return nil, ErrTokenExpired
+		}
+	}
+
+	if Revoked(claims) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// Revoked -> true if the access token with the given claims is revoked,
+// for checking tokens again that were accepted earlier
+func Revoked(claims jwt.MapClaims) bool {
+	return TokenRevoked != nil && TokenRevoked(claims)
+}
@@ -8,23 +8,74 @@ import (
 
 // User model
 type User struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Username  string             `bson:"username" json:"username"`
-	Email     string             `bson:"email" json:"email"`
-	Password  string             `bson:"password" json:"password"`
-	Role      string             `bson:"role" json:"role"` // default "user"
-	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username      string             `bson:"username" json:"username"`
+	Email         string             `bson:"email" json:"email"`
+	Password      string             `bson:"password" json:"password"`
+	Role          string             `bson:"role" json:"role"`                     // default "user"
+	EmailVerified bool               `bson:"email_verified" json:"email_verified"` // Set once the user opened the link mailed to Email
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
 }
 
-// Refresh Token
+// Refresh Token, stored by the hash of the token. Tokens are used once:
+// every refresh replaces the token with a new one of the same family, the
+// tokens handed out since one login.
 type RefreshToken struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID    primitive.ObjectID `bson:"user_id,omitempty" json:"user_id"`
-	Token     string             `bson:"token" json:"token"`
+	TokenHash string             `bson:"token_hash" json:"-"` // SHA-256 of the token, hex encoded
+	FamilyID  string             `bson:"family_id" json:"family_id"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"` // Set once the token was exchanged for a new one
+	Revoked   bool               `bson:"revoked" json:"revoked"`                     // Set on logout or when a used token is presented again
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// Password Reset token, stored by its hash. It can be used once, and only
+// the latest token of a user is valid.
+type PasswordReset struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// Email Verification token, stored by its hash. It verifies Email for the
+// user, so it is of no use once the user changed the address.
+type EmailVerification struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Email     string             `bson:"email" json:"email"`
+	TokenHash string             `bson:"token_hash" json:"-"`
 	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 }
 
+// OIDC Login in progress, from the redirect to the issuer until its
+// callback. It is found by the hash of the state sent to the issuer.
+type OIDCLogin struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	StateHash    string             `bson:"state_hash" json:"-"`
+	Nonce        string             `bson:"nonce" json:"-"`
+	CodeVerifier string             `bson:"code_verifier" json:"-"` // PKCE verifier of the code challenge sent
+	ExpiresAt    time.Time          `bson:"expires_at" json:"expires_at"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// RevokedToken is an entry of the access token revocation list. Kind is
+// "token" for a single token by jti, "session" for every access token of a
+// refresh token family and "user" for every token of a user issued before
+// RevokedAt. Entries are deleted once no token they cover can be valid.
+type RevokedToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Kind      string             `bson:"kind" json:"kind"`
+	Value     string             `bson:"value" json:"value"`
+	RevokedAt time.Time          `bson:"revoked_at" json:"revoked_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+}
+
 // Room model
 type Room struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
@@ -36,6 +87,19 @@ type Room struct {
 	Status       string             `bson:"status" json:"status"` // open or closed
 }
 
+// IsMember -> true if the user is the admin or a participant of the room
+func (r *Room) IsMember(userID string) bool {
+	if r.AdminID == userID {
+		return true
+	}
+	for _, pid := range r.Participants {
+		if pid == userID {
+			return true
+		}
+	}
+	return false
+}
+
 // Invitation Model
 type Invitation struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
@@ -49,13 +113,60 @@ type Invitation struct {
 
 // Session Model
 type Session struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	RoomID     primitive.ObjectID `bson:"room_id" json:"room_id"` // Reference to the room
-	Code       string             `bson:"code" json:"code"`       // The current code in the editor
-	LastSaved  time.Time          `bson:"last_saved" json:"last_saved"`
-	UpdatedBy  string             `bson:"updated_by" json:"updated_by"` // Last user (by user_id) who saved/updated
-	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
-	ModifiedAt time.Time          `bson:"modified_at" json:"modified_at"`
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID       primitive.ObjectID `bson:"room_id" json:"room_id"`                         // Reference to the room
+	Code         string             `bson:"code" json:"code"`                               // The current code of the main file
+	MainFile     string             `bson:"main_file,omitempty" json:"main_file,omitempty"` // Path of the file kept in Code
+	Files        []WorkspaceFile    `bson:"files,omitempty" json:"files,omitempty"`         // Every other file and folder of the workspace
+	Language     string             `bson:"language,omitempty" json:"language,omitempty"`   // Compiler language of the code, e.g. "python3"
+	LastSaved    time.Time          `bson:"last_saved" json:"last_saved"`
+	UpdatedBy    string             `bson:"updated_by" json:"updated_by"`                         // Last user (by user_id) who saved/updated
+	Contributors []string           `bson:"contributors,omitempty" json:"contributors,omitempty"` // Users (by user_id) who edited the code
+	Revision     int64              `bson:"revision" json:"revision"`                             // Incremented on every save
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	ModifiedAt   time.Time          `bson:"modified_at" json:"modified_at"`
+}
+
+// WorkspaceFile Model -> file or folder in the workspace of a room
+type WorkspaceFile struct {
+	Path    string `bson:"path" json:"path"` // Slash separated path from the workspace root, e.g. "src/util.py"
+	Folder  bool   `bson:"folder,omitempty" json:"folder,omitempty"`
+	Content string `bson:"content,omitempty" json:"content,omitempty"`
+}
+
+// SessionVersion Model -> code of a session as saved at one revision
+type SessionVersion struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID    primitive.ObjectID `bson:"room_id" json:"room_id"`
+	Revision  int64              `bson:"revision" json:"revision"`
+	Code      string             `bson:"code" json:"code"`
+	MainFile  string             `bson:"main_file,omitempty" json:"main_file,omitempty"`
+	Files     []WorkspaceFile    `bson:"files,omitempty" json:"files,omitempty"`
+	UpdatedBy string             `bson:"updated_by" json:"updated_by"` // User (by user_id) who saved this revision
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	Autosave  bool               `bson:"autosave,omitempty" json:"autosave,omitempty"` // Saved by the live room rather than by a user
+}
+
+// PlaybackEvent Model -> change to the workspace of a room, recorded for session playback
+type PlaybackEvent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID    primitive.ObjectID `bson:"room_id" json:"room_id"`
+	Seq       int64              `bson:"seq" json:"seq"`                               // Room sequence number, orders events recorded in the same millisecond
+	Type      string             `bson:"type" json:"type"`                             // "snapshot", "edit", "file_created", "file_moved" or "file_deleted"
+	Path      string             `bson:"path,omitempty" json:"path,omitempty"`         // File edited, moved or deleted, or the main file of a snapshot
+	NewPath   string             `bson:"new_path,omitempty" json:"new_path,omitempty"` // Destination of a move
+	Ops       []TextOp           `bson:"ops,omitempty" json:"ops,omitempty"`           // Operation of an edit on the previous content of the file
+	Files     []WorkspaceFile    `bson:"files,omitempty" json:"files,omitempty"`       // Whole workspace of a snapshot, or the files created
+	UserID    string             `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	UserName  string             `bson:"user_name,omitempty" json:"user_name,omitempty"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// TextOp -> one component of a recorded edit, exactly one field is set
+type TextOp struct {
+	Retain int    `bson:"retain,omitempty" json:"retain,omitempty"`
+	Insert string `bson:"insert,omitempty" json:"insert,omitempty"`
+	Delete int    `bson:"delete,omitempty" json:"delete,omitempty"`
 }
 
 // Auditlog Model
@@ -64,6 +175,6 @@ type AuditLog struct {
 	RoomID    primitive.ObjectID `bson:"room_id" json:"room_id"` // Associated room/session
 	UserID    string             `bson:"user_id" json:"user_id"` // The user who performed the action
 	Action    string             `bson:"action" json:"action"`   // e.g., "auto-save", "edit", "join", "export"
-	Details   string             `bson:"details" json:"details"` // Additional information (could be a diff, etc.)
+	Details   string             `bson:"details" json:"details"` // Additional information, e.g. the lines changed by a save
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
 }
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"example.com/collaborative-coding-editor/auth"
@@ -245,6 +246,23 @@ func JoinRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Invitations sent to an email can only be accepted by its verified owner
+	if invitation.InvitedEmail != "" {
+		email, verified, err := auth.VerifiedEmail(ctx, userID)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		if !strings.EqualFold(email, invitation.InvitedEmail) {
+			http.Error(w, "This invitation was sent to another email", http.StatusForbidden)
+			return
+		}
+		if !verified {
+			http.Error(w, "Verify your email to accept this invitation", http.StatusForbidden)
+			return
+		}
+	}
+
 	// Add the participant to the room
 	roomCollection := auth.GetCollection("rooms")
 	filter := bson.M{"_id": invitation.RoomID}
@@ -359,8 +377,7 @@ func CloseRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Broadcast a room closure message
-	hub := collaboration.GetHub(roomIDStr)
+	// Broadcast a room closure message, then disconnect everybody and stop the room's hubs
 	closeMsg := collaboration.Message{
 		Type:       collaboration.MessageTypeRoomClosed,
 		SenderID:   userID,
@@ -369,7 +386,9 @@ func CloseRoom(w http.ResponseWriter, r *http.Request) {
 		Timestamp:  time.Now(),
 	}
 
-	hub.Broadcast <- closeMsg
+	if err := collaboration.CloseRoom(roomIDStr, closeMsg); err != nil {
+		log.Printf("Error closing hub for room %s: %v", roomIDStr, err)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Room Closed"})
@@ -417,21 +436,65 @@ func GetRoomDetails(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Allow access only if admin/participant
-	if room.AdminID != userID {
-		participant := false
-		for _, pid := range room.Participants {
-			if pid == userID {
-				participant = true
-				break
-			}
-		}
-
-		if !participant {
-			http.Error(w, "You are not participant of this room", http.StatusForbidden)
-			return
-		}
+	if !room.IsMember(userID) {
+		http.Error(w, "You are not participant of this room", http.StatusForbidden)
+		return
 	}
 
 	json.NewEncoder(w).Encode(room)
 
 }
+
+// Get the users currently connected to the room
+func GetRoomPresence(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomIdStr, ok := vars["room_id"]
+	if !ok {
+		http.Error(w, "Room Id is required", http.StatusBadRequest)
+		return
+	}
+
+	roomID, err := primitive.ObjectIDFromHex(roomIdStr)
+	if err != nil {
+		http.Error(w, "Invalid Room Id", http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		http.Error(w, "Invalid User Id", http.StatusUnauthorized)
+		return
+	}
+
+	roomCollection := auth.GetCollection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var room models.Room
+	err = roomCollection.FindOne(ctx, bson.M{"_id": roomID}).Decode(&room)
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if !room.IsMember(userID) {
+		http.Error(w, "You are not participant of this room", http.StatusForbidden)
+		return
+	}
+
+	// The room may only be live on another instance
+	participants, err := collaboration.RoomPresence(roomIdStr)
+	if err != nil {
+		log.Printf("Error getting presence of room %s: %v", roomIdStr, err)
+		http.Error(w, "Error retrieving presence", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(participants)
+}
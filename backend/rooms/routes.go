@@ -17,4 +17,5 @@ func RegisterRoomRoutes(router *mux.Router) {
 	roomRouter.HandleFunc("/history", GetRoomHistory).Methods("GET")
 	roomRouter.HandleFunc("/{room_id}", GetRoomDetails).Methods("GET")
 	roomRouter.HandleFunc("/{room_id}/close", CloseRoom).Methods("POST")
+	roomRouter.HandleFunc("/{room_id}/presence", GetRoomPresence).Methods("GET")
 }
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"example.com/collaborative-coding-editor/middleware"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Access is what a user wants to do with the session of a room
+type Access int
+
+const (
+	// AccessRead -> view the code, its history, exports and the audit trail
+	AccessRead Access = iota
+	// AccessWrite -> change the code or the workspace and add audit entries
+	AccessWrite
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrNotMember    = errors.New("you are not participant of this room")
+	ErrRoomClosed   = errors.New("room is closed")
+)
+
+// CheckAccess returns the room if the user may access its session. The
+// admin and participants may read it, and write to it while the room is open.
+func CheckAccess(roomID primitive.ObjectID, userID string, access Access) (*models.Room, error) {
+	roomCollection := auth.GetCollection("rooms")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var room models.Room
+	err := roomCollection.FindOne(ctx, bson.M{"_id": roomID}).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userID == "" || !room.IsMember(userID) {
+		return nil, ErrNotMember
+	}
+	if access == AccessWrite && room.Status == "closed" {
+		return nil, ErrRoomClosed
+	}
+	return &room, nil
+}
+
+// authorize checks that the requesting user may access the session of a
+// room and returns the user's id, answering the request if not
+func authorize(w http.ResponseWriter, r *http.Request, roomID primitive.ObjectID, access Access) (string, bool) {
+	claims, ok := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	userID, _ := claims["user_id"].(string)
+
+	if !RequireAccess(w, roomID, userID, access) {
+		return "", false
+	}
+	return userID, true
+}
+
+// RequireAccess checks the user's access to the session of a room like
+// CheckAccess, answering the request if it is denied
+func RequireAccess(w http.ResponseWriter, roomID primitive.ObjectID, userID string, access Access) bool {
+	switch _, err := CheckAccess(roomID, userID, access); err {
+	case nil:
+		return true
+	case ErrRoomNotFound:
+		http.Error(w, "Room not found", http.StatusNotFound)
+	case ErrNotMember:
+		http.Error(w, "You are not participant of this room", http.StatusForbidden)
+	case ErrRoomClosed:
+		http.Error(w, "Room is closed", http.StatusForbidden)
+	default:
+		http.Error(w, "Error retrieving room", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// roomAccess parses the room_id path variable and checks the requesting
+// user's access to the room, answering the request on error
+func roomAccess(w http.ResponseWriter, r *http.Request, access Access) (primitive.ObjectID, string, bool) {
+	roomIDStr := mux.Vars(r)["room_id"]
+	if roomIDStr == "" {
+		http.Error(w, "RoomID is required", http.StatusBadRequest)
+		return primitive.NilObjectID, "", false
+	}
+	roomID, err := primitive.ObjectIDFromHex(roomIDStr)
+	if err != nil {
+		http.Error(w, "Invalid RoomID", http.StatusBadRequest)
+		return primitive.NilObjectID, "", false
+	}
+	userID, ok := authorize(w, r, roomID, access)
+	return roomID, userID, ok
+}
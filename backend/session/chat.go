@@ -0,0 +1,79 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChatLogEntry is a chat message as stored in chat_logs
+type ChatLogEntry struct {
+	SenderID   string    `bson:"sender_id" json:"sender_id"`
+	SenderName string    `bson:"sender_name" json:"sender_name"`
+	Content    string    `bson:"content" json:"content"`
+	Timestamp  time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// chatLog keeps the chat messages of rooms, tests swap it for one in memory
+type chatLog interface {
+	add(ctx context.Context, roomID primitive.ObjectID, entry ChatLogEntry) error
+	// between -> messages sent from start until end in the order they were
+	// sent, zero times leave that side open
+	between(ctx context.Context, roomID primitive.ObjectID, start, end time.Time) ([]ChatLogEntry, error)
+}
+
+var chats chatLog = mongoChatLog{}
+
+// SaveChat stores a chat message sent in a room
+func SaveChat(roomID primitive.ObjectID, entry ChatLogEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return chats.add(ctx, roomID, entry)
+}
+
+// loadChat returns the chat messages of a room in the order they were sent
+func loadChat(ctx context.Context, roomID primitive.ObjectID) ([]ChatLogEntry, error) {
+	return chats.between(ctx, roomID, time.Time{}, time.Time{})
+}
+
+// mongoChatLog stores messages in chat_logs by the hex id of their room
+type mongoChatLog struct{}
+
+func (mongoChatLog) add(ctx context.Context, roomID primitive.ObjectID, entry ChatLogEntry) error {
+	_, err := auth.GetCollection("chat_logs").InsertOne(ctx, bson.M{
+		"room_id":     roomID.Hex(),
+		"sender_id":   entry.SenderID,
+		"sender_name": entry.SenderName,
+		"content":     entry.Content,
+		"timestamp":   entry.Timestamp,
+	})
+	return err
+}
+
+func (mongoChatLog) between(ctx context.Context, roomID primitive.ObjectID, start, end time.Time) ([]ChatLogEntry, error) {
+	filter := bson.M{"room_id": roomID.Hex()}
+	window := bson.M{}
+	if !start.IsZero() {
+		window["$gte"] = start
+	}
+	if !end.IsZero() {
+		window["$lte"] = end
+	}
+	if len(window) > 0 {
+		filter["timestamp"] = window
+	}
+	opts := options.Find().SetSort(bson.M{"timestamp": 1})
+	cursor, err := auth.GetCollection("chat_logs").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	chat := []ChatLogEntry{}
+	if err := cursor.All(ctx, &chat); err != nil {
+		return nil, err
+	}
+	return chat, nil
+}
@@ -0,0 +1,150 @@
+package session
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryChatLog keeps chat messages in memory
+type memoryChatLog struct {
+	sync.Mutex
+	rooms map[primitive.ObjectID][]ChatLogEntry
+}
+
+func (m *memoryChatLog) add(ctx context.Context, roomID primitive.ObjectID, entry ChatLogEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	m.rooms[roomID] = append(m.rooms[roomID], entry)
+	return nil
+}
+
+func (m *memoryChatLog) between(ctx context.Context, roomID primitive.ObjectID, start, end time.Time) ([]ChatLogEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	chat := []ChatLogEntry{}
+	for _, entry := range m.rooms[roomID] {
+		if (start.IsZero() || !entry.Timestamp.Before(start)) && (end.IsZero() || !entry.Timestamp.After(end)) {
+			chat = append(chat, entry)
+		}
+	}
+	return chat, nil
+}
+
+func useChats(t *testing.T) {
+	t.Helper()
+	prev := chats
+	chats = &memoryChatLog{rooms: make(map[primitive.ObjectID][]ChatLogEntry)}
+	t.Cleanup(func() { chats = prev })
+}
+
+// unzip -> files of an archive by name
+func unzip(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestExportIncludesRoomChat(t *testing.T) {
+	useChats(t)
+	room, other := primitive.NewObjectID(), primitive.NewObjectID()
+	sent := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, save := range []struct {
+		room  primitive.ObjectID
+		entry ChatLogEntry
+	}{
+		{room, ChatLogEntry{SenderID: "u1", SenderName: "Ada", Content: "hello", Timestamp: sent}},
+		{other, ChatLogEntry{SenderID: "u2", SenderName: "Eve", Content: "not here", Timestamp: sent}},
+		{room, ChatLogEntry{SenderID: "u2", SenderName: "Bob", Content: "two\nlines", Timestamp: sent.Add(time.Minute)}},
+	} {
+		if err := SaveChat(save.room, save.entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chat, err := loadChat(context.Background(), room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := &models.Session{RoomID: room, Code: "print(1)\n"}
+	manifest := ExportManifest{RoomID: room.Hex(), RoomName: "Demo", Language: "python3", ChatMessages: len(chat)}
+	var buf bytes.Buffer
+	if err := writeExport(&buf, manifest, sess, chat, nil); err != nil {
+		t.Fatal(err)
+	}
+	files := unzip(t, buf.Bytes())
+
+	want := "# Chat transcript: Demo\n\n" +
+		"- **Ada** (2026-01-02T03:04:05Z): hello\n" +
+		"- **Bob** (2026-01-02T03:05:05Z): two\n  lines\n"
+	if files["chat.md"] != want {
+		t.Fatalf("chat.md = %q, want %q", files["chat.md"], want)
+	}
+	var got ExportManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ChatMessages != 2 || !strings.Contains(strings.Join(got.Files, " "), "code/main.py") {
+		t.Fatalf("manifest %+v", got)
+	}
+	if files["code/main.py"] != "print(1)\n" {
+		t.Fatalf("files %v", files)
+	}
+}
+
+func TestPlaybackIncludesRoomChat(t *testing.T) {
+	useChats(t)
+	room := primitive.NewObjectID()
+	start := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	SaveChat(room, ChatLogEntry{SenderID: "u0", Content: "before", Timestamp: start.Add(-time.Second)})
+	SaveChat(room, ChatLogEntry{SenderID: "u1", SenderName: "Ada", Content: "hi", Timestamp: start.Add(1500 * time.Millisecond)})
+	SaveChat(primitive.NewObjectID(), ChatLogEntry{SenderID: "u2", Content: "elsewhere", Timestamp: start.Add(time.Second)})
+
+	events := []models.PlaybackEvent{
+		{Type: "snapshot", Timestamp: start},
+		{Type: "edit", UserID: "u1", Timestamp: start.Add(time.Second)},
+		{Type: "edit", UserID: "u1", Timestamp: start.Add(2 * time.Second)},
+	}
+	chat, err := chats.between(context.Background(), room, start, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playback := mergePlayback(room, events, chat, false)
+
+	var got []string
+	for _, f := range playback.Events {
+		got = append(got, f.Type+"@"+strconv.FormatInt(f.Offset, 10)+f.Text)
+	}
+	if want := "snapshot@0 edit@1000 chat@1500hi edit@2000"; strings.Join(got, " ") != want {
+		t.Fatalf("events %v, want %s", got, want)
+	}
+	if playback.Users["u1"] != "Ada" || playback.Duration != 2000 {
+		t.Fatalf("users %v, duration %d", playback.Users, playback.Duration)
+	}
+}
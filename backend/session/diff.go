@@ -0,0 +1,225 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// splitLines splits text into lines, each keeping its trailing newline, so
+// that joining the lines gives back the exact text
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// matchLines finds a longest common subsequence of a and b with Myers'
+// algorithm. match[i] is the index in b of the line matched to a[i], or -1.
+func matchLines(a, b []string) []int {
+	n, m := len(a), len(b)
+	match := make([]int, n)
+	for i := range match {
+		match[i] = -1
+	}
+
+	if n == 0 || m == 0 {
+		return match
+	}
+
+	limit := n + m
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		snapshot := make([]int, len(v))
+		copy(snapshot, v)
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// Walk the trace back from the end to recover the matched lines
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0 && (x > 0 || y > 0); d-- {
+		prev := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[offset+k-1] < prev[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[offset+prevK]
+		prevY := prevX - prevK
+		if d == 0 {
+			prevX, prevY = 0, 0
+		}
+		for x > prevX && y > prevY {
+			x--
+			y--
+			match[x] = y
+		}
+		x, y = prevX, prevY
+	}
+	return match
+}
+
+// Unchanged lines shown around each change
+const diffContext = 3
+
+// DiffLine is one line of a hunk. Op is " " for context, "-" for a removed
+// and "+" for an added line. Text does not include the line break.
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// Hunk is a group of changes with surrounding context. Line numbers start
+// at 1, a start of 0 means the range is empty at the top of the file.
+type Hunk struct {
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// Diff compares two texts line by line and returns the changed hunks
+func Diff(oldText, newText string) []Hunk {
+	a, b := splitLines(oldText), splitLines(newText)
+	match := matchLines(a, b)
+
+	// Edit script: every line of both texts in order
+	type edit struct {
+		op         string
+		text       string
+		oldN, newN int // lines consumed before this one
+	}
+	var script []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && match[i] < 0:
+			script = append(script, edit{"-", a[i], i, j})
+			i++
+		case j < len(b) && (i == len(a) || j < match[i]):
+			script = append(script, edit{"+", b[j], i, j})
+			j++
+		default:
+			script = append(script, edit{" ", a[i], i, j})
+			i++
+			j++
+		}
+	}
+
+	var hunks []Hunk
+	for k := 0; k < len(script); {
+		if script[k].op == " " {
+			k++
+			continue
+		}
+		// Extend the hunk while changes are close enough to share context
+		start := max(k-diffContext, 0)
+		end := k
+		for end < len(script) {
+			if script[end].op != " " {
+				end++
+				continue
+			}
+			next := end
+			for next < len(script) && script[next].op == " " {
+				next++
+			}
+			if next == len(script) || next-end > 2*diffContext {
+				end = min(end+diffContext, len(script))
+				break
+			}
+			end = next
+		}
+
+		h := Hunk{OldStart: script[start].oldN + 1, NewStart: script[start].newN + 1}
+		for _, e := range script[start:end] {
+			h.Lines = append(h.Lines, DiffLine{Op: e.op, Text: strings.TrimSuffix(strings.TrimSuffix(e.text, "\n"), "\r")})
+			if e.op != "+" {
+				h.OldLines++
+			}
+			if e.op != "-" {
+				h.NewLines++
+			}
+		}
+		if h.OldLines == 0 {
+			h.OldStart--
+		}
+		if h.NewLines == 0 {
+			h.NewStart--
+		}
+		hunks = append(hunks, h)
+		k = end
+	}
+	return hunks
+}
+
+// UnifiedDiff formats hunks in the unified diff format used by diff -u and git
+func UnifiedDiff(oldName, newName string, hunks []Hunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	for _, h := range hunks {
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(h.OldStart, h.OldLines), hunkRange(h.NewStart, h.NewLines))
+		for _, line := range h.Lines {
+			b.WriteString(line.Op)
+			b.WriteString(line.Text)
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// DiffStat counts the added and removed lines of the hunks
+func DiffStat(hunks []Hunk) (added, removed int) {
+	for _, h := range hunks {
+		for _, line := range h.Lines {
+			switch line.Op {
+			case "+":
+				added++
+			case "-":
+				removed++
+			}
+		}
+	}
+	return added, removed
+}
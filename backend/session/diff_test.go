@@ -0,0 +1,94 @@
+package session
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lcsLength -> length of a longest common subsequence by dynamic programming
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestMatchLinesFindsLongestCommonSubsequence(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a'+rng.Intn(4))) + "\n"
+		}
+		return lines
+	}
+
+	for round := 0; round < 500; round++ {
+		a, b := randomLines(), randomLines()
+		match := matchLines(a, b)
+		matched, last := 0, -1
+		for i, j := range match {
+			if j < 0 {
+				continue
+			}
+			if j <= last || a[i] != b[j] {
+				t.Fatalf("%q vs %q: invalid match %v", a, b, match)
+			}
+			last = j
+			matched++
+		}
+		if want := lcsLength(a, b); matched != want {
+			t.Fatalf("%q vs %q: matched %d lines, want %d", a, b, matched, want)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	var old, changed []string
+	for i := 1; i <= 12; i++ {
+		line := strings.Repeat("x", i)
+		old = append(old, line)
+		switch i {
+		case 2:
+			changed = append(changed, "two")
+		case 11:
+			// removed
+		default:
+			changed = append(changed, line)
+		}
+	}
+	hunks := Diff(strings.Join(old, "\n")+"\n", strings.Join(changed, "\n")+"\n")
+
+	want := "--- a\n+++ b\n" +
+		"@@ -1,5 +1,5 @@\n x\n-xx\n+two\n xxx\n xxxx\n xxxxx\n" +
+		"@@ -8,5 +8,4 @@\n xxxxxxxx\n xxxxxxxxx\n xxxxxxxxxx\n-xxxxxxxxxxx\n xxxxxxxxxxxx\n"
+	if got := UnifiedDiff("a", "b", hunks); got != want {
+		t.Fatalf("diff\n%s\nwant\n%s", got, want)
+	}
+	if added, removed := DiffStat(hunks); added != 1 || removed != 2 {
+		t.Fatalf("diff stat +%d -%d, want +1 -2", added, removed)
+	}
+}
+
+func TestDiffEdges(t *testing.T) {
+	if hunks := Diff("same\n", "same\n"); len(hunks) != 0 {
+		t.Fatalf("equal texts differ: %+v", hunks)
+	}
+	// Ranges that are empty start before the first line
+	if got := UnifiedDiff("a", "b", Diff("", "new\n")); got != "--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n" {
+		t.Fatalf("diff from empty %q", got)
+	}
+	if got := UnifiedDiff("a", "b", Diff("old\n", "")); got != "--- a\n+++ b\n@@ -1 +0,0 @@\n-old\n" {
+		t.Fatalf("diff to empty %q", got)
+	}
+}
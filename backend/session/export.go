@@ -0,0 +1,262 @@
+package session
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"example.com/collaborative-coding-editor/middleware"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// File extensions of the compiler languages, used for files saved without one
+var languageExtensions = map[string]string{
+	"python3":    ".py",
+	"javascript": ".js",
+	"nodejs":     ".js",
+	"typescript": ".ts",
+	"go":         ".go",
+	"java":       ".java",
+	"c":          ".c",
+	"cpp":        ".cpp",
+	"cpp17":      ".cpp",
+	"csharp":     ".cs",
+	"ruby":       ".rb",
+	"php":        ".php",
+	"rust":       ".rs",
+	"kotlin":     ".kt",
+	"swift":      ".swift",
+	"bash":       ".sh",
+	"sql":        ".sql",
+}
+
+// ExportManifest describes the contents of an exported archive
+type ExportManifest struct {
+	RoomID       string    `json:"room_id"`
+	RoomName     string    `json:"room_name,omitempty"`
+	AdminID      string    `json:"admin_id,omitempty"`
+	Status       string    `json:"status,omitempty"`
+	Participants []string  `json:"participants,omitempty"`
+	RoomCreated  time.Time `json:"room_created_at"`
+	MainFile     string    `json:"main_file"`
+	Revision     int64     `json:"revision"`
+	LastSaved    time.Time `json:"last_saved"`
+	UpdatedBy    string    `json:"updated_by"`
+	Contributors []string  `json:"contributors,omitempty"`
+	Language     string    `json:"language,omitempty"`
+	ExportedAt   time.Time `json:"exported_at"`
+	ExportedBy   string    `json:"exported_by"`
+	Files        []string  `json:"files"`
+	ChatMessages int       `json:"chat_messages"`
+	AuditEntries int       `json:"audit_entries"`
+}
+
+// exportZip writes the session as a ZIP archive holding the source files
+// under code/, the chat transcript, the audit log as CSV and JSON and a manifest
+func exportZip(w http.ResponseWriter, r *http.Request, sess *models.Session, audits []models.AuditLog) {
+	roomID := sess.RoomID
+	claims, _ := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+	userID, _ := claims["user_id"].(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var room models.Room
+	if err := auth.GetCollection("rooms").FindOne(ctx, bson.M{"_id": roomID}).Decode(&room); err != nil {
+		log.Printf("Error retrieving room for export: %v", err)
+	}
+	chat, err := loadChat(ctx, roomID)
+	if err != nil {
+		http.Error(w, "Error retrieving chat messages", http.StatusInternalServerError)
+		return
+	}
+
+	manifest := ExportManifest{
+		RoomID:       roomID.Hex(),
+		RoomName:     room.Name,
+		AdminID:      room.AdminID,
+		Status:       room.Status,
+		Participants: room.Participants,
+		RoomCreated:  room.CreatedAt,
+		MainFile:     MainFile(sess),
+		Revision:     sess.Revision,
+		LastSaved:    sess.LastSaved,
+		UpdatedBy:    sess.UpdatedBy,
+		Contributors: sess.Contributors,
+		Language:     exportLanguage(r.URL.Query().Get("language"), sess),
+		ExportedAt:   time.Now(),
+		ExportedBy:   userID,
+		ChatMessages: len(chat),
+		AuditEntries: len(audits),
+	}
+
+	name := exportName(room.Name, roomID)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zip"))
+
+	if err := writeExport(w, manifest, sess, chat, audits); err != nil {
+		// The response has started, all that is left is to log the broken archive
+		log.Printf("Error writing export archive: %v", err)
+		return
+	}
+
+	go addAuditLog(roomID, userID, "export", "Session exported as a ZIP archive.")
+}
+
+// writeExport writes the ZIP archive of a session export
+func writeExport(out io.Writer, manifest ExportManifest, sess *models.Session, chat []ChatLogEntry, audits []models.AuditLog) error {
+	archive := zip.NewWriter(out)
+	write := func(name string, body func(io.Writer) error) error {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: manifest.ExportedAt})
+		if err != nil {
+			return err
+		}
+		return body(f)
+	}
+
+	for _, f := range WorkspaceFiles(sess) {
+		if f.Folder {
+			continue
+		}
+		p := "code/" + withExtension(f.Path, manifest.Language)
+		manifest.Files = append(manifest.Files, p)
+		content := f.Content
+		if err := write(p, func(out io.Writer) error {
+			_, err := io.WriteString(out, content)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if err := write("chat.md", func(out io.Writer) error { return writeTranscript(out, manifest, chat) }); err != nil {
+		return err
+	}
+	if err := write("audit_log.csv", func(out io.Writer) error { return writeAuditCSV(out, audits) }); err != nil {
+		return err
+	}
+	if err := write("audit_log.json", func(out io.Writer) error { return writeJSON(out, audits) }); err != nil {
+		return err
+	}
+	manifest.Files = append(manifest.Files, "chat.md", "audit_log.csv", "audit_log.json")
+	if err := write("manifest.json", func(out io.Writer) error { return writeJSON(out, manifest) }); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// exportLanguage -> language whose extension files without one get in an
+// export: the requested one, the one saved with the session or else the
+// one most files of the workspace are written in
+func exportLanguage(requested string, sess *models.Session) string {
+	if requested != "" {
+		return requested
+	}
+	if sess.Language != "" {
+		return sess.Language
+	}
+
+	counts := make(map[string]int)
+	for _, f := range WorkspaceFiles(sess) {
+		if !f.Folder {
+			counts[path.Ext(f.Path)]++
+		}
+	}
+	// Languages sharing an extension are tried in name order so that the
+	// same workspace always gets the same one
+	languages := make([]string, 0, len(languageExtensions))
+	for language := range languageExtensions {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	best, bestCount := "", 0
+	for _, language := range languages {
+		if n := counts[languageExtensions[language]]; n > bestCount {
+			best, bestCount = language, n
+		}
+	}
+	return best
+}
+
+// withExtension adds the extension of the language to files without one
+func withExtension(p, language string) string {
+	if path.Ext(p) != "" {
+		return p
+	}
+	if ext, ok := languageExtensions[language]; ok {
+		return p + ext
+	}
+	return p + ".txt"
+}
+
+// exportName -> file name of an export, from the room name if it has a usable one
+func exportName(roomName string, roomID primitive.ObjectID) string {
+	slug := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, roomName)
+	slug = strings.Trim(slug, "-")
+	if slug == "" {
+		slug = roomID.Hex()
+	}
+	return "session-" + slug
+}
+
+func writeTranscript(out io.Writer, manifest ExportManifest, chat []ChatLogEntry) error {
+	title := manifest.RoomName
+	if title == "" {
+		title = manifest.RoomID
+	}
+	if _, err := fmt.Fprintf(out, "# Chat transcript: %s\n\n", title); err != nil {
+		return err
+	}
+	if len(chat) == 0 {
+		_, err := io.WriteString(out, "_No messages._\n")
+		return err
+	}
+	for _, m := range chat {
+		sender := m.SenderName
+		if sender == "" {
+			sender = m.SenderID
+		}
+		// Indent continuation lines so multi-line messages stay in their list item
+		content := strings.ReplaceAll(strings.TrimRight(m.Content, "\n"), "\n", "\n  ")
+		if _, err := fmt.Fprintf(out, "- **%s** (%s): %s\n", sender, m.Timestamp.UTC().Format(time.RFC3339), content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAuditCSV(out io.Writer, audits []models.AuditLog) error {
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"timestamp", "user_id", "action", "details"})
+	for _, a := range audits {
+		cw.Write([]string{a.Timestamp.UTC().Format(time.RFC3339), a.UserID, a.Action, a.Details})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
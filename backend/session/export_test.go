@@ -0,0 +1,39 @@
+package session
+
+import (
+	"testing"
+
+	"example.com/collaborative-coding-editor/models"
+)
+
+func TestExportFileNames(t *testing.T) {
+	goFiles := []models.WorkspaceFile{
+		{Path: "util.go", Content: "package main\n"},
+		{Path: "cmd", Folder: true},
+		{Path: "cmd/run.go", Content: "package cmd\n"},
+		{Path: "README.md", Content: "# app\n"},
+	}
+	tests := []struct {
+		name      string
+		requested string
+		sess      *models.Session
+		want      string
+	}{
+		{"requested", "python3", &models.Session{Language: "go", Files: goFiles}, "main.py"},
+		{"saved with the session", "", &models.Session{Language: "rust", Files: goFiles}, "main.rs"},
+		{"from the other files", "", &models.Session{Files: goFiles}, "main.go"},
+		{"nothing to go by", "", &models.Session{}, "main.txt"},
+		{"unknown language", "cobol", &models.Session{Files: goFiles}, "main.txt"},
+	}
+	for _, tt := range tests {
+		language := exportLanguage(tt.requested, tt.sess)
+		if got := withExtension(MainFile(tt.sess), language); got != tt.want {
+			t.Errorf("%s: main file exported as %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Files keep the extension they have
+	if got := withExtension("lib/util.rb", "python3"); got != "lib/util.rb" {
+		t.Errorf("lib/util.rb exported as %q", got)
+	}
+}
@@ -0,0 +1,255 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Actions of a WorkspaceChange
+const (
+	WorkspaceCreate = "create"
+	WorkspaceMove   = "move"
+	WorkspaceDelete = "delete"
+)
+
+// WorkspaceChange describes a change to the file tree of a room
+type WorkspaceChange struct {
+	Action  string
+	Path    string
+	NewPath string               // Destination of a move
+	File    models.WorkspaceFile // Created file or folder
+	UserID  string
+	// Session revision saved with the change
+	Revision int64
+}
+
+// WorkspaceHook is called after the file tree of a room changed so that a
+// live room picks up the change. It is set by main to the collaboration service.
+var WorkspaceHook func(roomID string, change WorkspaceChange) error
+
+// ContentsHook returns the contents of the files of a live room by path,
+// nil if the room is not live. Changes to the file tree start from them so
+// that edits which were not autosaved yet are kept. It is set by main to
+// the collaboration service.
+var ContentsHook func(roomID string) map[string]string
+
+// WorkspaceResponse lists the files of a room
+type WorkspaceResponse struct {
+	MainFile string                 `json:"main_file"`
+	Revision int64                  `json:"revision"`
+	Files    []models.WorkspaceFile `json:"files"`
+}
+
+// CreateFileRequest creates a file or folder, missing parent folders are created too
+type CreateFileRequest struct {
+	Path    string `json:"path"`
+	Folder  bool   `json:"folder"`
+	Content string `json:"content"`
+}
+
+// RenameFileRequest renames a file or folder within its folder
+type RenameFileRequest struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
+// MoveFileRequest moves a file or folder into another folder, "" is the workspace root
+type MoveFileRequest struct {
+	Path   string `json:"path"`
+	Folder string `json:"folder"`
+}
+
+// ListFiles returns the files and folders of a room.
+func ListFiles(w http.ResponseWriter, r *http.Request) {
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
+		return
+	}
+	sess, err := LoadSession(roomID.Hex())
+	if err != nil {
+		http.Error(w, "Error retrieving session", http.StatusInternalServerError)
+		return
+	}
+	writeWorkspace(w, sess)
+}
+
+// CreateFile adds a file or folder to the workspace of a room.
+func CreateFile(w http.ResponseWriter, r *http.Request) {
+	var req CreateFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	p, err := CleanPath(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	change := &WorkspaceChange{Action: WorkspaceCreate, Path: p}
+	changeWorkspace(w, r, change, "file-create", fmt.Sprintf("Created %s.", p), func(ws *workspace) error {
+		if err := ws.create(p, req.Folder, req.Content); err != nil {
+			return err
+		}
+		change.File = ws.entries[p]
+		return nil
+	})
+}
+
+// RenameFile gives a file or folder a new name in the same folder.
+func RenameFile(w http.ResponseWriter, r *http.Request) {
+	var req RenameFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	from, err := CleanPath(req.Path)
+	if err != nil || req.Name == "" || strings.Contains(req.Name, "/") {
+		http.Error(w, ErrInvalidPath.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := CleanPath(path.Join(path.Dir(from), req.Name))
+	if err != nil || path.Dir(to) != path.Dir(from) {
+		http.Error(w, ErrInvalidPath.Error(), http.StatusBadRequest)
+		return
+	}
+
+	change := &WorkspaceChange{Action: WorkspaceMove, Path: from, NewPath: to}
+	changeWorkspace(w, r, change, "file-rename", fmt.Sprintf("Renamed %s to %s.", from, to), func(ws *workspace) error {
+		return ws.move(from, to)
+	})
+}
+
+// MoveFile moves a file or folder into another folder.
+func MoveFile(w http.ResponseWriter, r *http.Request) {
+	var req MoveFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	from, err := CleanPath(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := path.Base(from)
+	if req.Folder != "" {
+		folder, err := CleanPath(req.Folder)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = path.Join(folder, to)
+	}
+
+	change := &WorkspaceChange{Action: WorkspaceMove, Path: from, NewPath: to}
+	changeWorkspace(w, r, change, "file-move", fmt.Sprintf("Moved %s to %s.", from, to), func(ws *workspace) error {
+		if folder := path.Dir(to); folder != "." {
+			if entry, ok := ws.entries[folder]; !ok || !entry.Folder {
+				return ErrNotAFolder
+			}
+		}
+		return ws.move(from, to)
+	})
+}
+
+// DeleteFile removes a file, or a folder with everything inside it.
+func DeleteFile(w http.ResponseWriter, r *http.Request) {
+	p, err := CleanPath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	change := &WorkspaceChange{Action: WorkspaceDelete, Path: p}
+	changeWorkspace(w, r, change, "file-delete", fmt.Sprintf("Deleted %s.", p), func(ws *workspace) error {
+		return ws.remove(p)
+	})
+}
+
+// changeWorkspace applies a change to the file tree of the room, saves it
+// as a new revision, tells the live room and answers with the new tree.
+func changeWorkspace(w http.ResponseWriter, r *http.Request, change *WorkspaceChange, action, details string, apply func(ws *workspace) error) {
+	roomID, userID, ok := roomAccess(w, r, AccessWrite)
+	if !ok {
+		return
+	}
+
+	sess, err := updateWorkspace(roomID, userID, apply)
+	switch err {
+	case nil:
+	case ErrInvalidPath, ErrNotAFolder, ErrMainFile, ErrTooManyFiles, ErrMoveIntoSelf:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrFileNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case ErrFileExists, errWorkspaceBusy:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		log.Printf("Error saving workspace: %v", err)
+		http.Error(w, "Error saving workspace", http.StatusInternalServerError)
+		return
+	}
+
+	change.UserID = userID
+	change.Revision = sess.Revision
+	if WorkspaceHook != nil {
+		if err := WorkspaceHook(roomID.Hex(), *change); err != nil {
+			log.Printf("Error updating live room %s: %v", roomID.Hex(), err)
+		}
+	}
+	go addAuditLog(roomID, userID, action, details)
+
+	writeWorkspace(w, sess)
+}
+
+// updateWorkspace applies a change to the latest workspace of a room and
+// saves it, starting over if somebody else saved in between
+func updateWorkspace(roomID primitive.ObjectID, userID string, apply func(ws *workspace) error) (*models.Session, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		sess, err := LoadSession(roomID.Hex())
+		if err != nil {
+			return nil, err
+		}
+		ws := newWorkspace(sess)
+		if ContentsHook != nil {
+			ws.setContents(ContentsHook(roomID.Hex()))
+		}
+		if err := apply(ws); err != nil {
+			return nil, err
+		}
+
+		code, files := ws.fields()
+		fields := bson.M{"code": code, "main_file": ws.mainFile, "files": files}
+		base := int64(0)
+		if sess != nil {
+			base = sess.Revision
+		}
+		saved, err := storeSession(revisionFilter(roomID, base), sess == nil, fields, nil, userID, nil, false)
+		if err == mongo.ErrNoDocuments || mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		return saved, err
+	}
+	return nil, errWorkspaceBusy
+}
+
+func writeWorkspace(w http.ResponseWriter, sess *models.Session) {
+	resp := WorkspaceResponse{MainFile: MainFile(sess), Files: WorkspaceFiles(sess)}
+	if sess != nil {
+		resp.Revision = sess.Revision
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
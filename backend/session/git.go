@@ -0,0 +1,365 @@
+package session
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Branch holding the session history
+const gitBranch = "refs/heads/main"
+
+// Git object types as numbered in pack files
+const (
+	gitCommit = 1
+	gitTree   = 2
+	gitBlob   = 3
+)
+
+var gitTypeNames = map[int]string{gitCommit: "commit", gitTree: "tree", gitBlob: "blob"}
+
+type gitID [20]byte
+
+func (id gitID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type gitObject struct {
+	kind int
+	data []byte
+}
+
+// gitRepo builds git objects in memory, in the order they were first added
+type gitRepo struct {
+	objects map[gitID]gitObject
+	order   []gitID
+}
+
+func newGitRepo() *gitRepo {
+	return &gitRepo{objects: make(map[gitID]gitObject)}
+}
+
+func (g *gitRepo) add(kind int, data []byte) gitID {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", gitTypeNames[kind], len(data))
+	h.Write(data)
+	var id gitID
+	copy(id[:], h.Sum(nil))
+	if _, ok := g.objects[id]; !ok {
+		g.objects[id] = gitObject{kind: kind, data: data}
+		g.order = append(g.order, id)
+	}
+	return id
+}
+
+// tree stores the files, by slash separated path, as nested tree objects
+func (g *gitRepo) tree(files map[string]string) gitID {
+	type entry struct {
+		name string
+		mode string
+		id   gitID
+	}
+	var entries []entry
+	subtrees := make(map[string]map[string]string)
+	for p, content := range files {
+		if i := strings.Index(p, "/"); i >= 0 {
+			dir := p[:i]
+			if subtrees[dir] == nil {
+				subtrees[dir] = make(map[string]string)
+			}
+			subtrees[dir][p[i+1:]] = content
+			continue
+		}
+		entries = append(entries, entry{name: p, mode: "100644", id: g.add(gitBlob, []byte(content))})
+	}
+	for dir, sub := range subtrees {
+		entries = append(entries, entry{name: dir, mode: "40000", id: g.tree(sub)})
+	}
+
+	// Git orders entries by name, comparing trees as if they ended with a slash
+	key := func(e entry) string {
+		if e.mode == "40000" {
+			return e.name + "/"
+		}
+		return e.name
+	}
+	sort.Slice(entries, func(i, j int) bool { return key(entries[i]) < key(entries[j]) })
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%s %s\x00", e.mode, e.name)
+		buf.Write(e.id[:])
+	}
+	return g.add(gitTree, buf.Bytes())
+}
+
+func (g *gitRepo) commit(tree gitID, parent *gitID, author string, when time.Time, message string) gitID {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tree %s\n", tree)
+	if parent != nil {
+		fmt.Fprintf(&buf, "parent %s\n", parent)
+	}
+	stamp := fmt.Sprintf("%d %s", when.Unix(), when.Format("-0700"))
+	fmt.Fprintf(&buf, "author %s %s\ncommitter %s %s\n\n%s\n", author, stamp, author, stamp, message)
+	return g.add(gitCommit, buf.Bytes())
+}
+
+// writePack writes every object as a version 2 pack file without deltas
+func (g *gitRepo) writePack(w io.Writer) error {
+	h := sha1.New()
+	out := io.MultiWriter(w, h)
+
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(g.order)))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	for _, id := range g.order {
+		obj := g.objects[id]
+		// Type and size: 3 bits of type and 4 bits of size, then 7 bits per byte
+		size := len(obj.data)
+		b := []byte{byte(obj.kind<<4) | byte(size&0x0f)}
+		size >>= 4
+		for size > 0 {
+			b[len(b)-1] |= 0x80
+			b = append(b, byte(size&0x7f))
+			size >>= 7
+		}
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+		zw := zlib.NewWriter(out)
+		if _, err := zw.Write(obj.data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
+
+// writeBundle writes a git bundle that can be cloned with git clone
+func (g *gitRepo) writeBundle(w io.Writer, head gitID) error {
+	if _, err := fmt.Fprintf(w, "# v2 git bundle\n%s %s\n%s HEAD\n\n", head, gitBranch, head); err != nil {
+		return err
+	}
+	return g.writePack(w)
+}
+
+// writeBareRepo writes a bare repository with loose objects as a tar.gz archive
+func (g *gitRepo) writeBareRepo(w io.Writer, dir string, head gitID, when time.Time) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	file := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: dir + "/" + name, Mode: 0644, Size: int64(len(data)), ModTime: when, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	files := []struct {
+		name string
+		data string
+	}{
+		{"HEAD", "ref: " + gitBranch + "\n"},
+		{"config", "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = true\n"},
+		{"description", "Collaborative session history\n"},
+		{gitBranch, head.String() + "\n"},
+	}
+	for _, f := range files {
+		if err := file(f.name, []byte(f.data)); err != nil {
+			return err
+		}
+	}
+	for _, id := range g.order {
+		obj := g.objects[id]
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		fmt.Fprintf(zw, "%s %d\x00", gitTypeNames[obj.kind], len(obj.data))
+		zw.Write(obj.data)
+		zw.Close()
+		hexID := id.String()
+		if err := file("objects/"+hexID[:2]+"/"+hexID[2:], buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ExportGit returns the history of a room as a git repository with one
+// commit per saved revision. ?format=bundle (default) returns a git bundle,
+// ?format=tar a bare repository as tar.gz.
+func ExportGit(w http.ResponseWriter, r *http.Request) {
+	roomID, userID, ok := roomAccess(w, r, AccessRead)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "bundle"
+	}
+	if format != "bundle" && format != "tar" {
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.M{"revision": 1})
+	cursor, err := auth.GetCollection("session_versions").Find(ctx, bson.M{"room_id": roomID}, opts)
+	if err != nil {
+		http.Error(w, "Error retrieving versions", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var versions []models.SessionVersion
+	if err := cursor.All(ctx, &versions); err != nil {
+		http.Error(w, "Error retrieving versions", http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Session has no saved history", http.StatusNotFound)
+		return
+	}
+
+	versions = gitRevisions(versions)
+	authors := gitAuthors(ctx, versions)
+	repo := newGitRepo()
+	var head *gitID
+	for _, v := range versions {
+		files := make(map[string]string)
+		for _, f := range WorkspaceFiles(&models.Session{Code: v.Code, MainFile: v.MainFile, Files: v.Files}) {
+			if f.Folder {
+				// Git does not track folders, keep empty ones with a placeholder
+				files[f.Path+"/.gitkeep"] = ""
+				continue
+			}
+			files[f.Path] = f.Content
+		}
+		for p := range files {
+			if strings.HasSuffix(p, "/.gitkeep") && hasFilesIn(files, strings.TrimSuffix(p, ".gitkeep")) {
+				delete(files, p)
+			}
+		}
+		id := repo.commit(repo.tree(files), head, authors[v.UpdatedBy], v.CreatedAt, fmt.Sprintf("Revision %d", v.Revision))
+		head = &id
+	}
+
+	name := exportName("", roomID)
+
+	if format == "bundle" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".bundle"))
+		err = repo.writeBundle(w, *head)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".git.tar.gz"))
+		err = repo.writeBareRepo(w, name+".git", *head, time.Now())
+	}
+	if err != nil {
+		log.Printf("Error writing git export: %v", err)
+		return
+	}
+	go addAuditLog(roomID, userID, "export", fmt.Sprintf("Session history exported as a git %s with %d commits.", format, len(versions)))
+}
+
+// gitRevisions -> the versions that become commits. A run of autosaves
+// becomes a single commit of its last version.
+func gitRevisions(versions []models.SessionVersion) []models.SessionVersion {
+	kept := make([]models.SessionVersion, 0, len(versions))
+	for i, v := range versions {
+		if v.Autosave && i+1 < len(versions) && versions[i+1].Autosave {
+			continue
+		}
+		kept = append(kept, v)
+	}
+	return kept
+}
+
+// hasFilesIn -> true if a file other than the placeholder lives under dir
+func hasFilesIn(files map[string]string, dir string) bool {
+	for p := range files {
+		if strings.HasPrefix(p, dir) && p != dir+".gitkeep" {
+			return true
+		}
+	}
+	return false
+}
+
+// gitAuthors -> "Name <email>" of every user who saved a version
+func gitAuthors(ctx context.Context, versions []models.SessionVersion) map[string]string {
+	authors := make(map[string]string)
+	var ids []primitive.ObjectID
+	for _, v := range versions {
+		if _, ok := authors[v.UpdatedBy]; ok {
+			continue
+		}
+		name := v.UpdatedBy
+		if name == "" {
+			name = "unknown"
+		}
+		authors[v.UpdatedBy] = name + " <>"
+		if id, err := primitive.ObjectIDFromHex(v.UpdatedBy); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return authors
+	}
+
+	cursor, err := auth.GetCollection("users").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		log.Printf("Error retrieving commit authors: %v", err)
+		return authors
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			continue
+		}
+		authors[user.ID.Hex()] = fmt.Sprintf("%s <%s>", gitSafe(user.Username), gitSafe(user.Email))
+	}
+	return authors
+}
+
+// gitSafe strips characters that would break an author line
+func gitSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '<', '>', '\n', '\x00':
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,132 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"example.com/collaborative-coding-editor/models"
+)
+
+// Ids as computed by git for the same files and commit
+const (
+	testTreeID   = "6cab7a88e26590f4b9a9448810639efd15c9ce34"
+	testCommitID = "b59d722e4c4c37c5f611ec7355122f5ad73133b9"
+)
+
+func testRepo() (*gitRepo, gitID) {
+	g := newGitRepo()
+	tree := g.tree(map[string]string{
+		"main":        "print(1)\n",
+		"src/util.py": "def util(): pass\n",
+		"src-notes":   "",
+	})
+	head := g.commit(tree, nil, "Ada <ada@example.com>", time.Unix(1700000000, 0).UTC(), "Revision 1")
+	return g, head
+}
+
+func TestGitObjectIDs(t *testing.T) {
+	g, head := testRepo()
+	if head.String() != testCommitID {
+		t.Fatalf("commit %s, want %s", head, testCommitID)
+	}
+	if tree := g.order[len(g.order)-2]; tree.String() != testTreeID {
+		t.Fatalf("tree %s, want %s", tree, testTreeID)
+	}
+	// Adding an object again keeps a single copy
+	before := len(g.order)
+	g.add(gitBlob, []byte("print(1)\n"))
+	if len(g.order) != before {
+		t.Fatalf("duplicate object added")
+	}
+}
+
+func TestGitPackReadsBack(t *testing.T) {
+	g, _ := testRepo()
+	var buf bytes.Buffer
+	if err := g.writePack(&buf); err != nil {
+		t.Fatal(err)
+	}
+	pack := buf.Bytes()
+
+	sum := sha1.Sum(pack[:len(pack)-20])
+	if !bytes.Equal(sum[:], pack[len(pack)-20:]) {
+		t.Fatal("pack checksum does not match")
+	}
+	if string(pack[:4]) != "PACK" || binary.BigEndian.Uint32(pack[4:]) != 2 {
+		t.Fatalf("pack header %q", pack[:8])
+	}
+	count := int(binary.BigEndian.Uint32(pack[8:]))
+	if count != len(g.order) {
+		t.Fatalf("pack holds %d objects, want %d", count, len(g.order))
+	}
+
+	r := bufio.NewReader(bytes.NewReader(pack[12 : len(pack)-20]))
+	for i := 0; i < count; i++ {
+		c, _ := r.ReadByte()
+		kind, size, shift := int(c>>4)&7, int(c&0x0f), 4
+		for c&0x80 != 0 {
+			c, _ = r.ReadByte()
+			size |= int(c&0x7f) << shift
+			shift += 7
+		}
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			t.Fatalf("object %d: %v", i, err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("object %d: %v", i, err)
+		}
+		want := g.objects[g.order[i]]
+		if kind != want.kind || size != len(data) || !bytes.Equal(data, want.data) {
+			t.Fatalf("object %d: type %d size %d %q, want type %d %q", i, kind, size, data, want.kind, want.data)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("data left after the last object")
+	}
+}
+
+func TestGitPackLargeObjectSize(t *testing.T) {
+	// Sizes above 15 bytes continue in further bytes of the header
+	g := newGitRepo()
+	g.add(gitBlob, bytes.Repeat([]byte("x"), 1000))
+	var buf bytes.Buffer
+	if err := g.writePack(&buf); err != nil {
+		t.Fatal(err)
+	}
+	header := buf.Bytes()[12:14]
+	if header[0] != 0x80|gitBlob<<4|1000&0x0f || header[1] != 1000>>4 {
+		t.Fatalf("object header % x", header)
+	}
+}
+
+func TestGitRevisionsCollapseAutosaves(t *testing.T) {
+	versions := []models.SessionVersion{
+		{Revision: 1},
+		{Revision: 2, Autosave: true},
+		{Revision: 3, Autosave: true},
+		{Revision: 4},
+		{Revision: 5, Autosave: true},
+		{Revision: 6, Autosave: true},
+	}
+	var got []int64
+	for _, v := range gitRevisions(versions) {
+		got = append(got, v.Revision)
+	}
+	want := []int64{1, 3, 4, 6}
+	if len(got) != len(want) {
+		t.Fatalf("commits of revisions %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("commits of revisions %v, want %v", got, want)
+		}
+	}
+}
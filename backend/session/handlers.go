@@ -8,10 +8,7 @@ import (
 	"time"
 
 	"example.com/collaborative-coding-editor/auth"
-	"example.com/collaborative-coding-editor/middleware"
 	"example.com/collaborative-coding-editor/models"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -21,6 +18,18 @@ import (
 type SaveSessionRequest struct {
 	RoomID string `json:"room_id"` // Room ID (as hex string) to which this session belongs.
 	Code   string `json:"code"`    // The current code in the editor.
+	// Compiler language of the code, kept with the session if set
+	Language string `json:"language,omitempty"`
+	// Revision the code was edited from. When set, the save is rejected with
+	// 409 Conflict if the session was saved by somebody else in the meantime.
+	BaseRevision *int64 `json:"base_revision,omitempty"`
+}
+
+// SaveConflictResponse is returned with 409 Conflict when a save is based on an outdated revision.
+type SaveConflictResponse struct {
+	Message string          `json:"message"`
+	Current *models.Session `json:"current"` // The session as currently saved
+	Merge   MergeResult     `json:"merge"`   // The saved code and the request's code merged from the base revision
 }
 
 // SaveSession creates or updates the session state for a given room.
@@ -41,60 +50,80 @@ func SaveSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve user info from JWT (set by middleware)
-	claims, ok := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+	// Only members of an open room may change its code
+	userID, ok := authorize(w, r, roomID, AccessWrite)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	userID, _ := claims["user_id"].(string)
-
-	sessionCollection := auth.GetCollection("sessions")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
-	// Try to update an existing session for this room.
-	filter := bson.M{"room_id": roomID}
-	update := bson.M{
-		"$set": bson.M{
-			"code":        req.Code,
-			"last_saved":  time.Now(),
-			"updated_by":  userID,
-			"modified_at": time.Now(),
-		},
-		"$setOnInsert": bson.M{
-			"created_at": time.Now(),
-		},
+	// Update the existing session for this room, or create it.
+	var sess *models.Session
+	if req.BaseRevision != nil {
+		sess, err = StoreSessionAt(roomID, *req.BaseRevision, req.Code, req.Language, userID)
+	} else {
+		sess, err = StoreSession(roomID, req.Code, req.Language, userID)
+	}
+	if err == ErrStaleRevision {
+		writeSaveConflict(w, roomID, *req.BaseRevision, req.Code)
+		return
 	}
-	opts := true
-	_, err = sessionCollection.UpdateOne(ctx, filter, update, &options.UpdateOptions{
-		Upsert: &opts,
-	})
 	if err != nil {
 		log.Printf("Error saving session: %v", err)
 		http.Error(w, "Error saving session", http.StatusInternalServerError)
 		return
 	}
 
+	// The live room continues from the saved code, its autosave would overwrite it otherwise
+	if RestoreHook != nil {
+		if err := RestoreHook(sess, userID); err != nil {
+			log.Printf("Error updating live room %s: %v", roomID.Hex(), err)
+		}
+	}
+
 	// Optionally, add an audit log entry for auto-save.
-	go addAuditLog(roomID, userID, "auto-save", "Session auto-saved.")
+	go func() {
+		addAuditLog(roomID, userID, "auto-save", saveDetails(sess, "Session auto-saved."))
+	}()
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Session saved successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Session saved successfully", "revision": sess.Revision})
 }
 
-// GetSession retrieves the current session state for a given room.
-func GetSession(w http.ResponseWriter, r *http.Request) {
-	// Expect room_id in the URL.
-	vars := mux.Vars(r)
-	roomIDStr := vars["room_id"]
-	if roomIDStr == "" {
-		http.Error(w, "RoomID is required", http.StatusBadRequest)
+// writeSaveConflict answers a stale save with the current session and a
+// three-way merge of the saved code and the request's code
+func writeSaveConflict(w http.ResponseWriter, roomID primitive.ObjectID, baseRevision int64, code string) {
+	current, err := LoadSession(roomID.Hex())
+	if err != nil || current == nil {
+		http.Error(w, "Error loading session", http.StatusInternalServerError)
 		return
 	}
-	roomID, err := primitive.ObjectIDFromHex(roomIDStr)
+
+	// Without the base revision everything the two sides differ in is a conflict
+	base := ""
+	version, err := LoadVersion(roomID, baseRevision)
 	if err != nil {
-		http.Error(w, "Invalid RoomID", http.StatusBadRequest)
+		http.Error(w, "Error loading session", http.StatusInternalServerError)
+		return
+	}
+	if version != nil {
+		base = version.Code
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(SaveConflictResponse{
+		Message: "Session was modified since the base revision",
+		Current: current,
+		Merge:   Merge(base, current.Code, code),
+	})
+}
+
+// GetSession retrieves the current session state for a given room.
+func GetSession(w http.ResponseWriter, r *http.Request) {
+	// Expect room_id in the URL.
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
 		return
 	}
 
@@ -103,7 +132,7 @@ func GetSession(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	var sess models.Session
-	err = sessionCollection.FindOne(ctx, bson.M{"room_id": roomID}).Decode(&sess)
+	err := sessionCollection.FindOne(ctx, bson.M{"room_id": roomID}).Decode(&sess)
 	if err != nil {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
@@ -116,15 +145,8 @@ func GetSession(w http.ResponseWriter, r *http.Request) {
 // ExportSession exports the session state along with its audit trail for a given room.
 func ExportSession(w http.ResponseWriter, r *http.Request) {
 	// Get the room_id from the URL.
-	vars := mux.Vars(r)
-	roomIDStr := vars["room_id"]
-	if roomIDStr == "" {
-		http.Error(w, "RoomID is required", http.StatusBadRequest)
-		return
-	}
-	roomID, err := primitive.ObjectIDFromHex(roomIDStr)
-	if err != nil {
-		http.Error(w, "Invalid RoomID", http.StatusBadRequest)
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
 		return
 	}
 
@@ -135,14 +157,14 @@ func ExportSession(w http.ResponseWriter, r *http.Request) {
 
 	// Retrieve session state.
 	var sess models.Session
-	err = sessionCollection.FindOne(ctx, bson.M{"room_id": roomID}).Decode(&sess)
+	err := sessionCollection.FindOne(ctx, bson.M{"room_id": roomID}).Decode(&sess)
 	if err != nil {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
 
 	// Retrieve audit logs for this session.
-	cursor, err := auditCollection.Find(ctx, bson.M{"room_id": roomID})
+	cursor, err := auditCollection.Find(ctx, bson.M{"room_id": roomID}, options.Find().SetSort(bson.M{"timestamp": 1}))
 	if err != nil {
 		http.Error(w, "Error retrieving audit logs", http.StatusInternalServerError)
 		return
@@ -159,6 +181,11 @@ func ExportSession(w http.ResponseWriter, r *http.Request) {
 		audits = append(audits, a)
 	}
 
+	if r.URL.Query().Get("format") == "zip" {
+		exportZip(w, r, &sess, audits)
+		return
+	}
+
 	// Build the export payload.
 	exportPayload := struct {
 		Session   models.Session    `json:"session"`
@@ -196,13 +223,11 @@ func LogAudit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve user from JWT.
-	claims, ok := r.Context().Value(middleware.UserKey).(jwt.MapClaims)
+	// Retrieve user from JWT, only members of an open room add entries.
+	userID, ok := authorize(w, r, roomID, AccessWrite)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	userID, _ := claims["user_id"].(string)
 
 	if err := addAuditLog(roomID, userID, req.Action, req.Details); err != nil {
 		http.Error(w, "Error logging audit event", http.StatusInternalServerError)
@@ -215,15 +240,8 @@ func LogAudit(w http.ResponseWriter, r *http.Request) {
 
 // GetAuditLogs retrieves audit logs for a given room.
 func GetAuditLogs(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	roomIDStr := vars["room_id"]
-	if roomIDStr == "" {
-		http.Error(w, "RoomID is required", http.StatusBadRequest)
-		return
-	}
-	roomID, err := primitive.ObjectIDFromHex(roomIDStr)
-	if err != nil {
-		http.Error(w, "Invalid RoomID", http.StatusBadRequest)
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
 		return
 	}
 
@@ -0,0 +1,293 @@
+package session
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Limits of an imported archive
+const (
+	maxImportUpload = 10 << 20 // compressed archive
+	maxImportSize   = 20 << 20 // all files uncompressed
+	maxImportFile   = 2 << 20  // a single file uncompressed
+)
+
+var (
+	ErrUnknownArchive = errors.New("archive must be a ZIP or tar.gz file")
+	ErrImportTooLarge = errors.New("archive is too large")
+	ErrEmptyArchive   = errors.New("archive contains no files")
+)
+
+// ImportResponse is the imported workspace and the archive entries that were left out
+type ImportResponse struct {
+	WorkspaceResponse
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// archiveFile is a regular file read from an archive
+type archiveFile struct {
+	name    string
+	content []byte
+}
+
+// ImportWorkspace replaces the workspace of a room with the files of an
+// uploaded ZIP or tar.gz archive, sent as the "file" field of a multipart
+// form. The main file can be chosen with ?main=, otherwise a root file
+// named main.* or the first file is used.
+func ImportWorkspace(w http.ResponseWriter, r *http.Request) {
+	roomID, userID, ok := roomAccess(w, r, AccessWrite)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportUpload+1<<20)
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "An archive is required in the file field", http.StatusBadRequest)
+		return
+	}
+	defer upload.Close()
+	data, err := io.ReadAll(io.LimitReader(upload, maxImportUpload+1))
+	if err != nil {
+		http.Error(w, "Error reading upload", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxImportUpload {
+		http.Error(w, ErrImportTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	files, err := readArchive(data)
+	switch err {
+	case nil:
+	case ErrImportTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, skipped, err := importedWorkspace(files, r.URL.Query().Get("main"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code, entries := ws.fields()
+	fields := bson.M{"code": code, "main_file": ws.mainFile, "files": entries}
+	sess, err := storeSession(bson.M{"room_id": roomID}, true, fields, nil, userID, nil, false)
+	if err != nil {
+		log.Printf("Error importing workspace: %v", err)
+		http.Error(w, "Error saving workspace", http.StatusInternalServerError)
+		return
+	}
+
+	if RestoreHook != nil {
+		if err := RestoreHook(sess, userID); err != nil {
+			log.Printf("Error updating live room %s: %v", roomID.Hex(), err)
+		}
+	}
+	imported := len(files) - len(skipped)
+	go addAuditLog(roomID, userID, "import", fmt.Sprintf("Imported %d files from %s as revision %d.", imported, header.Filename, sess.Revision))
+
+	resp := ImportResponse{
+		WorkspaceResponse: WorkspaceResponse{MainFile: MainFile(sess), Revision: sess.Revision, Files: WorkspaceFiles(sess)},
+		Skipped:           skipped,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readArchive returns the regular files of a ZIP or tar.gz archive
+func readArchive(data []byte) ([]archiveFile, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return readZip(data)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return readTarGz(data)
+	}
+	return nil, ErrUnknownArchive
+}
+
+func readZip(data []byte) ([]archiveFile, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, ErrUnknownArchive
+	}
+	var files []archiveFile
+	total := 0
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if len(files) >= maxWorkspaceEntries {
+			return nil, ErrTooManyFiles
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := readLimited(rc, &total)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: f.Name, content: content})
+	}
+	return files, nil
+}
+
+func readTarGz(data []byte) ([]archiveFile, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnknownArchive
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	var files []archiveFile
+	total := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, ErrUnknownArchive
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if len(files) >= maxWorkspaceEntries {
+			return nil, ErrTooManyFiles
+		}
+		content, err := readLimited(tr, &total)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: hdr.Name, content: content})
+	}
+}
+
+// readLimited reads one file, enforcing the per-file and total size limits
+// on what is actually decompressed rather than on the sizes the archive claims
+func readLimited(r io.Reader, total *int) ([]byte, error) {
+	content, err := io.ReadAll(io.LimitReader(r, maxImportFile+1))
+	if err != nil {
+		return nil, ErrUnknownArchive
+	}
+	*total += len(content)
+	if len(content) > maxImportFile || *total > maxImportSize {
+		return nil, ErrImportTooLarge
+	}
+	return content, nil
+}
+
+// importedWorkspace builds a workspace from archive files. A single folder
+// holding everything is dropped, and entries with unsafe paths or binary
+// content are skipped.
+func importedWorkspace(files []archiveFile, mainFile string) (*workspace, []string, error) {
+	ws := &workspace{entries: make(map[string]models.WorkspaceFile)}
+	var skipped []string
+	paths := make(map[string]string)
+	for _, f := range files {
+		p, err := CleanPath(f.name)
+		if err != nil || isJunk(p) {
+			skipped = append(skipped, f.name)
+			continue
+		}
+		if !utf8.Valid(f.content) || bytes.IndexByte(f.content, 0) >= 0 {
+			skipped = append(skipped, f.name)
+			continue
+		}
+		paths[p] = string(f.content)
+	}
+	if len(paths) == 0 {
+		return nil, skipped, ErrEmptyArchive
+	}
+
+	// Sorted, a file and a folder of the same name always resolve the same way
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	root := commonRoot(paths)
+	names := make([]string, 0, len(paths))
+	for _, p := range sorted {
+		name := strings.TrimPrefix(p, root)
+		if err := ws.create(name, false, paths[p]); err == ErrTooManyFiles {
+			return nil, skipped, err
+		} else if err != nil {
+			// A file where a folder is needed, or the other way round
+			skipped = append(skipped, p)
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, skipped, ErrEmptyArchive
+	}
+	sort.Strings(names)
+	sort.Strings(skipped)
+
+	if mainFile != "" {
+		p, err := CleanPath(mainFile)
+		if err != nil {
+			return nil, skipped, err
+		}
+		if entry, ok := ws.entries[p]; !ok || entry.Folder {
+			return nil, skipped, fmt.Errorf("main file %s is not in the archive", p)
+		}
+		ws.mainFile = p
+		return ws, skipped, nil
+	}
+	ws.mainFile = names[0]
+	for _, name := range names {
+		if !strings.Contains(name, "/") && strings.TrimSuffix(name, path.Ext(name)) == DefaultMainFile {
+			ws.mainFile = name
+			break
+		}
+	}
+	return ws, skipped, nil
+}
+
+// commonRoot -> "dir/" if every path is inside the same top-level folder
+func commonRoot(paths map[string]string) string {
+	root := ""
+	for p := range paths {
+		i := strings.Index(p, "/")
+		if i < 0 {
+			return ""
+		}
+		if root == "" {
+			root = p[:i+1]
+		} else if p[:i+1] != root {
+			return ""
+		}
+	}
+	return root
+}
+
+// isJunk -> true for metadata files archivers add next to the real ones
+func isJunk(p string) bool {
+	base := path.Base(p)
+	return strings.HasPrefix(p, "__MACOSX/") || base == ".DS_Store" || strings.HasPrefix(base, "._")
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImportedWorkspaceCollisionsAreDeterministic(t *testing.T) {
+	// "lib" is a file in one entry and a folder in another
+	files := []archiveFile{
+		{name: "project/lib/util.py", content: []byte("def util(): pass\n")},
+		{name: "project/lib", content: []byte("not a folder\n")},
+		{name: "project/main.py", content: []byte("print(1)\n")},
+		{name: "project/.DS_Store", content: []byte("junk")},
+		{name: "project/image.bin", content: []byte{0, 1, 2}},
+	}
+
+	var first *workspace
+	var firstSkipped []string
+	for i := 0; i < 20; i++ {
+		// The archive order must not matter either
+		ordered := append([]archiveFile(nil), files...)
+		if i%2 == 1 {
+			for l, r := 0, len(ordered)-1; l < r; l, r = l+1, r-1 {
+				ordered[l], ordered[r] = ordered[r], ordered[l]
+			}
+		}
+		ws, skipped, err := importedWorkspace(ordered, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first, firstSkipped = ws, skipped
+			continue
+		}
+		if !reflect.DeepEqual(ws.entries, first.entries) || !reflect.DeepEqual(skipped, firstSkipped) {
+			t.Fatalf("import %d: entries %v skipped %v, want %v and %v", i, ws.entries, skipped, first.entries, firstSkipped)
+		}
+	}
+
+	if first.mainFile != "main.py" {
+		t.Fatalf("main file %q, want main.py", first.mainFile)
+	}
+	if entry, ok := first.entries["lib"]; !ok || entry.Folder {
+		t.Fatalf("lib = %+v, want the file that sorts first", entry)
+	}
+	want := []string{"project/.DS_Store", "project/image.bin", "project/lib/util.py"}
+	if !reflect.DeepEqual(firstSkipped, want) {
+		t.Fatalf("skipped %v, want %v", firstSkipped, want)
+	}
+}
+
+func TestImportedWorkspaceMainFile(t *testing.T) {
+	files := []archiveFile{
+		{name: "src/app.go", content: []byte("package main\n")},
+		{name: "README.md", content: []byte("# app\n")},
+	}
+	ws, _, err := importedWorkspace(files, "src/app.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.mainFile != "src/app.go" || ws.entries["src"].Folder != true {
+		t.Fatalf("main file %q, entries %v", ws.mainFile, ws.entries)
+	}
+	if _, _, err := importedWorkspace(files, "missing.go"); err == nil {
+		t.Fatal("main file outside the archive accepted")
+	}
+	if _, _, err := importedWorkspace([]archiveFile{{name: "../evil", content: []byte("x")}}, ""); err != ErrEmptyArchive {
+		t.Fatalf("error = %v, want ErrEmptyArchive", err)
+	}
+}
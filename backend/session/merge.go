@@ -0,0 +1,98 @@
+package session
+
+import "strings"
+
+// Markers around the two sides of a merge conflict
+const (
+	conflictStart = "<<<<<<< current\n"
+	conflictSep   = "=======\n"
+	conflictEnd   = ">>>>>>> yours\n"
+)
+
+// MergeResult is the outcome of a three-way merge
+type MergeResult struct {
+	Code      string `json:"code"`      // Merged code, with conflict markers where both sides changed the same lines
+	Conflicts int    `json:"conflicts"` // Number of conflicting regions
+}
+
+// Merge combines the changes made from base to current and from base to
+// yours line by line. Regions changed differently on both sides are kept
+// with git style conflict markers, the current copy first.
+func Merge(base, current, yours string) MergeResult {
+	baseLines := splitLines(base)
+	currentLines := splitLines(current)
+	yourLines := splitLines(yours)
+
+	matchCurrent := matchLines(baseLines, currentLines)
+	matchYours := matchLines(baseLines, yourLines)
+
+	var out strings.Builder
+	var result MergeResult
+	i, c, y := 0, 0, 0
+	for {
+		// Next base line kept unchanged on both sides
+		k := i
+		for k < len(baseLines) && (matchCurrent[k] < 0 || matchYours[k] < 0) {
+			k++
+		}
+		cEnd, yEnd := len(currentLines), len(yourLines)
+		if k < len(baseLines) {
+			cEnd, yEnd = matchCurrent[k], matchYours[k]
+		}
+
+		if k > i || cEnd > c || yEnd > y {
+			baseChunk := baseLines[i:k]
+			currentChunk := currentLines[c:cEnd]
+			yourChunk := yourLines[y:yEnd]
+			switch {
+			case equalLines(currentChunk, baseChunk):
+				writeLines(&out, yourChunk)
+			case equalLines(yourChunk, baseChunk), equalLines(currentChunk, yourChunk):
+				writeLines(&out, currentChunk)
+			default:
+				result.Conflicts++
+				out.WriteString(conflictStart)
+				writeLines(&out, currentChunk)
+				terminate(&out)
+				out.WriteString(conflictSep)
+				writeLines(&out, yourChunk)
+				terminate(&out)
+				out.WriteString(conflictEnd)
+			}
+		}
+
+		if k == len(baseLines) {
+			break
+		}
+		out.WriteString(baseLines[k])
+		i, c, y = k+1, cEnd+1, yEnd+1
+	}
+
+	result.Code = out.String()
+	return result
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(out *strings.Builder, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+// terminate ends the output with a newline so a conflict marker starts its own line
+func terminate(out *strings.Builder) {
+	if s := out.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		out.WriteString("\n")
+	}
+}
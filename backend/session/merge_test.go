@@ -0,0 +1,46 @@
+package session
+
+import "testing"
+
+func TestMerge(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name      string
+		current   string
+		yours     string
+		want      string
+		conflicts int
+	}{
+		{"unchanged", base, base, base, 0},
+		{"only current", "a\nB\nc\nd\ne\n", base, "a\nB\nc\nd\ne\n", 0},
+		{"only yours", base, "a\nb\nc\nd\nE\n", "a\nb\nc\nd\nE\n", 0},
+		{"separate lines", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", 0},
+		{"same change", "a\nb\nX\nd\ne\n", "a\nb\nX\nd\ne\n", "a\nb\nX\nd\ne\n", 0},
+		{"insert and delete", "a\nb\nnew\nc\nd\ne\n", "a\nb\nc\ne\n", "a\nb\nnew\nc\ne\n", 0},
+		{
+			"same line", "a\nb\nmine\nd\ne\n", "a\nb\ntheirs\nd\ne\n",
+			"a\nb\n<<<<<<< current\nmine\n=======\ntheirs\n>>>>>>> yours\nd\ne\n", 1,
+		},
+		{
+			"without final newline", "a\nb\nc\nd\nX", "a\nb\nc\nd\nY",
+			"a\nb\nc\nd\n<<<<<<< current\nX\n=======\nY\n>>>>>>> yours\n", 1,
+		},
+	}
+	for _, tt := range tests {
+		got := Merge(base, tt.current, tt.yours)
+		if got.Code != tt.want || got.Conflicts != tt.conflicts {
+			t.Errorf("%s: merged %q with %d conflicts, want %q with %d", tt.name, got.Code, got.Conflicts, tt.want, tt.conflicts)
+		}
+	}
+}
+
+func TestMergeWithoutBase(t *testing.T) {
+	// A lost base revision makes every difference a conflict
+	got := Merge("", "same\nmine\n", "same\ntheirs\n")
+	if got.Conflicts != 1 {
+		t.Fatalf("merged %q with %d conflicts, want 1", got.Code, got.Conflicts)
+	}
+	if got := Merge("", "same\n", "same\n"); got.Code != "same\n" || got.Conflicts != 0 {
+		t.Fatalf("equal sides merged to %q with %d conflicts", got.Code, got.Conflicts)
+	}
+}
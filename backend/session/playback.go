@@ -0,0 +1,196 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Most events returned by one playback, later ones are cut off
+const maxPlaybackEvents = 100000
+
+// Playback is the recorded history of a room, starting at a snapshot of
+// its workspace. Users are listed once and referred to by id in the events.
+type Playback struct {
+	RoomID    string            `json:"room_id"`
+	Start     time.Time         `json:"start"`
+	Duration  int64             `json:"duration"` // Milliseconds from the first to the last event
+	Users     map[string]string `json:"users"`    // Names by user_id
+	Events    []PlaybackFrame   `json:"events"`
+	Truncated bool              `json:"truncated,omitempty"` // Events after the last one were left out
+}
+
+// PlaybackFrame is one event of a playback
+type PlaybackFrame struct {
+	Offset  int64                  `json:"t"`    // Milliseconds since Start
+	Type    string                 `json:"type"` // "snapshot", "edit", "file_created", "file_moved", "file_deleted" or "chat"
+	User    string                 `json:"user,omitempty"`
+	Path    string                 `json:"path,omitempty"`
+	NewPath string                 `json:"new_path,omitempty"`
+	Ops     []models.TextOp        `json:"ops,omitempty"`
+	Files   []models.WorkspaceFile `json:"files,omitempty"`
+	Text    string                 `json:"text,omitempty"` // Chat message
+}
+
+// GetPlayback returns the edits, file changes and chat messages of a room
+// in the order they happened. ?from= and ?to= (RFC 3339) limit the time
+// range, playback then starts at the last snapshot before from.
+func GetPlayback(w http.ResponseWriter, r *http.Request) {
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
+		return
+	}
+	from, to, err := PlaybackRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	playback, err := LoadPlayback(roomID, from, to)
+	if err != nil {
+		http.Error(w, "Error retrieving playback", http.StatusInternalServerError)
+		return
+	}
+	if playback == nil {
+		http.Error(w, "No playback recorded for this session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(playback)
+}
+
+// PlaybackRange -> time range of a playback from the ?from= and ?to=
+// query parameters, zero if not given
+func PlaybackRange(r *http.Request) (from, to time.Time, err error) {
+	for name, at := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		if *at, err = time.Parse(time.RFC3339, value); err != nil {
+			return from, to, fmt.Errorf("invalid %s timestamp", name)
+		}
+	}
+	return from, to, nil
+}
+
+// LoadPlayback returns the recorded history of a room between from and
+// to, either of which may be zero. It returns nil if nothing was recorded.
+func LoadPlayback(roomID primitive.ObjectID, from, to time.Time) (*Playback, error) {
+	eventCollection := auth.GetCollection("playback_events")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"room_id": roomID}
+	if !from.IsZero() {
+		// Replaying has to start from a full copy of the workspace
+		var snapshot models.PlaybackEvent
+		opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "seq", Value: -1}})
+		err := eventCollection.FindOne(ctx, bson.M{"room_id": roomID, "type": "snapshot", "timestamp": bson.M{"$lte": from}}, opts).Decode(&snapshot)
+		switch {
+		case err == nil:
+			filter["timestamp"] = bson.M{"$gte": snapshot.Timestamp}
+		case err != mongo.ErrNoDocuments:
+			return nil, err
+		}
+	}
+	if !to.IsZero() {
+		if window, ok := filter["timestamp"].(bson.M); ok {
+			window["$lte"] = to
+		} else {
+			filter["timestamp"] = bson.M{"$lte": to}
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "seq", Value: 1}}).
+		SetLimit(maxPlaybackEvents + 1)
+	cursor, err := eventCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var events []models.PlaybackEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	truncated := len(events) > maxPlaybackEvents
+	if truncated {
+		events = events[:maxPlaybackEvents]
+	}
+	// Anything before the first snapshot cannot be replayed
+	for len(events) > 0 && events[0].Type != "snapshot" {
+		events = events[1:]
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	// Chat after the last edit belongs to the playback unless events were cut off
+	start, end := events[0].Timestamp, to
+	if truncated {
+		end = events[len(events)-1].Timestamp
+	}
+	chat, err := chats.between(ctx, roomID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergePlayback(roomID, events, chat, truncated), nil
+}
+
+// mergePlayback builds the playback of recorded events, starting with a
+// snapshot, and the chat messages sent meanwhile
+func mergePlayback(roomID primitive.ObjectID, events []models.PlaybackEvent, chat []ChatLogEntry, truncated bool) *Playback {
+	start := events[0].Timestamp
+	playback := &Playback{
+		RoomID:    roomID.Hex(),
+		Start:     start,
+		Users:     make(map[string]string),
+		Events:    make([]PlaybackFrame, 0, len(events)+len(chat)),
+		Truncated: truncated,
+	}
+	type timed struct {
+		at    time.Time
+		frame PlaybackFrame
+	}
+	merged := make([]timed, 0, len(events)+len(chat))
+	for _, e := range events {
+		if e.UserID != "" && e.UserName != "" {
+			playback.Users[e.UserID] = e.UserName
+		}
+		merged = append(merged, timed{e.Timestamp, PlaybackFrame{
+			Type:    e.Type,
+			User:    e.UserID,
+			Path:    e.Path,
+			NewPath: e.NewPath,
+			Ops:     e.Ops,
+			Files:   e.Files,
+		}})
+	}
+	for _, c := range chat {
+		if c.SenderID != "" && c.SenderName != "" {
+			playback.Users[c.SenderID] = c.SenderName
+		}
+		merged = append(merged, timed{c.Timestamp, PlaybackFrame{Type: "chat", User: c.SenderID, Text: c.Content}})
+	}
+	// Events are already in order, chat messages are merged in by time
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].at.Before(merged[j].at) })
+
+	for _, m := range merged {
+		m.frame.Offset = m.at.Sub(start).Milliseconds()
+		playback.Events = append(playback.Events, m.frame)
+	}
+	playback.Duration = playback.Events[len(playback.Events)-1].Offset
+	return playback
+}
@@ -13,6 +13,18 @@ func RegisterSessionRoutes(router *mux.Router) {
 
 	sessionRouter.HandleFunc("/save", SaveSession).Methods("POST")
 	sessionRouter.HandleFunc("/{room_id}", GetSession).Methods("GET")
+	sessionRouter.HandleFunc("/{room_id}/diff", DiffVersions).Methods("GET")
+	sessionRouter.HandleFunc("/{room_id}/files", ListFiles).Methods("GET")
+	sessionRouter.HandleFunc("/{room_id}/files", CreateFile).Methods("POST")
+	sessionRouter.HandleFunc("/{room_id}/files", DeleteFile).Methods("DELETE")
+	sessionRouter.HandleFunc("/{room_id}/files/rename", RenameFile).Methods("POST")
+	sessionRouter.HandleFunc("/{room_id}/files/move", MoveFile).Methods("POST")
+	sessionRouter.HandleFunc("/{room_id}/git", ExportGit).Methods("GET")
+	sessionRouter.HandleFunc("/{room_id}/import", ImportWorkspace).Methods("POST")
+	sessionRouter.HandleFunc("/{room_id}/playback", GetPlayback).Methods("GET")
+	sessionRouter.HandleFunc("/{room_id}/versions", ListVersions).Methods("GET")
+	sessionRouter.HandleFunc("/{room_id}/versions/{revision}", GetVersion).Methods("GET")
+	sessionRouter.HandleFunc("/{room_id}/versions/{revision}/restore", RestoreVersion).Methods("POST")
 	sessionRouter.HandleFunc("/export/{room_id}", ExportSession).Methods("GET")
 	sessionRouter.HandleFunc("/audit", LogAudit).Methods("POST")
 	sessionRouter.HandleFunc("/audit/{room_id}", GetAuditLogs).Methods("GET")
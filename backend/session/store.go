@@ -0,0 +1,212 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"example.com/collaborative-coding-editor/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoadSession returns the stored session of a room, or nil if nothing was saved yet.
+// It is used by the collaboration hub to seed the room document.
+func LoadSession(roomIDStr string) (*models.Session, error) {
+	roomID, err := primitive.ObjectIDFromHex(roomIDStr)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionCollection := auth.GetCollection("sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var sess models.Session
+	err = sessionCollection.FindOne(ctx, bson.M{"room_id": roomID}).Decode(&sess)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// ErrStaleRevision is returned when a save is based on an outdated revision
+var ErrStaleRevision = errors.New("session was modified since the base revision")
+
+// StoreSession saves the code of a room as a new revision, creating its
+// session on the first save. The language is kept unless it is empty.
+// userID and the contributors are added to the users who edited the session.
+func StoreSession(roomID primitive.ObjectID, code, language, userID string, contributors ...string) (*models.Session, error) {
+	return storeSession(bson.M{"room_id": roomID}, true, codeFields(code, language), nil, userID, contributors, false)
+}
+
+// codeFields -> session fields set by a save of the main file
+func codeFields(code, language string) bson.M {
+	fields := bson.M{"code": code}
+	if language != "" {
+		fields["language"] = language
+	}
+	return fields
+}
+
+// StoreSessionAt saves the code only if the session is still at baseRevision.
+// ErrStaleRevision is returned, and nothing saved, if somebody saved in between.
+func StoreSessionAt(roomID primitive.ObjectID, baseRevision int64, code, language, userID string) (*models.Session, error) {
+	// A save based on revision 0 creates the session if there is none yet.
+	// Of two such saves only one can insert it, the unique room_id index
+	// makes the other fail.
+	sess, err := storeSession(revisionFilter(roomID, baseRevision), baseRevision == 0, codeFields(code, language), nil, userID, nil, false)
+	if err == mongo.ErrNoDocuments || mongo.IsDuplicateKeyError(err) {
+		return nil, ErrStaleRevision
+	}
+	return sess, err
+}
+
+// revisionFilter matches the session of a room at the given revision
+func revisionFilter(roomID primitive.ObjectID, revision int64) bson.M {
+	filter := bson.M{"room_id": roomID, "revision": revision}
+	if revision == 0 {
+		// Sessions saved before revisions existed have no revision field
+		filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	return filter
+}
+
+// EnsureIndexes makes sessions unique per room, so that only one first save
+// of a room can create its session
+func EnsureIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := auth.GetCollection("sessions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "room_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Error creating session indexes: %v", err)
+	}
+}
+
+// storeSession sets the given fields on the session matched by filter as a
+// new revision and keeps a copy of the resulting workspace as a version
+func storeSession(filter bson.M, upsert bool, fields bson.M, arrayFilters []interface{}, userID string, contributors []string, autosave bool) (*models.Session, error) {
+	sessionCollection := auth.GetCollection("sessions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	set := bson.M{
+		"last_saved":  time.Now(),
+		"updated_by":  userID,
+		"modified_at": time.Now(),
+	}
+	for field, value := range fields {
+		set[field] = value
+	}
+	update := bson.M{
+		"$set": set,
+		"$setOnInsert": bson.M{
+			"created_at": time.Now(),
+		},
+		"$addToSet": bson.M{
+			"contributors": bson.M{"$each": append(contributors, userID)},
+		},
+		"$inc": bson.M{
+			"revision": 1,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.After)
+	if len(arrayFilters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: arrayFilters})
+	}
+
+	var sess models.Session
+	if err := sessionCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&sess); err != nil {
+		return nil, err
+	}
+
+	// Keep the code of every revision, stale saves are merged against them
+	version := models.SessionVersion{
+		ID:        primitive.NewObjectID(),
+		RoomID:    sess.RoomID,
+		Revision:  sess.Revision,
+		Code:      sess.Code,
+		MainFile:  sess.MainFile,
+		Files:     sess.Files,
+		UpdatedBy: userID,
+		CreatedAt: sess.ModifiedAt,
+		Autosave:  autosave,
+	}
+	if _, err := auth.GetCollection("session_versions").InsertOne(ctx, version); err != nil {
+		log.Printf("Error saving session version: %v", err)
+	}
+	return &sess, nil
+}
+
+// LoadVersion returns the code of a session at the given revision, or nil if it was not kept
+func LoadVersion(roomID primitive.ObjectID, revision int64) (*models.SessionVersion, error) {
+	versionCollection := auth.GetCollection("session_versions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var version models.SessionVersion
+	err := versionCollection.FindOne(ctx, bson.M{"room_id": roomID, "revision": revision}).Decode(&version)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// AutoSave stores the documents of a live room on behalf of the users who
+// edited them and records the save in the audit log. code is the content of
+// the main file, files the content of every other file by path. Files that
+// were moved or deleted in the meantime are left alone. The new revision is
+// returned. The documents must still be based on baseRevision, otherwise
+// nothing is saved and the current revision is returned with ErrStaleRevision.
+func AutoSave(roomID primitive.ObjectID, baseRevision int64, code string, files map[string]string, lastEditor string, contributors []string) (int64, error) {
+	fields := bson.M{"code": code}
+	var arrayFilters []interface{}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		id := "f" + strconv.Itoa(i)
+		fields["files.$["+id+"].content"] = files[path]
+		arrayFilters = append(arrayFilters, bson.M{id + ".path": path, id + ".folder": bson.M{"$ne": true}})
+	}
+
+	sess, err := storeSession(revisionFilter(roomID, baseRevision), baseRevision == 0, fields, arrayFilters, lastEditor, contributors, true)
+	if err == mongo.ErrNoDocuments || mongo.IsDuplicateKeyError(err) {
+		current, err := LoadSession(roomID.Hex())
+		if err != nil {
+			return 0, err
+		}
+		if current == nil {
+			return 0, ErrStaleRevision
+		}
+		return current.Revision, ErrStaleRevision
+	}
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		summary := fmt.Sprintf("Session auto-saved by the server, edited by %s.", strings.Join(contributors, ", "))
+		addAuditLog(roomID, lastEditor, "auto-save", saveDetails(sess, summary))
+	}()
+	return sess.Revision, nil
+}
@@ -0,0 +1,273 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/collaborative-coding-editor/auth"
+	"example.com/collaborative-coding-editor/models"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RestoreHook is called after a session was saved outside the live room,
+// e.g. a restored version or a save through the API, so that a live room
+// picks up the saved workspace. It is set by main to the collaboration service.
+var RestoreHook func(sess *models.Session, userID string) error
+
+// VersionSummary describes one saved revision without its code
+type VersionSummary struct {
+	Revision  int64     `json:"revision"`
+	UpdatedBy string    `json:"updated_by"` // Author (by user_id) of the revision
+	CreatedAt time.Time `json:"created_at"`
+	Size      int       `json:"size"`               // Length of the code in bytes
+	Autosave  bool      `json:"autosave,omitempty"` // Saved by the live room rather than by a user
+}
+
+// ListVersions returns every saved revision of a room, newest first.
+func ListVersions(w http.ResponseWriter, r *http.Request) {
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
+		return
+	}
+
+	versionCollection := auth.GetCollection("session_versions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.M{"revision": -1})
+	cursor, err := versionCollection.Find(ctx, bson.M{"room_id": roomID}, opts)
+	if err != nil {
+		http.Error(w, "Error retrieving versions", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	versions := []VersionSummary{}
+	for cursor.Next(ctx) {
+		var v models.SessionVersion
+		if err := cursor.Decode(&v); err != nil {
+			log.Printf("Error decoding session version: %v", err)
+			continue
+		}
+		versions = append(versions, VersionSummary{
+			Revision:  v.Revision,
+			UpdatedBy: v.UpdatedBy,
+			CreatedAt: v.CreatedAt,
+			Size:      len(v.Code),
+			Autosave:  v.Autosave,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// GetVersion returns the code of a room at one revision.
+func GetVersion(w http.ResponseWriter, r *http.Request) {
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
+		return
+	}
+	version, ok := loadVersion(w, r, roomID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+}
+
+// RestoreVersion saves the code of an earlier revision as the newest revision
+// of the session and replaces the document of the live room.
+func RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	roomID, userID, ok := roomAccess(w, r, AccessWrite)
+	if !ok {
+		return
+	}
+	version, ok := loadVersion(w, r, roomID)
+	if !ok {
+		return
+	}
+
+	files := version.Files
+	if files == nil {
+		files = []models.WorkspaceFile{}
+	}
+	fields := bson.M{"code": version.Code, "main_file": version.MainFile, "files": files}
+	sess, err := storeSession(bson.M{"room_id": roomID}, true, fields, nil, userID, nil, false)
+	if err != nil {
+		log.Printf("Error restoring session: %v", err)
+		http.Error(w, "Error restoring session", http.StatusInternalServerError)
+		return
+	}
+
+	if RestoreHook != nil {
+		if err := RestoreHook(sess, userID); err != nil {
+			log.Printf("Error updating live room %s: %v", roomID.Hex(), err)
+		}
+	}
+
+	go addAuditLog(roomID, userID, "restore", fmt.Sprintf("Restored revision %d as revision %d.", version.Revision, sess.Revision))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sess)
+}
+
+// loadVersion loads the revision named in the path, answering the request on error
+func loadVersion(w http.ResponseWriter, r *http.Request, roomID primitive.ObjectID) (*models.SessionVersion, bool) {
+	revision, err := strconv.ParseInt(mux.Vars(r)["revision"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return nil, false
+	}
+	version, err := LoadVersion(roomID, revision)
+	if err != nil {
+		http.Error(w, "Error retrieving version", http.StatusInternalServerError)
+		return nil, false
+	}
+	if version == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil, false
+	}
+	return version, true
+}
+
+// DiffResponse is the difference between two revisions of a session
+type DiffResponse struct {
+	From    int64  `json:"from"` // Revision compared from, 0 is the empty session
+	To      int64  `json:"to"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+	Unified string `json:"unified"`
+	Hunks   []Hunk `json:"hunks"`
+}
+
+// DiffVersions compares a file, by default the main file, between two
+// revisions of a session. from and to are revision numbers or RFC 3339
+// timestamps, which select the revision current at that time. from
+// defaults to the empty session and to to the latest revision.
+func DiffVersions(w http.ResponseWriter, r *http.Request) {
+	roomID, _, ok := roomAccess(w, r, AccessRead)
+	if !ok {
+		return
+	}
+
+	from, err := resolveVersion(roomID, r.URL.Query().Get("from"), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := resolveVersion(roomID, r.URL.Query().Get("to"), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Compare the main file unless another file is asked for
+	file := r.URL.Query().Get("path")
+	if file != "" {
+		if file, err = CleanPath(file); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	oldName, newName := fmt.Sprintf("revision %d", from.Revision), fmt.Sprintf("revision %d", to.Revision)
+	if file != "" {
+		oldName, newName = oldName+"/"+file, newName+"/"+file
+	}
+
+	hunks := Diff(versionFile(from, file), versionFile(to, file))
+	added, removed := DiffStat(hunks)
+	if hunks == nil {
+		hunks = []Hunk{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DiffResponse{
+		From:    from.Revision,
+		To:      to.Revision,
+		Added:   added,
+		Removed: removed,
+		Unified: UnifiedDiff(oldName, newName, hunks),
+		Hunks:   hunks,
+	})
+}
+
+// versionFile -> content of a file in a version, "" for the main file. Files
+// missing from the version are empty.
+func versionFile(version *models.SessionVersion, file string) string {
+	if file == "" || file == version.MainFile || (version.MainFile == "" && file == DefaultMainFile) {
+		return version.Code
+	}
+	for _, f := range version.Files {
+		if f.Path == file && !f.Folder {
+			return f.Content
+		}
+	}
+	return ""
+}
+
+// resolveVersion finds the revision selected by a diff parameter. Revision
+// 0 and times before the first save select the empty session.
+func resolveVersion(roomID primitive.ObjectID, value string, latest bool) (*models.SessionVersion, error) {
+	filter := bson.M{"room_id": roomID}
+	switch {
+	case value == "" && !latest, value == "0":
+		return &models.SessionVersion{RoomID: roomID}, nil
+	case value == "":
+	default:
+		if revision, err := strconv.ParseInt(value, 10, 64); err == nil {
+			version, err := LoadVersion(roomID, revision)
+			if err != nil {
+				return nil, err
+			}
+			if version == nil {
+				return nil, fmt.Errorf("revision %d not found", revision)
+			}
+			return version, nil
+		}
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revision or timestamp %q", value)
+		}
+		filter["created_at"] = bson.M{"$lte": at}
+	}
+
+	versionCollection := auth.GetCollection("session_versions")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var version models.SessionVersion
+	opts := options.FindOne().SetSort(bson.M{"revision": -1})
+	err := versionCollection.FindOne(ctx, filter, opts).Decode(&version)
+	if err == mongo.ErrNoDocuments {
+		return &models.SessionVersion{RoomID: roomID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// saveDetails describes a save for the audit log with the lines it changed
+func saveDetails(sess *models.Session, summary string) string {
+	previous := ""
+	if sess.Revision > 1 {
+		version, err := LoadVersion(sess.RoomID, sess.Revision-1)
+		if err != nil || version == nil {
+			return summary
+		}
+		previous = version.Code
+	}
+	added, removed := DiffStat(Diff(previous, sess.Code))
+	return fmt.Sprintf("%s Revision %d, %d lines added, %d removed.", summary, sess.Revision, added, removed)
+}
@@ -0,0 +1,203 @@
+package session
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	"example.com/collaborative-coding-editor/models"
+)
+
+// Path of the main file of sessions saved before workspaces existed
+const DefaultMainFile = "main"
+
+// Limits of a single workspace
+const (
+	maxWorkspaceEntries = 500
+	maxPathLength       = 255
+)
+
+var (
+	ErrInvalidPath   = errors.New("invalid path")
+	ErrFileExists    = errors.New("a file or folder with this path already exists")
+	ErrFileNotFound  = errors.New("file or folder not found")
+	ErrNotAFolder    = errors.New("parent is not a folder")
+	ErrMainFile      = errors.New("the main file cannot be deleted")
+	ErrTooManyFiles  = errors.New("too many files in the workspace")
+	ErrMoveIntoSelf  = errors.New("a folder cannot be moved into itself")
+	errWorkspaceBusy = errors.New("workspace was modified concurrently")
+)
+
+// MainFile -> path of the file a session keeps in Code
+func MainFile(sess *models.Session) string {
+	if sess == nil || sess.MainFile == "" {
+		return DefaultMainFile
+	}
+	return sess.MainFile
+}
+
+// WorkspaceFiles -> every file and folder of a session including the main
+// file, sorted by path
+func WorkspaceFiles(sess *models.Session) []models.WorkspaceFile {
+	return newWorkspace(sess).list()
+}
+
+// CleanPath normalises a workspace path and rejects paths leaving the workspace
+func CleanPath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, "\\") || len(p) > maxPathLength {
+		return "", ErrInvalidPath
+	}
+	cleaned := path.Clean(p)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrInvalidPath
+	}
+	return cleaned, nil
+}
+
+// workspace is the file tree of a session while it is being changed
+type workspace struct {
+	mainFile string
+	entries  map[string]models.WorkspaceFile
+}
+
+func newWorkspace(sess *models.Session) *workspace {
+	ws := &workspace{mainFile: MainFile(sess), entries: make(map[string]models.WorkspaceFile)}
+	code := ""
+	if sess != nil {
+		code = sess.Code
+		for _, f := range sess.Files {
+			ws.entries[f.Path] = f
+		}
+	}
+	ws.entries[ws.mainFile] = models.WorkspaceFile{Path: ws.mainFile, Content: code}
+	return ws
+}
+
+func (ws *workspace) list() []models.WorkspaceFile {
+	files := make([]models.WorkspaceFile, 0, len(ws.entries))
+	for _, f := range ws.entries {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// setContents replaces the content of the files found in contents
+func (ws *workspace) setContents(contents map[string]string) {
+	for p, content := range contents {
+		if entry, ok := ws.entries[p]; ok && !entry.Folder {
+			entry.Content = content
+			ws.entries[p] = entry
+		}
+	}
+}
+
+// fields -> the session fields storing the workspace
+func (ws *workspace) fields() (code string, files []models.WorkspaceFile) {
+	files = []models.WorkspaceFile{}
+	for _, f := range ws.list() {
+		if f.Path == ws.mainFile {
+			code = f.Content
+			continue
+		}
+		files = append(files, f)
+	}
+	return code, files
+}
+
+// under -> true if p is dir itself or inside it
+func under(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// makeParents creates the missing folders above p
+func (ws *workspace) makeParents(p string) error {
+	dir := path.Dir(p)
+	if dir == "." {
+		return nil
+	}
+	if parent, ok := ws.entries[dir]; ok {
+		if !parent.Folder {
+			return ErrNotAFolder
+		}
+		return nil
+	}
+	if err := ws.makeParents(dir); err != nil {
+		return err
+	}
+	ws.entries[dir] = models.WorkspaceFile{Path: dir, Folder: true}
+	return nil
+}
+
+// create adds a file or folder, creating missing parent folders
+func (ws *workspace) create(p string, folder bool, content string) error {
+	if _, ok := ws.entries[p]; ok {
+		return ErrFileExists
+	}
+	if err := ws.makeParents(p); err != nil {
+		return err
+	}
+	if folder {
+		content = ""
+	}
+	ws.entries[p] = models.WorkspaceFile{Path: p, Folder: folder, Content: content}
+	return ws.checkSize()
+}
+
+// move renames a file or folder, moving everything inside a folder along
+func (ws *workspace) move(from, to string) error {
+	entry, ok := ws.entries[from]
+	if !ok {
+		return ErrFileNotFound
+	}
+	if from == to {
+		return nil
+	}
+	if entry.Folder && under(to, from) {
+		return ErrMoveIntoSelf
+	}
+	if _, ok := ws.entries[to]; ok {
+		return ErrFileExists
+	}
+	if err := ws.makeParents(to); err != nil {
+		return err
+	}
+
+	for p, f := range ws.entries {
+		if !under(p, from) {
+			continue
+		}
+		delete(ws.entries, p)
+		f.Path = to + strings.TrimPrefix(p, from)
+		ws.entries[f.Path] = f
+	}
+	if under(ws.mainFile, from) {
+		ws.mainFile = to + strings.TrimPrefix(ws.mainFile, from)
+	}
+	return ws.checkSize()
+}
+
+// remove deletes a file, or a folder with everything inside it
+func (ws *workspace) remove(p string) error {
+	if _, ok := ws.entries[p]; !ok {
+		return ErrFileNotFound
+	}
+	if under(ws.mainFile, p) {
+		return ErrMainFile
+	}
+	for q := range ws.entries {
+		if under(q, p) {
+			delete(ws.entries, q)
+		}
+	}
+	return nil
+}
+
+func (ws *workspace) checkSize() error {
+	if len(ws.entries) > maxWorkspaceEntries {
+		return ErrTooManyFiles
+	}
+	return nil
+}
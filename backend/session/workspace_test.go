@@ -0,0 +1,45 @@
+package session
+
+import (
+	"testing"
+
+	"example.com/collaborative-coding-editor/models"
+)
+
+func TestWorkspaceChangeKeepsLiveContents(t *testing.T) {
+	sess := &models.Session{
+		Code: "saved main",
+		Files: []models.WorkspaceFile{
+			{Path: "lib", Folder: true},
+			{Path: "lib/util.py", Content: "saved util"},
+		},
+	}
+	ws := newWorkspace(sess)
+	// Edits made in the room since the last autosave
+	ws.setContents(map[string]string{
+		DefaultMainFile: "live main",
+		"lib/util.py":   "live util",
+		"lib":           "not a file",
+		"gone.py":       "deleted meanwhile",
+	})
+	if err := ws.move("lib", "src"); err != nil {
+		t.Fatal(err)
+	}
+
+	code, files := ws.fields()
+	if code != "live main" {
+		t.Fatalf("main file %q, want the live text", code)
+	}
+	want := map[string]models.WorkspaceFile{
+		"src":         {Path: "src", Folder: true},
+		"src/util.py": {Path: "src/util.py", Content: "live util"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("files %+v", files)
+	}
+	for _, f := range files {
+		if f != want[f.Path] {
+			t.Fatalf("file %+v, want %+v", f, want[f.Path])
+		}
+	}
+}
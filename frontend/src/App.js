@@ -4,6 +4,10 @@ import { BrowserRouter as Router, Routes, Route } from 'react-router-dom';
 import { AuthProvider } from './components/Auth/AuthContext';
 import Login from './components/Auth/Login';
 import Register from './components/Auth/Register';
+import ForgotPassword from './components/Auth/ForgotPassword';
+import ResetPassword from './components/Auth/ResetPassword';
+import VerifyEmail from './components/Auth/VerifyEmail';
+import SsoCallback from './components/Auth/SsoCallback';
 import Dashboard from './components/Dashboard';
 import RoomCreation from './components/RoomCreation';
 import RoomJoin from './components/RoomJoin';
@@ -21,6 +25,10 @@ const App = () => {
         <Routes>
           <Route path="/login" element={<Login />} />
           <Route path="/register" element={<Register />} />
+          <Route path="/forgot-password" element={<ForgotPassword />} />
+          <Route path="/reset-password" element={<ResetPassword />} />
+          <Route path="/verify-email" element={<VerifyEmail />} />
+          <Route path="/sso/callback" element={<SsoCallback />} />
           <Route path="/dashboard" element={<ProtectedRoute><Dashboard /></ProtectedRoute>} />
           <Route path="/room/create" element={<ProtectedRoute><RoomCreation /></ProtectedRoute>} />
           <Route path="/room/join" element={<ProtectedRoute><RoomJoin /></ProtectedRoute>} />
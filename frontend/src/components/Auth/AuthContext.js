@@ -1,5 +1,5 @@
 import React, { createContext, useState, useEffect } from 'react';
-import { getLocalAccessToken,clearLocalTokens } from '../../services/authService';
+import { getLocalAccessToken, logout as logoutSession } from '../../services/authService';
 import { jwtDecode } from 'jwt-decode'; // Use named import if needed
 
 export const AuthContext = createContext();
@@ -20,8 +20,8 @@ export const AuthProvider = ({ children }) => {
   }, [accessToken]);
 
   const logout = () => {
-    // Clear tokens from storage.
-    clearLocalTokens();
+    // Revoke the refresh token and clear tokens from storage.
+    logoutSession().catch((error) => console.error('Logout failed:', error));
     // Clear user state.
     setAccessToken(null);
     setUser(null);
@@ -0,0 +1,40 @@
+// src/components/Auth/ForgotPassword.js
+import React, { useState } from 'react';
+import { Link } from 'react-router-dom';
+import { forgotPassword } from '../../services/authService';
+
+const ForgotPassword = () => {
+  const [email, setEmail] = useState('');
+  const [message, setMessage] = useState('');
+  const [error, setError] = useState('');
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    setError('');
+    try {
+      const data = await forgotPassword(email);
+      setMessage(data.message);
+    } catch (err) {
+      setError('Could not send the reset link, please try again');
+    }
+  };
+
+  return (
+    <div className="auth-container">
+      <h2>Forgot Password</h2>
+      {error && <p style={{ color: 'red' }}>{error}</p>}
+      {message ? (
+        <p>{message}</p>
+      ) : (
+        <form onSubmit={handleSubmit}>
+          <label>Email:</label>
+          <input type="email" value={email} onChange={(e) => setEmail(e.target.value)} required />
+          <button type="submit">Send reset link</button>
+        </form>
+      )}
+      <p><Link to="/login">Back to login</Link></p>
+    </div>
+  );
+};
+
+export default ForgotPassword;
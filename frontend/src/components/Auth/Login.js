@@ -2,14 +2,19 @@
 import React, { useState, useContext } from 'react';
 import { login } from '../../services/authService';
 import { AuthContext } from './AuthContext';
-import { useNavigate } from 'react-router-dom';
+import { Link, useNavigate, useSearchParams } from 'react-router-dom';
+
+const API_BASE_URL = process.env.REACT_APP_API_BASE_URL || 'http://localhost:8080';
+const SSO_ENABLED = process.env.REACT_APP_SSO_ENABLED === 'true';
 
 const Login = () => {
   const { setAccessToken } = useContext(AuthContext);
   const navigate = useNavigate();
+  const [searchParams] = useSearchParams();
   const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
-  const [error, setError] = useState('');
+  // A failed single sign-on comes back here with its error
+  const [error, setError] = useState(searchParams.get('sso_error') || '');
 
   const handleSubmit = async (e) => {
     e.preventDefault();
@@ -33,6 +38,12 @@ const Login = () => {
         <input type="password" value={password} onChange={(e) => setPassword(e.target.value)} required />
         <button type="submit">Login</button>
       </form>
+      {SSO_ENABLED && (
+        <button type="button" onClick={() => { window.location.href = `${API_BASE_URL}/auth/oidc/login`; }}>
+          Sign in with SSO
+        </button>
+      )}
+      <p><Link to="/forgot-password">Forgot your password?</Link></p>
     </div>
   );
 };
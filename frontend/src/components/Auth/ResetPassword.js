@@ -0,0 +1,54 @@
+// src/components/Auth/ResetPassword.js
+import React, { useState } from 'react';
+import { Link, useNavigate, useSearchParams } from 'react-router-dom';
+import { resetPassword } from '../../services/authService';
+
+const ResetPassword = () => {
+  const [searchParams] = useSearchParams();
+  const navigate = useNavigate();
+  const token = searchParams.get('token') || '';
+  const [password, setPassword] = useState('');
+  const [confirm, setConfirm] = useState('');
+  const [error, setError] = useState('');
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    if (password !== confirm) {
+      setError('Passwords do not match');
+      return;
+    }
+    try {
+      await resetPassword(token, password);
+      navigate('/login');
+    } catch (err) {
+      setError('The reset link is invalid or has expired');
+    }
+  };
+
+  if (!token) {
+    return (
+      <div className="auth-container">
+        <h2>Reset Password</h2>
+        <p style={{ color: 'red' }}>The reset link is incomplete.</p>
+        <p><Link to="/forgot-password">Request a new link</Link></p>
+      </div>
+    );
+  }
+
+  return (
+    <div className="auth-container">
+      <h2>Reset Password</h2>
+      {error && <p style={{ color: 'red' }}>{error}</p>}
+      <form onSubmit={handleSubmit}>
+        <label>New password:</label>
+        <input type="password" value={password} onChange={(e) => setPassword(e.target.value)} required />
+        <label>Confirm password:</label>
+        <input type="password" value={confirm} onChange={(e) => setConfirm(e.target.value)} required />
+        <button type="submit">Reset password</button>
+      </form>
+      <p><Link to="/forgot-password">Request a new link</Link></p>
+    </div>
+  );
+};
+
+export default ResetPassword;
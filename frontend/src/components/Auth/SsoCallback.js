@@ -0,0 +1,30 @@
+// src/components/Auth/SsoCallback.js
+import React, { useEffect, useContext } from 'react';
+import { useNavigate } from 'react-router-dom';
+import { setLocalTokens } from '../../services/authService';
+import { AuthContext } from './AuthContext';
+
+// Receives the tokens of a single sign-on from the URL fragment.
+const SsoCallback = () => {
+  const { setAccessToken } = useContext(AuthContext);
+  const navigate = useNavigate();
+
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    const accessToken = params.get('access_token');
+    const refreshToken = params.get('refresh_token');
+    // Drop the tokens from the address bar and history
+    window.history.replaceState(null, '', window.location.pathname);
+    if (!accessToken || !refreshToken) {
+      navigate('/login?sso_error=' + encodeURIComponent('Single sign-on failed'), { replace: true });
+      return;
+    }
+    setLocalTokens({ access_token: accessToken, refresh_token: refreshToken });
+    setAccessToken(accessToken);
+    navigate('/dashboard', { replace: true });
+  }, [navigate, setAccessToken]);
+
+  return <p>Signing in...</p>;
+};
+
+export default SsoCallback;
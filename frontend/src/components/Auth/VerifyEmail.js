@@ -0,0 +1,34 @@
+// src/components/Auth/VerifyEmail.js
+import React, { useEffect, useRef, useState } from 'react';
+import { Link, useSearchParams } from 'react-router-dom';
+import { verifyEmail } from '../../services/authService';
+
+const VerifyEmail = () => {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token') || '';
+  const [status, setStatus] = useState(token ? 'verifying' : 'invalid');
+  // The token works once, don't send it twice
+  const sent = useRef(false);
+
+  useEffect(() => {
+    if (!token || sent.current) return;
+    sent.current = true;
+    verifyEmail(token)
+      .then(() => setStatus('verified'))
+      .catch(() => setStatus('invalid'));
+  }, [token]);
+
+  return (
+    <div className="auth-container">
+      <h2>Verify Email</h2>
+      {status === 'verifying' && <p>Verifying your email...</p>}
+      {status === 'verified' && <p>Your email is verified. You can now accept invitations sent to it.</p>}
+      {status === 'invalid' && (
+        <p style={{ color: 'red' }}>The verification link is invalid or has expired. Log in to request a new one.</p>
+      )}
+      <p><Link to="/dashboard">Go to dashboard</Link></p>
+    </div>
+  );
+};
+
+export default VerifyEmail;
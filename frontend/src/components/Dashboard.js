@@ -1,11 +1,32 @@
 // src/components/Dashboard.js
-import React from 'react';
+import React, { useContext, useState } from 'react';
 import { Link } from 'react-router-dom';
+import { AuthContext } from './Auth/AuthContext';
+import { resendVerification } from '../services/authService';
 
 const Dashboard = () => {
+  const { user } = useContext(AuthContext);
+  const [notice, setNotice] = useState('');
+
+  const handleResend = async () => {
+    try {
+      const data = await resendVerification();
+      setNotice(data.message);
+    } catch (err) {
+      setNotice(err.response?.data || 'Could not send the verification email');
+    }
+  };
+
   return (
     <div className="dashboard">
       <h2>Dashboard</h2>
+      {user && user.email_verified === false && (
+        <div className="verify-banner">
+          <p>Please verify your email to accept invitations sent to it.</p>
+          <button onClick={handleResend}>Resend verification email</button>
+          {notice && <p>{notice}</p>}
+        </div>
+      )}
       <div className="dashboard-actions">
         <Link to="/room/create">
           <button>Create Room (Admin)</button>
@@ -2,11 +2,12 @@
 import React, { useEffect, useState, useRef, useContext } from 'react';
 import { useParams, useNavigate } from 'react-router-dom';
 import MonacoEditor from "react-monaco-editor";
-import { getSession, saveSession } from '../services/sessionService';
+import { getSession } from '../services/sessionService';
 import { compileCode } from '../services/compilerService';
 import Chat from './Chat';
 import { AuthContext } from './Auth/AuthContext';
 import { closeRoom } from '../services/roomService';
+import { getFreshAccessToken } from '../services/api';
 
 const Editor = () => {
   const { roomId } = useParams();
@@ -17,8 +18,8 @@ const Editor = () => {
   const [ws, setWs] = useState(null);
   const [language, setLanguage] = useState('python3');
   const [versionIndex, setVersionIndex] = useState('3');
-  const autoSaveRef = useRef(null);
-  const [toast, setToast] = useState("");
+  // Revision of the main file the code is at, sent by the server with edits and snapshots
+  const revisionRef = useRef(0);
 
   // Load session state on mount.
   useEffect(() => {
@@ -35,46 +36,51 @@ const Editor = () => {
 
   // Establish WebSocket connection.
   useEffect(() => {
-    const token = localStorage.getItem("access_token");
-    const wsUrl = `${process.env.REACT_APP_WS_URL || 'ws://localhost:8080'}/collaboration/${roomId}?token=${encodeURIComponent(token)}`;
-    const socket = new WebSocket(wsUrl);
-    socket.onopen = () => console.log('WebSocket connected');
-    socket.onmessage = (event) => {
-      const message = JSON.parse(event.data);
-      if (message.type === "edit") {
-        setCode(message.content);
-      } else if (message.content && message.content.includes("joined the room")) {
-        // Optionally update presence UI.
-      } else if (message.content && message.content.includes("Room has been closed")) {
-        alert(message.content);
-        navigate('/dashboard');
+    let socket = null;
+    let cancelled = false;
+    const connect = async () => {
+      // Access tokens are short lived, the handshake needs a valid one
+      let token;
+      try {
+        token = await getFreshAccessToken();
+      } catch (err) {
+        console.error('Token refresh failed:', err);
+        navigate('/login');
+        return;
       }
-      // Chat messages are handled in Chat component.
-    };
-    socket.onerror = (err) => console.error('WebSocket error:', err);
-    socket.onclose = () => console.log('WebSocket disconnected');
-    setWs(socket);
-    return () => socket.close();
-  }, [roomId, navigate]);
-
-  // Auto-save every 30 seconds and on tab close.
-  useEffect(() => {
-    autoSaveRef.current = setInterval(() => {
-      saveSession(roomId, code)
-        .then(() => showToast("Code saved"))
-        .catch((err) => console.error("Auto-save failed", err));
-    }, 30000);
-
-    const handleBeforeUnload = async (e) => {
-      await saveSession(roomId, code);
-      showToast("Code saved");
+      if (cancelled) return;
+      const wsUrl = `${process.env.REACT_APP_WS_URL || 'ws://localhost:8080'}/collaboration/${roomId}?token=${encodeURIComponent(token)}`;
+      socket = new WebSocket(wsUrl);
+      socket.onopen = () => console.log('WebSocket connected');
+      socket.onmessage = (event) => {
+        const message = JSON.parse(event.data);
+        if (message.type === "snapshot") {
+          // Sent on connect and whenever the server resynchronises this client
+          setCode(message.content || '');
+          revisionRef.current = message.revision || 0;
+        } else if (message.type === "edit") {
+          setCode(message.content);
+          revisionRef.current = message.revision || revisionRef.current;
+        } else if (message.type === "ack") {
+          revisionRef.current = message.revision || revisionRef.current;
+        } else if (message.content && message.content.includes("joined the room")) {
+          // Optionally update presence UI.
+        } else if (message.content && message.content.includes("Room has been closed")) {
+          alert(message.content);
+          navigate('/dashboard');
+        }
+        // Chat messages are handled in Chat component.
+      };
+      socket.onerror = (err) => console.error('WebSocket error:', err);
+      socket.onclose = () => console.log('WebSocket disconnected');
+      setWs(socket);
     };
-    window.addEventListener("beforeunload", handleBeforeUnload);
+    connect();
     return () => {
-      clearInterval(autoSaveRef.current);
-      window.removeEventListener("beforeunload", handleBeforeUnload);
+      cancelled = true;
+      if (socket) socket.close();
     };
-  }, [roomId, code]);
+  }, [roomId, navigate]);
 
   const handleEditorChange = (newValue, e) => {
     setCode(newValue);
@@ -102,11 +108,6 @@ const Editor = () => {
     // Add more as needed.
   ];
 
-  const showToast = (msg) => {
-    setToast(msg);
-    setTimeout(() => setToast(""), 3000);
-  };
-
   // Determine if user is admin.
   const isAdmin = user && user.role === "admin";
 
@@ -149,7 +150,6 @@ const Editor = () => {
         </div>
       )}
       <Chat roomId={roomId} websocket={ws} />
-      {toast && <div className="toast">{toast}</div>}
       {isAdmin && (
         <button
           onClick={async () => {
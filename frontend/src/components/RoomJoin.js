@@ -20,7 +20,12 @@ const RoomJoin = () => {
         setError('Room details not returned by server.');
       }
     } catch (err) {
-      setError('Invalid invite token or server error.');
+      // Invitations sent to an email need the email to be verified first
+      if (err.response?.status === 403) {
+        setError(err.response.data);
+      } else {
+        setError('Invalid invite token or server error.');
+      }
     }
   };
 
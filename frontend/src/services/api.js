@@ -1,6 +1,6 @@
 // src/services/api.js
 import axios from 'axios';
-import { getLocalAccessToken, getLocalRefreshToken, setLocalAccessToken } from './authService';
+import { getLocalAccessToken, getLocalRefreshToken, setLocalTokens } from './authService';
 
 const API_BASE_URL = process.env.REACT_APP_API_BASE_URL || 'http://localhost:8080';
 
@@ -20,6 +20,37 @@ api.interceptors.request.use(
   (error) => Promise.reject(error)
 );
 
+// Refresh tokens are single use, concurrent refreshes share one request
+let refreshing = null;
+const refreshTokens = () => {
+  if (!refreshing) {
+    refreshing = axios
+      .post(`${API_BASE_URL}/auth/refresh`, { refresh_token: getLocalRefreshToken() })
+      .then((res) => {
+        setLocalTokens(res.data);
+        return res;
+      })
+      .finally(() => { refreshing = null; });
+  }
+  return refreshing;
+};
+
+// Access token that is good for at least another 30 seconds, refreshed if
+// needed. For connections that cannot go through the interceptor.
+export const getFreshAccessToken = async () => {
+  const token = getLocalAccessToken();
+  try {
+    const { exp } = JSON.parse(atob(token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')));
+    if (exp * 1000 > Date.now() + 30000) {
+      return token;
+    }
+  } catch (e) {
+    // Not a JWT, let the refresh decide
+  }
+  const res = await refreshTokens();
+  return res.data.access_token;
+};
+
 // Response interceptor: try token refresh on 401 errors.
 api.interceptors.response.use(
   (response) => response,
@@ -28,10 +59,8 @@ api.interceptors.response.use(
     if (error.response && error.response.status === 401 && !originalRequest._retry) {
       originalRequest._retry = true;
       try {
-        const refreshToken = getLocalRefreshToken();
-        const res = await axios.post(`${API_BASE_URL}/auth/refresh`, { refresh_token: refreshToken });
+        const res = await refreshTokens();
         if (res.status === 200) {
-          setLocalAccessToken(res.data.access_token);
           originalRequest.headers['Authorization'] = 'Bearer ' + res.data.access_token;
           return api(originalRequest);
         }
@@ -20,6 +20,18 @@ export const login = async (email, password) => {
   return response.data;
 };
 
+// Revoke the refresh token on the server and forget both tokens.
+export const logout = async () => {
+  const refreshToken = getLocalRefreshToken();
+  const accessToken = getLocalAccessToken();
+  clearLocalTokens();
+  if (refreshToken) {
+    // The access token is sent along so that it is revoked as well
+    const headers = accessToken ? { Authorization: 'Bearer ' + accessToken } : {};
+    await api.post('/auth/logout', { refresh_token: refreshToken }, { headers });
+  }
+};
+
 export const register = async (username, email, password) => {
   const response = await api.post('/auth/register', { username, email, password });
   return response.data;
@@ -30,3 +42,23 @@ export const invitations = async () => {
   const response = await api.get('/auth/invitations');
   return response.data;
 };
+
+export const forgotPassword = async (email) => {
+  const response = await api.post('/auth/password/forgot', { email });
+  return response.data;
+};
+
+export const resetPassword = async (token, password) => {
+  const response = await api.post('/auth/password/reset', { token, password });
+  return response.data;
+};
+
+export const verifyEmail = async (token) => {
+  const response = await api.post('/auth/email/verify', { token });
+  return response.data;
+};
+
+export const resendVerification = async () => {
+  const response = await api.post('/auth/email/resend');
+  return response.data;
+};